@@ -5,30 +5,110 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"time"
 
+	"github.com/efvincent/archex5/auth"
 	"github.com/efvincent/archex5/commands"
 	"github.com/efvincent/archex5/eventStore"
-	"github.com/efvincent/archex5/eventStore/MemoryEventStore"
+	"github.com/efvincent/archex5/eventStore/esErrors.go"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/efvincent/archex5/models"
 	"github.com/efvincent/archex5/processor"
+	"github.com/efvincent/archex5/scheduler"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
-var cmdProc = processor.MakeCmdProc()
+var cmdProc *processor.CmdProc
+var options Options
 
 const COMMAND_TYPE_ATTRIB = "commandType"
 
-func Run(host string, port string) {
+// Settings that change what the API exposes
+type Options struct {
+	// exposes the administrative routes under /api/admin, which can destroy data
+	EnableAdmin bool
+	// authenticates requests, every request needs credentials it accepts unless this is nil
+	Authenticator auth.Authenticator
+	// queues the commands sent with ?async=true, which can't be sent when this is nil
+	Queue *scheduler.CommandQueue
+}
+
+// Runs the API, sending commands to the given command processor
+func Run(cp *processor.CmdProc, host string, port string, opts Options) {
+	cmdProc = cp
+	options = opts
 	router := mux.NewRouter()
-	r := router.HandleFunc("/api/command", commandHandler)
+	r := router.HandleFunc("/api/command", authenticated(commandHandler))
 	r.Methods("POST")
 
-	r = router.HandleFunc("/api/{namespace}/products", getProductsHandler)
+	// ahead of the namespace routes, which would otherwise match it
+	r = router.HandleFunc("/api/commands/{uid}", authenticated(getQueuedCommandHandler))
+	r.Methods("GET")
+
+	if opts.EnableAdmin {
+		r = router.HandleFunc("/api/admin/export", guarded(auth.ROLE_ADMIN, exportHandler))
+		r.Methods("GET")
+
+		r = router.HandleFunc("/api/admin/import", guarded(auth.ROLE_ADMIN, importHandler))
+		r.Methods("POST")
+
+		r = router.HandleFunc("/api/admin/scavenge", guarded(auth.ROLE_ADMIN, scavengeHandler))
+		r.Methods("POST")
+
+		r = router.HandleFunc("/api/admin/{namespace}/retention", guarded(auth.ROLE_ADMIN, retentionHandler))
+		r.Methods("GET", "PUT")
+
+		r = router.HandleFunc("/api/admin/{namespace}/streams/{streamId}", guarded(auth.ROLE_ADMIN, deleteStreamHandler))
+		r.Methods("DELETE")
+
+		r = router.HandleFunc("/api/admin/{namespace}/streams/{streamId}/retention", guarded(auth.ROLE_ADMIN, retentionHandler))
+		r.Methods("GET", "PUT")
+	}
+
+	// before the routes that start with a namespace, so these aren't taken for a namespace's
+	r = router.HandleFunc("/api/namespaces", authenticated(namespacesHandler))
+	r.Methods("GET", "POST")
+
+	r = router.HandleFunc("/api/namespaces/{namespace}", guardedWrites(auth.ROLE_ADMIN, namespaceHandler))
+	r.Methods("GET", "PUT", "DELETE")
+
+	r = router.HandleFunc("/api/namespaces/{namespace}/stats", guarded(auth.ROLE_READ, namespaceStatsHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/products", guarded(auth.ROLE_READ, getProductsHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/products/{sku}", guarded(auth.ROLE_READ, getProductHandler))
+
+	r = router.HandleFunc("/api/{namespace}/products/{sku}/collections", guarded(auth.ROLE_READ, getProductCollectionsHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/products/{sku}/verify", guarded(auth.ROLE_READ, verifyProductHandler))
 	r.Methods("GET")
 
-	r = router.HandleFunc("/api/{namespace}/products/{sku}", getProductHandler)
+	r = router.HandleFunc("/api/{namespace}/products/{sku}/meta", guardedWrites(auth.ROLE_WRITE, productMetadataHandler))
+	r.Methods("GET", "PUT")
+
+	r = router.HandleFunc("/api/{namespace}/products/{sku}/headcheck-monitor", guarded(auth.ROLE_READ, getHeadCheckMonitorHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/price-changes/pending", guarded(auth.ROLE_READ, getPendingPriceChangesHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/collections", guarded(auth.ROLE_READ, getCollectionsHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/collections/{collectionId}", guarded(auth.ROLE_READ, getCollectionHandler))
+	r.Methods("GET")
+
+	r = router.HandleFunc("/api/{namespace}/commands", guarded(auth.ROLE_ADMIN, getCommandLogHandler))
+	r.Methods("GET")
 
 	addr := fmt.Sprintf("%s:%s", host, port)
 	fmt.Printf("Server running. Listening on %s\n", addr)
@@ -62,10 +142,7 @@ func getProductsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var es eventStore.EventStore
-	// some kind of DI might make sense here ... demo approach only
-	es = MemoryEventStore.SingletonMemoryEventStore
-	streamIds, err := es.GetStreams(ns)
+	streamIds, err := cmdProc.GetSkus(ns)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -77,6 +154,536 @@ func getProductsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// Lists the price changes in a namespace that were held for approval
+func getPendingPriceChangesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	pending, err := cmdProc.GetPendingPriceChanges(ns)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// only the products whose ACLs let the principal read them
+	readable := []models.PendingPriceChange{}
+	for _, pc := range pending {
+		err := cmdProc.ActingAs(principalOf(r)).CheckStreamAccess(ns, pc.SKU, eventStore.ACL_READ)
+		if _, denied := err.(*auth.AclError); err != nil && !denied {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not check the ACL of %s: %v", pc.SKU, err)
+			return
+		}
+		if err == nil {
+			readable = append(readable, pc)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespace": ns,
+		"pending":   readable,
+	})
+}
+
+func getCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cols, err := cmdProc.GetCollections(ns)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespace":   ns,
+		"collections": cols,
+	})
+}
+
+func getCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	id := vars["collectionId"]
+	if len(ns) == 0 || len(id) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if c, err := cmdProc.GetCollection(ns, id); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Printf("Could not retrieve: %v", err)
+	}
+}
+
+// Lists the commands in a namespace's command log, optionally only those for a sku and with an
+// outcome (accepted, rejected or conflict)
+func getCommandLogHandler(w http.ResponseWriter, r *http.Request) {
+	ns := mux.Vars(r)["namespace"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	entries, err := cmdProc.GetCommandLog(ns, q.Get("sku"), q.Get("outcome"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Could not get the command log: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespace": ns,
+		"commands":  entries,
+	})
+}
+
+// Queues a command to be processed by the command queue's workers, answering with its uid so its
+// status can be followed at /api/commands/{uid}. Commands the policy doesn't allow are refused
+// before they're queued
+func queueCommand(w http.ResponseWriter, r *http.Request, cp processor.CmdProc, cmd interface{}, entry events.CommandLogged) {
+	if options.Queue == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Commands can't be sent asynchronously, the server has no command queue")
+		return
+	}
+	if err := cp.Authorize(cmd); err != nil {
+		logCommand(cp, cmd, entry, err)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, "API error: %v", err)
+		return
+	}
+	qc, err := options.Queue.Enqueue(entry.UID, entry.CommandType, entry.Payload, cmd, principalOf(r))
+	if err != nil {
+		log.Printf("API error: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not queue the command: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/commands/"+qc.UID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uid":    qc.UID,
+		"status": qc.Status,
+	})
+}
+
+// Gets a queued command's status, and its outcome once it's been processed. Principals can only
+// see the commands sent to namespaces they can read
+func getQueuedCommandHandler(w http.ResponseWriter, r *http.Request) {
+	if options.Queue == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	qc, found := options.Queue.Get(mux.Vars(r)["uid"])
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !allowed(w, r, qc.Namespace, auth.ROLE_READ) {
+		return
+	}
+	// the payload isn't shown, it can hold supplier contacts (see processor.LogCommand), and
+	// only the name of the principal who sent the command is
+	principal := ""
+	if qc.Principal != nil {
+		principal = qc.Principal.Name
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uid":         qc.UID,
+		"namespace":   qc.Namespace,
+		"sku":         qc.SKU,
+		"commandType": qc.CommandType,
+		"principal":   principal,
+		"status":      qc.Status,
+		"outcome":     qc.Outcome,
+		"error":       qc.Error,
+		"events":      qc.Events,
+		"queued":      qc.Queued,
+		"finished":    qc.Finished,
+	})
+}
+
+// Walks the product stream's hash chain, reporting the first broken link if there is one
+func verifyProductHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	sku := vars["sku"]
+	if len(ns) == 0 || len(sku) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if v, err := cmdProc.VerifyStream(ns, sku); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Printf("Could not verify: %v", err)
+	}
+}
+
+// Gets the head check monitor's state for a product, how many head checks in a row have failed
+// and whether the monitor deactivated it
+func getHeadCheckMonitorHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	sku := vars["sku"]
+	if len(ns) == 0 || len(sku) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if m, err := cmdProc.GetHeadCheckMonitor(ns, sku); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Printf("Could not retrieve: %v", err)
+	}
+}
+
+// Gets (GET) or replaces (PUT) the metadata of a product's stream. A PUT has to carry the version
+// of the metadata it replaces, and gets a 409 when the metadata has been set since
+func productMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	sku := vars["sku"]
+	if len(ns) == 0 || len(sku) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == "PUT" {
+		var m eventStore.StreamMetadata
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not unmarshal request body as stream metadata: %v", err)
+			return
+		}
+		if _, err := cmdProc.SetProductMetadata(ns, sku, m); err != nil {
+			status := http.StatusBadRequest
+			if e, ok := err.(*esErrors.ESError); ok && e.ErrCode == esErrors.META_VERSION_EXPECTATION_FAILED {
+				status = http.StatusConflict
+			}
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "Could not set metadata: %v", err)
+			return
+		}
+	}
+	m, err := cmdProc.GetProductMetadata(ns, sku)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not get metadata: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// The body of a request to create a namespace
+type createNamespaceRequest struct {
+	Namespace string                       `json:"namespace"`
+	Settings  eventStore.NamespaceSettings `json:"settings"`
+}
+
+// Lists the namespaces with their info (GET), or creates a namespace (POST). Callers only see the
+// namespaces they can read, and need the admin role in a namespace to create it
+func namespacesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		var req createNamespaceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not unmarshal request body as a namespace: %v", err)
+			return
+		}
+		if !allowed(w, r, req.Namespace, auth.ROLE_ADMIN) {
+			return
+		}
+		if err := cmdProc.CreateNamespace(req.Namespace, req.Settings); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not create namespace: %v", err)
+			return
+		}
+		info, err := cmdProc.GetNamespaceInfo(req.Namespace)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not get namespace: %v", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	nss, err := cmdProc.GetNamespaces()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not get namespaces: %v", err)
+		return
+	}
+	sort.Strings(nss)
+	infos := []eventStore.NamespaceInfo{}
+	p := principalOf(r)
+	for _, ns := range nss {
+		if p != nil && !p.Can(ns, auth.ROLE_READ) {
+			continue
+		}
+		info, err := cmdProc.GetNamespaceInfo(ns)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "Could not get namespace: %v", err)
+			return
+		}
+		infos = append(infos, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespaces": infos,
+	})
+}
+
+// Gets a namespace's info (GET), replaces its settings (PUT), or deletes it (DELETE). A namespace
+// that still has streams is only deleted with force=true, and only when the admin API is enabled
+func namespaceHandler(w http.ResponseWriter, r *http.Request) {
+	ns := mux.Vars(r)["namespace"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		force := r.URL.Query().Get("force") == "true"
+		if force && !options.EnableAdmin {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "Deleting a namespace with its streams needs the admin API to be enabled")
+			return
+		}
+		if err := cmdProc.DeleteNamespace(ns, force); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not delete namespace: %v", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "PUT":
+		var settings eventStore.NamespaceSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not unmarshal request body as namespace settings: %v", err)
+			return
+		}
+		if err := cmdProc.SetNamespaceSettings(ns, settings); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not set namespace settings: %v", err)
+			return
+		}
+	}
+	info, err := cmdProc.GetNamespaceInfo(ns)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not get namespace: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// Gets how much of its quotas a namespace is using
+func namespaceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ns := mux.Vars(r)["namespace"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	usage, err := cmdProc.GetNamespaceUsage(ns)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not get namespace stats: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// Answers when the error is a quota error, with a 413 when the command is too large and otherwise
+// a 429, saying when to retry if waiting will help. Reports whether it did
+func overQuota(w http.ResponseWriter, err error) bool {
+	qe, ok := err.(*processor.QuotaError)
+	if !ok {
+		return false
+	}
+	if qe.TooLarge {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		fmt.Fprintf(w, "API error: %v", err)
+		return true
+	}
+	if qe.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(qe.RetryAfter.Seconds()))))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintf(w, "API error: %v", err)
+	return true
+}
+
+// Reports whether the error is a denial by the policy or by a stream's ACL, which gets a 403
+func forbidden(err error) bool {
+	switch err.(type) {
+	case *auth.PolicyError, *auth.AclError:
+		return true
+	}
+	return false
+}
+
+// Permanently removes a stream from the event store. Only routed when the admin API is enabled
+func deleteStreamHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	streamId := vars["streamId"]
+	if len(ns) == 0 || len(streamId) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err := cmdProc.DeleteStream(ns, streamId); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not delete stream: %v", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Gets (GET) or sets (PUT) the retention policy of a stream, or the namespace's default when
+// the route has no stream. Only routed when the admin API is enabled
+func retentionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	streamId := vars["streamId"]
+	if len(ns) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == "PUT" {
+		var p eventStore.RetentionPolicy
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not unmarshal request body as a retention policy: %v", err)
+			return
+		}
+		if err := cmdProc.SetRetention(ns, streamId, p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Could not set retention: %v", err)
+			return
+		}
+	}
+	p, err := cmdProc.GetRetention(ns, streamId)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Could not get retention: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// Enforces retention policies now rather than waiting for the scavenger. Only routed when the
+// admin API is enabled
+func scavengeHandler(w http.ResponseWriter, r *http.Request) {
+	snapshots, report, err := cmdProc.EnforceRetention()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "Could not enforce retention: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"snapshots": snapshots,
+		"scavenged": report,
+	})
+}
+
+// Streams the event store's events as NDJSON, optionally only the namespace given with ns or the
+// streams starting with prefix. Only routed when the admin API is enabled
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	opts := maintenance.ExportOptions{Namespace: q.Get("ns"), StreamPrefix: q.Get("prefix")}
+	if _, err := cmdProc.Export(w, opts); err != nil {
+		// the status has usually gone by now, so all that's left is to cut the export short
+		log.Printf("API error: export failed: %v", err)
+	}
+}
+
+// Imports NDJSON written by an export from the request body. With refuseNonEmpty=true streams
+// that already have events aren't appended to. Only routed when the admin API is enabled
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	opts := maintenance.ImportOptions{
+		StreamPrefix:   q.Get("prefix"),
+		RefuseNonEmpty: q.Get("refuseNonEmpty") == "true",
+	}
+	report, err := cmdProc.Import(r.Body, opts)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"imported": report,
+		"error":    errorString(err),
+	})
+}
+
+// Records a command in the command log, see processor.LogCommand
+func logCommand(cp processor.CmdProc, cmd interface{}, entry events.CommandLogged, err error) {
+	if logErr := cp.LogCommand(cmd, entry, err); logErr != nil {
+		log.Printf("API error: could not log command %s: %v", entry.UID, logErr)
+	}
+}
+
+// Logs a command refused before it was processed, see processor.LogRefusedCommand
+func logRefusedCommand(cp processor.CmdProc, cmd interface{}, entry events.CommandLogged, err error) {
+	if logErr := cp.LogRefusedCommand(cmd, entry, err); logErr != nil {
+		log.Printf("API error: could not log command %s: %v", entry.UID, logErr)
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Lists the collections a product is a member of, using the collection membership projection
+func getProductCollectionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	ns := vars["namespace"]
+	sku := vars["sku"]
+	if len(ns) == 0 || len(sku) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	membership, err := cmdProc.GetCollectionMembership(ns)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	ids := append([]string{}, membership[sku]...)
+	sort.Strings(ids)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"namespace":   ns,
+		"sku":         sku,
+		"collections": ids,
+	})
+}
+
 // Reads the raw body, unmarshals it as generic json, looks for a field called
 // commandType, and sends the raw json and raw event type to commands.UnmarshalAsTypedCommand
 // to get a typed command, and then forwards that to the command processor
@@ -96,23 +703,77 @@ func commandHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// add a timestamp and unique ID to the incoming command
+	// add a timestamp and unique ID to the incoming command, and re-encode it so the
+	// typed command is unmarshaled with them
+	uid := uuid.New().String()
 	raw["ts"] = time.Now().Unix()
-	raw["uid"] = uuid.New().String()
+	raw["uid"] = uid
+	withIds, err := json.Marshal(raw)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "Could not marshal request body as json")
+		return
+	}
 
 	if typeKey, tOk := raw[COMMAND_TYPE_ATTRIB]; tOk {
 		switch typeKey.(type) {
 		case string:
-			cmd, err := commands.UnmarshalAsTypedCommand(fmt.Sprintf("%v", typeKey), []byte(rawStr))
+			// every command is logged, including the ones refused before they're processed, but
+			// those are logged without their payloads (see processor.LogRefusedCommand)
+			cp := cmdProc.ActingAs(principalOf(r))
+			entry := events.CommandLogged{UID: uid, CommandType: typeKey.(string), Payload: withIds}
+			entry.Namespace, _ = raw["ns"].(string)
+
+			cmd, err := commands.UnmarshalAsTypedCommand(fmt.Sprintf("%v", typeKey), withIds)
 			if err != nil {
+				// the namespace is only what the body claims, so it's only logged in when the
+				// principal could have written to it
+				if checkRole(r, entry.Namespace, auth.ROLE_WRITE) == nil {
+					logRefusedCommand(cp, nil, entry, err)
+				}
 				w.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(w, "Could not unmarshal request body as a valid command: %v", err)
 				return
 			}
 
+			n, namespaced := cmd.(commands.Namespaced)
+			ns := ""
+			if namespaced {
+				ns = n.GetNamespace()
+			}
+			if err := checkRole(r, ns, auth.ROLE_WRITE); err != nil {
+				logRefusedCommand(cp, cmd, entry, err)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, err)
+				return
+			}
+			if namespaced {
+				if err := cmdProc.AdmitCommand(ns, len(rawStr)); err != nil {
+					logRefusedCommand(cp, cmd, entry, err)
+					if !overQuota(w, err) {
+						w.WriteHeader(http.StatusInternalServerError)
+						fmt.Fprintf(w, "API error: %v", err)
+					}
+					return
+				}
+			}
+
+			if r.URL.Query().Get("async") == "true" {
+				queueCommand(w, r, cp, cmd, entry)
+				return
+			}
+
 			// there is such a type mapping. Attempt to decode it.
-			if err := cmdProc.ProcessProductCommand(cmd); err != nil {
+			if _, err := cp.ProcessLoggedCommand(cmd, entry); err != nil {
 				log.Printf("API error: %s", err)
+				if overQuota(w, err) {
+					return
+				}
+				if forbidden(err) {
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprintf(w, "API error: %v", err)
+					return
+				}
 				w.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(w, "API error: %v", err)
 			} else {
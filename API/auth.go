@@ -0,0 +1,144 @@
+package API
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/efvincent/archex5/auth"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/gorilla/mux"
+)
+
+// the key the authenticated principal is kept under in a request's context
+type principalKey struct{}
+
+// Finds the credentials a request carries, an API key in an X-API-Key header or a bearer token
+func requestToken(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); len(key) > 0 {
+		return key
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return ""
+}
+
+// Authenticates requests before passing them on, answering with a 401 when they don't carry
+// credentials the authenticator accepts. The principal is added to the request's context for the
+// handler to check. Requests go straight through when the API doesn't authenticate
+func authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if options.Authenticator == nil {
+			h(w, r)
+			return
+		}
+		token := requestToken(r)
+		if len(token) == 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "Credentials are required, an API key in an X-API-Key header or a bearer token")
+			return
+		}
+		p, err := options.Authenticator.Authenticate(token)
+		if auth.IsCredentialsError(err) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "API error: %v", err)
+			return
+		}
+		if err != nil {
+			log.Printf("API error: could not authenticate: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Could not authenticate the request")
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
+
+// Authenticates requests and checks the principal has the role in the route's namespace. Routes
+// without a namespace need the role in every namespace
+func guarded(role string, h http.HandlerFunc) http.HandlerFunc {
+	return authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if allowed(w, r, mux.Vars(r)["namespace"], role) {
+			h(w, r)
+		}
+	})
+}
+
+// Like guarded, except GETs only need the read role, the role is needed for changes
+func guardedWrites(role string, h http.HandlerFunc) http.HandlerFunc {
+	return authenticated(func(w http.ResponseWriter, r *http.Request) {
+		needs := role
+		if r.Method == "GET" {
+			needs = auth.ROLE_READ
+		}
+		if allowed(w, r, mux.Vars(r)["namespace"], needs) {
+			h(w, r)
+		}
+	})
+}
+
+// Gets the principal making a request, nil when the API doesn't authenticate
+func principalOf(r *http.Request) *auth.Principal {
+	p, _ := r.Context().Value(principalKey{}).(*auth.Principal)
+	return p
+}
+
+// Checks the principal making a request has the role in the namespace, returning why not when it
+// doesn't
+func checkRole(r *http.Request, ns string, role string) error {
+	p := principalOf(r)
+	if p == nil || p.Can(ns, role) {
+		return nil
+	}
+	where := "namespace " + ns
+	if len(ns) == 0 {
+		where = "every namespace"
+	}
+	return errors.New(fmt.Sprintf("%s doesn't have the %s role in %s", p.Name, role, where))
+}
+
+// The access a request for a product's route needs to the product's stream, reading or writing
+// the stream or its metadata. Empty for routes that aren't for a product
+func streamAccess(r *http.Request) string {
+	if len(mux.Vars(r)["sku"]) == 0 {
+		return ""
+	}
+	meta := strings.HasSuffix(r.URL.Path, "/meta")
+	switch {
+	case meta && r.Method == "GET":
+		return eventStore.ACL_META_READ
+	case meta:
+		return eventStore.ACL_META_WRITE
+	case r.Method == "GET":
+		return eventStore.ACL_READ
+	}
+	return eventStore.ACL_WRITE
+}
+
+// Checks the principal making a request has the role in the namespace, and that the ACL of the
+// product's stream gives it the access the request needs when the route is for a product,
+// answering with a 403 when it doesn't. Reports whether it does
+func allowed(w http.ResponseWriter, r *http.Request, ns string, role string) bool {
+	err := checkRole(r, ns, role)
+	if access := streamAccess(r); err == nil && len(access) > 0 {
+		err = cmdProc.ActingAs(principalOf(r)).CheckStreamAccess(ns, mux.Vars(r)["sku"], access)
+		if _, ok := err.(*auth.AclError); err != nil && !ok {
+			log.Printf("API error: could not check the ACL of %s in %s: %v", mux.Vars(r)["sku"], ns, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Could not check the stream's ACL")
+			return false
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err)
+		return false
+	}
+	return true
+}
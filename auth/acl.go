@@ -0,0 +1,32 @@
+//
+// A stream's ACL (see eventStore.StreamAcl) names who may do what with the stream, on top of the
+// roles and the policy. It lists principals by name (key:<name> or jwt:<subject>, see Principal)
+// or by role, and a list that's empty leaves the decision to the roles and the policy.
+//
+
+package auth
+
+import "fmt"
+
+// Returned when a stream's ACL doesn't give a principal the access it needs
+type AclError struct {
+	Principal string
+	Access    string
+	Namespace string
+	StreamId  string
+}
+
+func (e AclError) Error() string {
+	return fmt.Sprintf("The ACL of stream %s in namespace %s doesn't give %s %s access",
+		e.StreamId, e.Namespace, e.Principal, e.Access)
+}
+
+// Reports whether an ACL's list names the principal, by its name or by a role it has
+func (p Principal) Listed(entries []string) bool {
+	for _, e := range entries {
+		if e == p.Name || p.HasRole(e) {
+			return true
+		}
+	}
+	return false
+}
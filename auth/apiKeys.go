@@ -0,0 +1,225 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// API keys are handed out as "ax5_<id>_<secret>". The ID finds the key in the keyfile, which only
+// holds a hash of the secret, so the keyfile can't be used to make requests
+const apiKeyPrefix = "ax5_"
+
+// Returned when a request's credentials look like an API key but aren't a key in the keyfile, or
+// are a revoked one
+var ErrUnknownKey = &CredentialsError{"unknown or revoked API key"}
+
+type ApiKey struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash"`
+	Namespaces []string `json:"namespaces"`
+	Roles      []string `json:"roles"`
+	// unix nanos, Revoked is zero until the key is revoked
+	Created int64 `json:"created"`
+	Revoked int64 `json:"revoked,omitempty"`
+}
+
+func (k ApiKey) Principal() Principal {
+	return Principal{Name: API_KEY_PRINCIPAL + k.Name, Namespaces: k.Namespaces, Roles: k.Roles}
+}
+
+// The API keys kept in a keyfile:
+//
+//	{"keys": [{"id": "...", "name": "ci", "hash": "...", "namespaces": ["nike"], "roles": ["write"], ...}]}
+//
+// The keyfile is read again whenever it changes, so keys created or revoked by the command line
+// take effect in a running server
+type ApiKeyFile struct {
+	path     string
+	mutex    *sync.Mutex
+	keys     []ApiKey
+	modified time.Time
+}
+
+type storedApiKeys struct {
+	Keys []ApiKey `json:"keys"`
+}
+
+// Opens a keyfile, which doesn't have to exist until a key is created
+func MakeApiKeyFile(path string) *ApiKeyFile {
+	return &ApiKeyFile{path: path, mutex: &sync.Mutex{}}
+}
+
+// Reads the keyfile if it has changed since it was last read. Must be called with the mutex held
+func (kf *ApiKeyFile) refresh() error {
+	info, err := os.Stat(kf.path)
+	if os.IsNotExist(err) {
+		kf.keys, kf.modified = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(kf.modified) && kf.keys != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(kf.path)
+	if err != nil {
+		return err
+	}
+	var stored storedApiKeys
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return errors.New(fmt.Sprintf("Could not read API keyfile %s: %v", kf.path, err))
+	}
+	kf.keys, kf.modified = append([]ApiKey{}, stored.Keys...), info.ModTime()
+	return nil
+}
+
+// Must be called with the mutex held
+func (kf *ApiKeyFile) save() error {
+	b, err := json.MarshalIndent(storedApiKeys{kf.keys}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := kf.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, kf.path); err != nil {
+		return err
+	}
+	// read back on the next refresh, to pick up the new modification time
+	kf.keys = nil
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a key allowed the roles in the namespaces, returning it along with the token callers
+// present, which is the only time the token is available. The name is the key's principal, so no
+// other key that hasn't been revoked can have it; a revoked key's name can be given to the key
+// replacing it
+func (kf *ApiKeyFile) Create(name string, namespaces []string, roles []string) (string, ApiKey, error) {
+	if len(name) == 0 {
+		return "", ApiKey{}, errors.New("An API key needs a name")
+	}
+	if len(namespaces) == 0 {
+		return "", ApiKey{}, errors.New(fmt.Sprintf("An API key needs at least one namespace, or %s for all of them",
+			ALL_NAMESPACES))
+	}
+	if len(roles) == 0 {
+		return "", ApiKey{}, errors.New("An API key needs at least one role")
+	}
+	ranked := false
+	for _, r := range roles {
+		ranked = ranked || IsRole(r)
+		if len(strings.TrimSpace(r)) == 0 || strings.ContainsAny(r, " ,") {
+			return "", ApiKey{}, errors.New(fmt.Sprintf("'%s' can't be used as a role", r))
+		}
+	}
+	if !ranked {
+		return "", ApiKey{}, errors.New(fmt.Sprintf("An API key needs one of the roles %s, %s or %s",
+			ROLE_READ, ROLE_WRITE, ROLE_ADMIN))
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", ApiKey{}, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(raw)
+	key := ApiKey{
+		Id:         strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Name:       name,
+		Hash:       hashSecret(secret),
+		Namespaces: namespaces,
+		Roles:      roles,
+		Created:    time.Now().UnixNano(),
+	}
+
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	if err := kf.refresh(); err != nil {
+		return "", ApiKey{}, err
+	}
+	for _, k := range kf.keys {
+		if k.Name == name && k.Revoked == 0 {
+			return "", ApiKey{}, errors.New(fmt.Sprintf("API key %s is already named %s", k.Id, name))
+		}
+	}
+	kf.keys = append(kf.keys, key)
+	if err := kf.save(); err != nil {
+		return "", ApiKey{}, err
+	}
+	return apiKeyPrefix + key.Id + "_" + secret, key, nil
+}
+
+// Revokes a key, which stays in the keyfile so it can still be listed
+func (kf *ApiKeyFile) Revoke(id string) error {
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	if err := kf.refresh(); err != nil {
+		return err
+	}
+	for i := range kf.keys {
+		if kf.keys[i].Id != id {
+			continue
+		}
+		if kf.keys[i].Revoked > 0 {
+			return errors.New(fmt.Sprintf("API key %s is already revoked", id))
+		}
+		kf.keys[i].Revoked = time.Now().UnixNano()
+		return kf.save()
+	}
+	return errors.New(fmt.Sprintf("No API key %s", id))
+}
+
+func (kf *ApiKeyFile) List() ([]ApiKey, error) {
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	if err := kf.refresh(); err != nil {
+		return nil, err
+	}
+	return append([]ApiKey{}, kf.keys...), nil
+}
+
+// Finds the principal a token belongs to, failing with ErrUnknownKey when it isn't a current key,
+// or ErrUnrecognized when it isn't an API key at all
+func (kf *ApiKeyFile) Authenticate(token string) (*Principal, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, ErrUnrecognized
+	}
+	parts := strings.SplitN(strings.TrimPrefix(token, apiKeyPrefix), "_", 2)
+	if len(parts) != 2 {
+		return nil, ErrUnknownKey
+	}
+	kf.mutex.Lock()
+	defer kf.mutex.Unlock()
+	if err := kf.refresh(); err != nil {
+		return nil, err
+	}
+	for _, k := range kf.keys {
+		if k.Id != parts[0] || k.Revoked > 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hashSecret(parts[1]))) == 1 {
+			p := k.Principal()
+			return &p, nil
+		}
+	}
+	return nil, ErrUnknownKey
+}
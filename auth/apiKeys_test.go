@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func keyfile(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "keys.json")
+}
+
+func TestApiKeyAuthenticate(t *testing.T) {
+	path := keyfile(t)
+	kf := MakeApiKeyFile(path)
+	token, key, err := kf.Create("ci", []string{"nike"}, []string{ROLE_WRITE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := kf.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "key:ci" || !p.Can("nike", ROLE_WRITE) || p.Can("adidas", ROLE_READ) {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+
+	secret := strings.TrimPrefix(token, apiKeyPrefix+key.Id+"_")
+	if b, _ := ioutil.ReadFile(path); strings.Contains(string(b), secret) {
+		t.Fatal("the keyfile holds the key's secret")
+	}
+	if _, err := kf.Authenticate("ax5_" + key.Id + "_wrong"); err != ErrUnknownKey {
+		t.Fatalf("expected a wrong secret to be refused, got %v", err)
+	}
+	if _, err := kf.Authenticate("ax5_nope"); err != ErrUnknownKey {
+		t.Fatalf("expected a malformed key to be refused, got %v", err)
+	}
+	if _, err := kf.Authenticate("eyJ.a.b"); err != ErrUnrecognized {
+		t.Fatalf("expected a JWT not to be taken for an API key, got %v", err)
+	}
+}
+
+func TestApiKeyRevoked(t *testing.T) {
+	path := keyfile(t)
+	kf := MakeApiKeyFile(path)
+	token, key, err := kf.Create("ci", []string{"*"}, []string{ROLE_ADMIN})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, _, err := kf.Create("other", []string{"*"}, []string{ROLE_READ})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kf.Revoke(key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kf.Authenticate(token); err != ErrUnknownKey {
+		t.Fatalf("expected the revoked key to be refused, got %v", err)
+	}
+	if err := kf.Revoke(key.Id); err == nil {
+		t.Fatal("expected revoking a revoked key to fail")
+	}
+
+	// a server reading the keyfile afresh refuses it too, and still accepts the other key
+	reread := MakeApiKeyFile(path)
+	if _, err := reread.Authenticate(token); err != ErrUnknownKey {
+		t.Fatalf("expected the revoked key to be refused after reading the keyfile, got %v", err)
+	}
+	if _, err := reread.Authenticate(kept); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := reread.List()
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("expected the revoked key to still be listed, got %v %v", keys, err)
+	}
+}
+
+func TestApiKeyCreateValidation(t *testing.T) {
+	kf := MakeApiKeyFile(keyfile(t))
+	for _, c := range []struct {
+		name       string
+		namespaces []string
+		roles      []string
+	}{
+		{"", []string{"nike"}, []string{ROLE_READ}},
+		{"ci", nil, []string{ROLE_READ}},
+		{"ci", []string{"nike"}, nil},
+		{"ci", []string{"nike"}, []string{"merchandiser"}},
+		{"ci", []string{"nike"}, []string{ROLE_READ, "a b"}},
+	} {
+		if _, _, err := kf.Create(c.name, c.namespaces, c.roles); err == nil {
+			t.Fatalf("expected %+v to be refused", c)
+		}
+	}
+}
+
+func TestApiKeyNamesUnique(t *testing.T) {
+	kf := MakeApiKeyFile(keyfile(t))
+	_, key, err := kf.Create("ci", []string{"nike"}, []string{ROLE_WRITE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kf.Create("ci", []string{"adidas"}, []string{ROLE_READ}); err == nil ||
+		!strings.Contains(err.Error(), "already named ci") {
+		t.Fatalf("expected a second key named ci to be refused, got %v", err)
+	}
+	// the key replacing a revoked one can have its name
+	if err := kf.Revoke(key.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := kf.Create("ci", []string{"nike"}, []string{ROLE_WRITE}); err != nil {
+		t.Fatalf("expected a revoked key's name to be given again, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Finds the principal that presented a token. Authenticators that don't recognize the kind of
+// token they're given (a JWT given to the API keys, say) return ErrUnrecognized, so that several
+// can be tried in turn (see Authenticators). Tokens they recognize but refuse get a
+// CredentialsError, anything else is the authenticator failing
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+var ErrUnrecognized = errors.New("Unrecognized credentials")
+
+// Returned for credentials that aren't valid, which the caller can do nothing about but present
+// different ones
+type CredentialsError struct {
+	Reason string
+}
+
+func (e CredentialsError) Error() string {
+	return fmt.Sprintf("Invalid credentials, %s", e.Reason)
+}
+
+// Reports whether the error means the caller didn't present valid credentials, rather than the
+// authenticator failing
+func IsCredentialsError(err error) bool {
+	_, ok := err.(*CredentialsError)
+	return ok || err == ErrUnrecognized
+}
+
+// Authenticators that are tried in order, the first to recognize a token deciding who presented it
+type Authenticators []Authenticator
+
+func (as Authenticators) Authenticate(token string) (*Principal, error) {
+	for _, a := range as {
+		p, err := a.Authenticate(token)
+		if err != ErrUnrecognized {
+			return p, err
+		}
+	}
+	return nil, ErrUnrecognized
+}
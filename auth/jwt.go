@@ -0,0 +1,359 @@
+//
+// Services authenticate with JWT bearer tokens signed by an identity provider the server trusts.
+// The provider's public keys are configured locally, as a JWKS file or as PEM files, so tokens are
+// verified without the server fetching anything. Only asymmetric signatures are accepted (RS*, PS*,
+// ES* and EdDSA); each algorithm is only checked with keys of its own type. The token's subject is
+// the principal, and two claims, configurable, hold the namespaces and roles it has.
+//
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultNamespacesClaim = "namespaces"
+	DefaultRolesClaim      = "roles"
+	DefaultJWTLeeway       = time.Minute
+)
+
+// A key tokens can be signed with. Tokens naming a key with their kid header are only checked
+// with that key, keys without an Id are tried for every token
+type PublicKey struct {
+	Id  string
+	Key crypto.PublicKey
+}
+
+type JWTOptions struct {
+	// the claims holding the namespaces and roles, each a list of strings or a space separated string
+	NamespacesClaim string
+	RolesClaim      string
+	// when set, tokens have to have been issued by the issuer, and for the audience
+	Issuer   string
+	Audience string
+	// how far the server's clock and the issuer's can disagree when checking exp and nbf
+	Leeway time.Duration
+}
+
+type JWTAuthenticator struct {
+	keys []PublicKey
+	opts JWTOptions
+}
+
+// Makes an authenticator accepting tokens signed with any of the keys. Options left empty get
+// their defaults
+func MakeJWTAuthenticator(keys []PublicKey, opts JWTOptions) (*JWTAuthenticator, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("JWT authentication needs at least one public key")
+	}
+	if len(opts.NamespacesClaim) == 0 {
+		opts.NamespacesClaim = DefaultNamespacesClaim
+	}
+	if len(opts.RolesClaim) == 0 {
+		opts.RolesClaim = DefaultRolesClaim
+	}
+	if opts.Leeway == 0 {
+		opts.Leeway = DefaultJWTLeeway
+	}
+	return &JWTAuthenticator{keys, opts}, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func invalidToken(format string, args ...interface{}) error {
+	return &CredentialsError{fmt.Sprintf(format, args...)}
+}
+
+// Verifies a token and finds the principal it was issued to. Tokens that aren't JWTs are
+// ErrUnrecognized
+func (ja *JWTAuthenticator) Authenticate(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrUnrecognized
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrUnrecognized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, invalidToken("the token's signature is malformed")
+	}
+	if !ja.verify(header, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, invalidToken("the token's signature doesn't verify with a %s key", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, invalidToken("the token's claims are malformed")
+	}
+	if err := ja.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	if len(sub) == 0 {
+		return nil, invalidToken("the token has no subject")
+	}
+	return &Principal{
+		Name:       JWT_PRINCIPAL + sub,
+		Namespaces: stringsClaim(claims[ja.opts.NamespacesClaim]),
+		Roles:      stringsClaim(claims[ja.opts.RolesClaim]),
+	}, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Checks the signature with each of the keys it could have been made with
+func (ja *JWTAuthenticator) verify(header jwtHeader, signed []byte, sig []byte) bool {
+	for _, k := range ja.keys {
+		if len(header.Kid) > 0 && len(k.Id) > 0 && k.Id != header.Kid {
+			continue
+		}
+		if verifySignature(header.Alg, k.Key, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func digest(h hash.Hash, signed []byte) []byte {
+	h.Write(signed)
+	return h.Sum(nil)
+}
+
+// Checks a signature made with alg, false when the key isn't the kind alg uses
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) bool {
+	if len(alg) < 5 {
+		return false
+	}
+	var h hash.Hash
+	var ch crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		h, ch = sha256.New(), crypto.SHA256
+	case "384":
+		h, ch = sha512.New384(), crypto.SHA384
+	case "512":
+		h, ch = sha512.New(), crypto.SHA512
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if h == nil {
+			return false
+		}
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(k, ch, digest(h, signed), sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(k, ch, digest(h, signed), sig, nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if h == nil || alg[:2] != "ES" || len(sig) != 2*size || !curveFits(alg, k.Curve) {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(k, digest(h, signed), r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(k, signed, sig)
+	}
+	return false
+}
+
+// ES256 is only P-256, ES384 only P-384 and ES512 only P-521
+func curveFits(alg string, c elliptic.Curve) bool {
+	switch alg {
+	case "ES256":
+		return c == elliptic.P256()
+	case "ES384":
+		return c == elliptic.P384()
+	case "ES512":
+		return c == elliptic.P521()
+	}
+	return false
+}
+
+func (ja *JWTAuthenticator) checkClaims(claims map[string]interface{}, now time.Time) error {
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return invalidToken("the token has no expiry")
+	}
+	if now.Add(-ja.opts.Leeway).After(time.Unix(int64(exp), 0)) {
+		return invalidToken("the token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ja.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return invalidToken("the token isn't valid yet")
+	}
+	if iss, _ := claims["iss"].(string); len(ja.opts.Issuer) > 0 && iss != ja.opts.Issuer {
+		return invalidToken("the token wasn't issued by %s", ja.opts.Issuer)
+	}
+	if len(ja.opts.Audience) > 0 {
+		for _, aud := range stringsClaim(claims["aud"]) {
+			if aud == ja.opts.Audience {
+				return nil
+			}
+		}
+		return invalidToken("the token isn't for %s", ja.opts.Audience)
+	}
+	return nil
+}
+
+// Reads a claim that's a list of strings, or a space separated string like OAuth's scope
+func stringsClaim(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return strings.Fields(c)
+	case []interface{}:
+		ss := []string{}
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return []string{}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Reads the signing keys from a JWKS file, skipping keys that are only for encryption
+func LoadJWKS(path string) ([]PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read JWKS %s: %v", path, err))
+	}
+	keys := []PublicKey{}
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read key %v (%s) of JWKS %s: %v", i, k.Kid, path, err))
+		}
+		keys = append(keys, PublicKey{k.Kid, key})
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	param := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, errors.New("missing or malformed key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := param(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := param(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unsupported curve '%s'", k.Crv))
+		}
+		x, err := param(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := param(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("the point isn't on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("only Ed25519 OKP keys are supported")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported key type '%s'", k.Kty))
+}
+
+// Reads a public key from a PEM file, as a PKIX public key, a PKCS #1 RSA public key or a
+// certificate. The key has no Id, so it's tried for every token
+func LoadPublicKeyPEM(path string) (PublicKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return PublicKey{}, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return PublicKey{}, errors.New(fmt.Sprintf("%s isn't a PEM file", filepath.Base(path)))
+	}
+	var key crypto.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		err = errors.New(fmt.Sprintf("unexpected %s block", block.Type))
+	}
+	if err != nil {
+		return PublicKey{}, errors.New(fmt.Sprintf("Could not read public key %s: %v", path, err))
+	}
+	return PublicKey{Key: key}, nil
+}
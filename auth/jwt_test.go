@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"testing"
+	"time"
+)
+
+func segment(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Makes a token with the header and claims, signed by sign over the header and claims segments
+func makeToken(t *testing.T, header map[string]string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	t.Helper()
+	signed := segment(t, header) + "." + segment(t, claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub":        "svc",
+		"exp":        time.Now().Add(time.Hour).Unix(),
+		"namespaces": []string{"nike"},
+		"roles":      "read write",
+	}
+}
+
+func rsaSigner(k *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		sum := sha256.Sum256(signed)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+		return sig
+	}
+}
+
+// Signs with the key as JWS does, r and s each padded to the size of the curve
+func ecSigner(k *ecdsa.PrivateKey, h func() hash.Hash) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		d := h()
+		d.Write(signed)
+		r, s, _ := ecdsa.Sign(rand.Reader, k, d.Sum(nil))
+		size := (k.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig
+	}
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func ecKey(t *testing.T, c elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(c, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func authenticator(t *testing.T, keys ...PublicKey) *JWTAuthenticator {
+	t.Helper()
+	ja, err := MakeJWTAuthenticator(keys, JWTOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ja
+}
+
+func expectRejected(t *testing.T, ja *JWTAuthenticator, token string) {
+	t.Helper()
+	if p, err := ja.Authenticate(token); !IsCredentialsError(err) {
+		t.Fatalf("expected the token to be rejected, got %v %v", p, err)
+	}
+}
+
+func TestJWTAccepted(t *testing.T) {
+	k := rsaKey(t)
+	ja := authenticator(t, PublicKey{Key: &k.PublicKey})
+	p, err := ja.Authenticate(makeToken(t, map[string]string{"alg": "RS256"}, validClaims(), rsaSigner(k)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "jwt:svc" || len(p.Namespaces) != 1 || p.Namespaces[0] != "nike" || !p.HasRole(ROLE_WRITE) {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+
+	ec := ecKey(t, elliptic.P384())
+	ja = authenticator(t, PublicKey{Key: &ec.PublicKey})
+	if _, err := ja.Authenticate(makeToken(t, map[string]string{"alg": "ES384"}, validClaims(),
+		ecSigner(ec, sha512.New384))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTNotAToken(t *testing.T) {
+	ja := authenticator(t, PublicKey{Key: &rsaKey(t).PublicKey})
+	if _, err := ja.Authenticate("ax5_abc_def"); err != ErrUnrecognized {
+		t.Fatalf("expected an API key not to be taken for a JWT, got %v", err)
+	}
+}
+
+func TestJWTRejectsAlgNone(t *testing.T) {
+	ja := authenticator(t, PublicKey{Key: &rsaKey(t).PublicKey})
+	for _, alg := range []string{"none", "None", "NONE", ""} {
+		expectRejected(t, ja, makeToken(t, map[string]string{"alg": alg}, validClaims(),
+			func([]byte) []byte { return nil }))
+	}
+}
+
+// The classic confusion: a token MACed with the public key, hoping it's taken as an HMAC secret
+func TestJWTRejectsHS256(t *testing.T) {
+	k := rsaKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ja := authenticator(t, PublicKey{Key: &k.PublicKey})
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "HS256"}, validClaims(), func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, der)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}))
+}
+
+func TestJWTRejectsRS256WithECKeys(t *testing.T) {
+	ec := ecKey(t, elliptic.P256())
+	ja := authenticator(t, PublicKey{Key: &ec.PublicKey})
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "RS256"}, validClaims(), rsaSigner(rsaKey(t))))
+	// an ES256 signature presented as RS256
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "RS256"}, validClaims(), ecSigner(ec, sha256.New)))
+}
+
+func TestJWTRejectsWrongCurve(t *testing.T) {
+	p384 := ecKey(t, elliptic.P384())
+	ja := authenticator(t, PublicKey{Key: &p384.PublicKey})
+	// signed with the configured P-384 key, but ES256 is only ever P-256
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "ES256"}, validClaims(), ecSigner(p384, sha256.New)))
+
+	p256 := ecKey(t, elliptic.P256())
+	ja = authenticator(t, PublicKey{Key: &p256.PublicKey})
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "ES384"}, validClaims(), ecSigner(p256, sha512.New384)))
+}
+
+func TestJWTRejectsOutsideValidity(t *testing.T) {
+	k := rsaKey(t)
+	ja := authenticator(t, PublicKey{Key: &k.PublicKey})
+	header := map[string]string{"alg": "RS256"}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-DefaultJWTLeeway - time.Minute).Unix()
+	expectRejected(t, ja, makeToken(t, header, expired, rsaSigner(k)))
+
+	noExpiry := validClaims()
+	delete(noExpiry, "exp")
+	expectRejected(t, ja, makeToken(t, header, noExpiry, rsaSigner(k)))
+
+	early := validClaims()
+	early["nbf"] = time.Now().Add(DefaultJWTLeeway + time.Minute).Unix()
+	expectRejected(t, ja, makeToken(t, header, early, rsaSigner(k)))
+
+	// within the leeway either way is accepted
+	skewed := validClaims()
+	skewed["exp"] = time.Now().Add(-DefaultJWTLeeway / 2).Unix()
+	skewed["nbf"] = time.Now().Add(DefaultJWTLeeway / 2).Unix()
+	if _, err := ja.Authenticate(makeToken(t, header, skewed, rsaSigner(k))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJWTRejectsKidMismatch(t *testing.T) {
+	k := rsaKey(t)
+	ja := authenticator(t, PublicKey{Id: "k1", Key: &k.PublicKey})
+	// the signature is good, but the token names a key the server doesn't have
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "RS256", "kid": "k2"}, validClaims(), rsaSigner(k)))
+
+	other := rsaKey(t)
+	ja = authenticator(t, PublicKey{Id: "k1", Key: &k.PublicKey}, PublicKey{Id: "k2", Key: &other.PublicKey})
+	expectRejected(t, ja, makeToken(t, map[string]string{"alg": "RS256", "kid": "k2"}, validClaims(), rsaSigner(k)))
+	if _, err := ja.Authenticate(makeToken(t, map[string]string{"alg": "RS256", "kid": "k1"}, validClaims(),
+		rsaSigner(k))); err != nil {
+		t.Fatal(err)
+	}
+}
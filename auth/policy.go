@@ -0,0 +1,152 @@
+//
+// A policy narrows down which commands a principal can send, beyond the write role every command
+// needs. Each rule covers some command types in some namespaces and says who may send them, by
+// role or by name. A command has to be allowed by every rule that covers it; commands no rule
+// covers are allowed, unless the policy denies them by default. Principals are named the way they
+// authenticated, key:<name> for an API key and jwt:<subject> for a token. Roles in rules don't
+// have to be the ranked read, write and admin roles, a rule can name any role principals are
+// given, like "pricing-manager". The ranked roles still imply the ones below them.
+//
+//	{
+//	  "rules": [
+//	    {"name": "price-approvals", "commands": ["approve-price-change", "reject-price-change"],
+//	     "roles": ["pricing-manager"]},
+//	    {"name": "product-creation", "commands": ["create-product"], "roles": ["admin"]}
+//	  ]
+//	}
+//
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Stands for every command type in a rule's commands
+const ALL_COMMANDS = "*"
+
+// The name PolicyErrors give when a command was denied because no rule covers it
+const DEFAULT_DENY_RULE = "defaultDeny"
+
+type PolicyRule struct {
+	Name string `json:"name"`
+	// the command types the rule covers, and the namespaces, all of them when empty
+	Commands   []string `json:"commands"`
+	Namespaces []string `json:"namespaces,omitempty"`
+	// who may send the commands: principals with one of the roles, or with one of the names
+	Roles      []string `json:"roles,omitempty"`
+	Principals []string `json:"principals,omitempty"`
+}
+
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+	// deny the commands no rule covers, rather than allowing them
+	DefaultDeny bool `json:"defaultDeny,omitempty"`
+}
+
+// Returned when a policy doesn't let a principal send a command, naming the rule that denied it
+type PolicyError struct {
+	Rule        string
+	Principal   string
+	CommandType string
+	Namespace   string
+}
+
+func (e PolicyError) Error() string {
+	if e.Rule == DEFAULT_DENY_RULE {
+		return fmt.Sprintf("No policy rule allows %s to send %s in namespace %s",
+			e.Principal, e.CommandType, e.Namespace)
+	}
+	return fmt.Sprintf("Policy rule %s doesn't allow %s to send %s in namespace %s",
+		e.Rule, e.Principal, e.CommandType, e.Namespace)
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PolicyRule) covers(commandType string, ns string) bool {
+	return (contains(r.Commands, commandType) || contains(r.Commands, ALL_COMMANDS)) &&
+		(len(r.Namespaces) == 0 || contains(r.Namespaces, ns))
+}
+
+func (r PolicyRule) allows(p Principal) bool {
+	if contains(r.Principals, p.Name) {
+		return true
+	}
+	for _, role := range r.Roles {
+		if p.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the policy lets the principal send a command of the type in the namespace, returning a
+// *PolicyError when it doesn't
+func (pol Policy) Authorize(p Principal, commandType string, ns string) error {
+	covered := false
+	for _, r := range pol.Rules {
+		if !r.covers(commandType, ns) {
+			continue
+		}
+		if !r.allows(p) {
+			return &PolicyError{r.Name, p.Name, commandType, ns}
+		}
+		covered = true
+	}
+	if !covered && pol.DefaultDeny {
+		return &PolicyError{DEFAULT_DENY_RULE, p.Name, commandType, ns}
+	}
+	return nil
+}
+
+// Reads a policy file, checking its rules only name the given command types
+func LoadPolicy(path string, commandTypes []string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pol Policy
+	if err := json.Unmarshal(b, &pol); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read policy %s: %v", path, err))
+	}
+	names := map[string]bool{}
+	for i, r := range pol.Rules {
+		switch {
+		case len(r.Name) == 0:
+			return nil, errors.New(fmt.Sprintf("Rule %v of policy %s has no name", i, path))
+		case r.Name == DEFAULT_DENY_RULE:
+			return nil, errors.New(fmt.Sprintf("Policy rules can't be named %s", DEFAULT_DENY_RULE))
+		case names[r.Name]:
+			return nil, errors.New(fmt.Sprintf("Policy %s has more than one rule named %s", path, r.Name))
+		case len(r.Commands) == 0:
+			return nil, errors.New(fmt.Sprintf("Policy rule %s covers no commands", r.Name))
+		case len(r.Roles) == 0 && len(r.Principals) == 0:
+			return nil, errors.New(fmt.Sprintf("Policy rule %s allows no one, it needs roles or principals", r.Name))
+		}
+		names[r.Name] = true
+		for _, p := range r.Principals {
+			if !IsPrincipalName(p) {
+				return nil, errors.New(fmt.Sprintf("Policy rule %s names principal '%s', expected %s<name> or %s<subject>",
+					r.Name, p, API_KEY_PRINCIPAL, JWT_PRINCIPAL))
+			}
+		}
+		for _, c := range r.Commands {
+			if c != ALL_COMMANDS && !contains(commandTypes, c) {
+				return nil, errors.New(fmt.Sprintf("Policy rule %s covers unknown command type '%s', expected one of %s",
+					r.Name, c, strings.Join(commandTypes, ", ")))
+			}
+		}
+	}
+	return &pol, nil
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func principal(name string, roles ...string) Principal {
+	return Principal{Name: name, Namespaces: []string{ALL_NAMESPACES}, Roles: roles}
+}
+
+func TestPolicyAuthorize(t *testing.T) {
+	pol := Policy{Rules: []PolicyRule{
+		{Name: "approvals", Commands: []string{"approve-price-change"}, Roles: []string{"pricing-manager"}},
+		{Name: "creation", Commands: []string{"create-product"}, Roles: []string{ROLE_ADMIN}},
+		{Name: "nike-creation", Commands: []string{"create-product"}, Namespaces: []string{"nike"},
+			Principals: []string{"key:importer"}, Roles: []string{ROLE_ADMIN}},
+		{Name: "adidas-everything", Commands: []string{ALL_COMMANDS}, Namespaces: []string{"adidas"},
+			Roles: []string{"adidas-team"}},
+		{Name: "deletion", Commands: []string{"delete-product"}, Principals: []string{"key:importer"}},
+	}}
+	for _, c := range []struct {
+		name        string
+		p           Principal
+		commandType string
+		ns          string
+		// the rule that denies it, empty when it's allowed
+		deniedBy string
+	}{
+		{"the rule's role", principal("pm", ROLE_WRITE, "pricing-manager"), "approve-price-change", "nike", ""},
+		{"covered without the role", principal("merch", ROLE_WRITE), "approve-price-change", "nike", "approvals"},
+		{"uncovered", principal("merch", ROLE_WRITE), "update-product-price", "nike", ""},
+		{"ranked role implied", principal("boss", ROLE_ADMIN), "create-product", "puma", ""},
+		{"lower ranked role", principal("merch", ROLE_WRITE), "create-product", "puma", "creation"},
+		{"ranked role doesn't imply others", principal("boss", ROLE_ADMIN), "approve-price-change", "nike", "approvals"},
+		// both creation rules cover nike, and every rule covering a command has to allow it
+		{"every covering rule allows", principal("boss", ROLE_ADMIN), "create-product", "nike", ""},
+		{"one covering rule denies", principal("key:importer", ROLE_WRITE), "create-product", "nike", "creation"},
+		{"namespace scoped rule elsewhere", principal("key:importer", ROLE_ADMIN), "create-product", "puma", ""},
+		{"named principal", principal("key:importer", ROLE_WRITE), "delete-product", "nike", ""},
+		// a token's subject isn't the API key with the same name
+		{"same name another way", principal("jwt:importer", ROLE_WRITE), "delete-product", "nike", "deletion"},
+		{"all commands rule", principal("merch", ROLE_WRITE), "update-product-price", "adidas", "adidas-everything"},
+		{"all commands rule's role", principal("a", ROLE_WRITE, "adidas-team"), "update-product-price", "adidas", ""},
+		{"all commands rule and another", principal("a", ROLE_WRITE, "adidas-team"), "create-product", "adidas", "creation"},
+	} {
+		err := pol.Authorize(c.p, c.commandType, c.ns)
+		if len(c.deniedBy) == 0 {
+			if err != nil {
+				t.Fatalf("%s: expected %s to be allowed, got %v", c.name, c.commandType, err)
+			}
+			continue
+		}
+		pe, ok := err.(*PolicyError)
+		if !ok || pe.Rule != c.deniedBy {
+			t.Fatalf("%s: expected %s to be denied by %s, got %v", c.name, c.commandType, c.deniedBy, err)
+		}
+		if pe.Principal != c.p.Name || pe.CommandType != c.commandType || pe.Namespace != c.ns {
+			t.Fatalf("%s: unexpected error %+v", c.name, pe)
+		}
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	pol := Policy{DefaultDeny: true, Rules: []PolicyRule{
+		{Name: "pricing", Commands: []string{"update-product-price"}, Roles: []string{ROLE_WRITE}},
+	}}
+	if err := pol.Authorize(principal("merch", ROLE_WRITE), "update-product-price", "nike"); err != nil {
+		t.Fatalf("expected the covered command to be allowed, got %v", err)
+	}
+	err := pol.Authorize(principal("boss", ROLE_ADMIN), "create-product", "nike")
+	if pe, ok := err.(*PolicyError); !ok || pe.Rule != DEFAULT_DENY_RULE {
+		t.Fatalf("expected the uncovered command to be denied by default, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "No policy rule allows") {
+		t.Fatalf("unexpected message %q", err)
+	}
+	// a rule that covers the command but denies it is named, not the default
+	err = pol.Authorize(principal("viewer", ROLE_READ), "update-product-price", "nike")
+	if pe, ok := err.(*PolicyError); !ok || pe.Rule != "pricing" {
+		t.Fatalf("expected the covering rule to deny it, got %v", err)
+	}
+}
+
+func policyFile(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPolicy(t *testing.T) {
+	known := []string{"create-product", "approve-price-change"}
+	pol, err := LoadPolicy(policyFile(t, `{"defaultDeny": true, "rules": [
+		{"name": "a", "commands": ["create-product"], "roles": ["admin"]},
+		{"name": "b", "commands": ["*"], "namespaces": ["nike"], "principals": ["key:ci"]}]}`), known)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pol.DefaultDeny || len(pol.Rules) != 2 || pol.Rules[1].Principals[0] != "key:ci" {
+		t.Fatalf("unexpected policy %+v", pol)
+	}
+
+	for _, c := range []struct {
+		policy string
+		want   string
+	}{
+		{`{"rules": [`, "Could not read policy"},
+		{`{"rules": [{"commands": ["create-product"], "roles": ["admin"]}]}`, "has no name"},
+		{`{"rules": [{"name": "defaultDeny", "commands": ["create-product"], "roles": ["admin"]}]}`, "can't be named"},
+		{`{"rules": [{"name": "a", "commands": ["create-product"], "roles": ["admin"]},
+			{"name": "a", "commands": ["approve-price-change"], "roles": ["admin"]}]}`, "more than one rule named a"},
+		{`{"rules": [{"name": "a", "roles": ["admin"]}]}`, "covers no commands"},
+		{`{"rules": [{"name": "a", "commands": ["create-product"]}]}`, "allows no one"},
+		{`{"rules": [{"name": "a", "commands": ["delete-everything"], "roles": ["admin"]}]}`, "unknown command type 'delete-everything'"},
+		{`{"rules": [{"name": "a", "commands": ["create-product"], "principals": ["ci"]}]}`, "names principal 'ci'"},
+		{`{"rules": [{"name": "a", "commands": ["create-product"], "principals": ["key:"]}]}`, "names principal 'key:'"},
+	} {
+		if _, err := LoadPolicy(policyFile(t, c.policy), known); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("expected %s to be refused with %q, got %v", c.policy, c.want, err)
+		}
+	}
+	if _, err := LoadPolicy(filepath.Join(os.TempDir(), "no-such-policy.json"), known); err == nil {
+		t.Fatal("expected a missing policy file to be refused")
+	}
+}
@@ -0,0 +1,79 @@
+//
+// Requests to the API are made by a principal, a caller that has been authenticated, which is
+// allowed to act in some namespaces with some roles. The roles are ranked, each one allowing
+// what the ones below it do: read lets a principal query, write lets it send commands too, and
+// admin lets it manage namespaces and use the administrative routes as well. Principals can have
+// other roles too, which mean nothing on their own but can be named by a policy (see Policy).
+//
+
+package auth
+
+import "strings"
+
+const (
+	ROLE_READ  = "read"
+	ROLE_WRITE = "write"
+	ROLE_ADMIN = "admin"
+)
+
+// Stands for every namespace in a principal's namespaces
+const ALL_NAMESPACES = "*"
+
+// Principals are named after how they were authenticated, so that an API key and a token's
+// subject with the same name are still different principals to ACLs, policies and the record
+// of who wrote an event
+const (
+	API_KEY_PRINCIPAL = "key:"
+	JWT_PRINCIPAL     = "jwt:"
+)
+
+// Reports whether a name is one principals are given, one qualified by how they authenticated
+func IsPrincipalName(name string) bool {
+	for _, prefix := range []string{API_KEY_PRINCIPAL, JWT_PRINCIPAL} {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var roleRanks = map[string]int{ROLE_READ: 1, ROLE_WRITE: 2, ROLE_ADMIN: 3}
+
+// Reports whether the role is one of the ranked roles
+func IsRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+type Principal struct {
+	// who the principal is, key:<the API key's name> or jwt:<the token's subject>
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+	Roles      []string `json:"roles"`
+}
+
+// Reports whether the principal has the role, or a higher one, in the namespace. An empty
+// namespace asks whether it has the role in every namespace
+func (p Principal) Can(ns string, role string) bool {
+	return p.InNamespace(ns) && p.HasRole(role)
+}
+
+func (p Principal) InNamespace(ns string) bool {
+	for _, n := range p.Namespaces {
+		if n == ALL_NAMESPACES || (len(ns) > 0 && n == ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the principal has the role. Ranked roles are also had by principals with a
+// higher one, other roles only by principals given them
+func (p Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role || (roleRanks[role] > 0 && roleRanks[r] >= roleRanks[role]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/efvincent/archex5/auth"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// the name, namespaces and roles of a key made by apikey create
+var apiKeyName string
+var apiKeyNamespaces []string
+var apiKeyRoles []string
+
+// apiKeyCmd represents the apikey command
+var apiKeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Manages the API keys the server accepts",
+	Long: `Creates, revokes and lists the keys in the API keyfile. When the server is given a keyfile
+every request needs one of its keys, each allowed some roles (read, write or admin) in some
+namespaces. Changes to the keyfile take effect in a running server.`,
+}
+
+var apiKeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates an API key",
+	Long: `Creates an API key with the roles in the namespaces, creating the keyfile if it doesn't exist.
+The key is printed once, only a hash of it is kept in the keyfile.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kf, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		token, key, err := kf.Create(apiKeyName, apiKeyNamespaces, apiKeyRoles)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %s (%s), it won't be shown again:\n%s\n", key.Id, key.Name, token)
+		return nil
+	},
+}
+
+var apiKeyRevokeCmd = &cobra.Command{
+	Use:          "revoke <id>",
+	Short:        "Revokes an API key",
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kf, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		if err := kf.Revoke(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", args[0])
+		return nil
+	},
+}
+
+var apiKeyListCmd = &cobra.Command{
+	Use:          "list",
+	Short:        "Lists the API keys",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kf, err := apiKeyFile()
+		if err != nil {
+			return err
+		}
+		keys, err := kf.List()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tNAMESPACES\tROLES\tCREATED\tREVOKED")
+		for _, k := range keys {
+			revoked := ""
+			if k.Revoked > 0 {
+				revoked = time.Unix(0, k.Revoked).Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", k.Id, k.Name, strings.Join(k.Namespaces, ","),
+				strings.Join(k.Roles, ","), time.Unix(0, k.Created).Format(time.RFC3339), revoked)
+		}
+		return tw.Flush()
+	},
+}
+
+// Opens the configured API keyfile
+func apiKeyFile() (*auth.ApiKeyFile, error) {
+	path := viper.GetString("auth.apiKeyfile")
+	if len(path) == 0 {
+		return nil, errors.New("No API keyfile configured, use --api-keyfile or auth.apiKeyfile in the config")
+	}
+	return auth.MakeApiKeyFile(path), nil
+}
+
+func init() {
+	apiKeyCreateCmd.Flags().StringVar(&apiKeyName, "name", "", "What the key is for, shown when it's listed.")
+	apiKeyCreateCmd.Flags().StringSliceVar(&apiKeyNamespaces, "ns", nil,
+		"The namespaces the key can be used in, * for all of them.")
+	apiKeyCreateCmd.Flags().StringSliceVar(&apiKeyRoles, "roles", []string{auth.ROLE_READ},
+		"The key's roles: read, write or admin, each allowing what the ones before it do, and any roles a policy names.")
+	apiKeyCmd.AddCommand(apiKeyCreateCmd, apiKeyRevokeCmd, apiKeyListCmd)
+	rootCmd.AddCommand(apiKeyCmd)
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"log"
+
+	"github.com/efvincent/archex5/auth"
+	"github.com/spf13/viper"
+)
+
+// Sets up the authenticators the configuration asks for, API keys and JWTs, tried in that order.
+// Returns nil when none are configured, in which case the API doesn't authenticate requests
+func openAuthenticator() (auth.Authenticator, error) {
+	as := auth.Authenticators{}
+	if keyfile := viper.GetString("auth.apiKeyfile"); len(keyfile) > 0 {
+		log.Printf("Authenticating requests with the API keys in %s", keyfile)
+		as = append(as, auth.MakeApiKeyFile(keyfile))
+	}
+
+	keys := []auth.PublicKey{}
+	if jwks := viper.GetString("auth.jwt.jwks"); len(jwks) > 0 {
+		ks, err := auth.LoadJWKS(jwks)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+	}
+	for _, path := range viper.GetStringSlice("auth.jwt.publicKeys") {
+		k, err := auth.LoadPublicKeyPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) > 0 {
+		ja, err := auth.MakeJWTAuthenticator(keys, auth.JWTOptions{
+			NamespacesClaim: viper.GetString("auth.jwt.namespacesClaim"),
+			RolesClaim:      viper.GetString("auth.jwt.rolesClaim"),
+			Issuer:          viper.GetString("auth.jwt.issuer"),
+			Audience:        viper.GetString("auth.jwt.audience"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Authenticating bearer tokens with %v public keys", len(keys))
+		as = append(as, ja)
+	}
+
+	if len(as) == 0 {
+		return nil, nil
+	}
+	return as, nil
+}
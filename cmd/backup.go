@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/spf13/cobra"
+)
+
+var backupOut string
+var backupIncrementalFrom string
+
+// backupCmd represents the backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Writes a compressed backup of the event store",
+	Long: `Writes every event in the store, up to the store's current global position, to a gzipped
+archive. With --incremental-from the archive only holds the events written since that backup.
+Events are archived as they're stored, so encrypted payloads stay encrypted and the keyfile has
+to be kept as well. The archive also holds the keys sensitive fields are sealed with, wrapped
+with the keyfile when there is one, so treat it as sensitive.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(backupOut) == 0 {
+			return errors.New("Give the archive to write with --out")
+		}
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		keys, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+		var previous *maintenance.BackupHeader
+		if len(backupIncrementalFrom) > 0 {
+			f, err := os.Open(backupIncrementalFrom)
+			if err != nil {
+				return err
+			}
+			header, err := maintenance.ReadBackupHeader(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			previous = &header
+		}
+
+		// written to a temporary file first, so a failed backup never leaves a partial archive
+		tmp := backupOut + ".tmp"
+		f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		header, err := maintenance.Backup(store, keys, f, previous)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, backupOut)
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if header.Full {
+			fmt.Printf("Wrote a full backup at position %v to %s\n", header.Position, backupOut)
+		} else {
+			fmt.Printf("Wrote an incremental backup from position %v to %v to %s\n", header.Since, header.Position, backupOut)
+		}
+		return nil
+	},
+}
+
+func init() {
+	backupCmd.Flags().StringVar(&backupOut, "out", "", "Archive to write")
+	backupCmd.Flags().StringVar(&backupIncrementalFrom, "incremental-from", "",
+		"Previous backup, only the events written since it are archived")
+	rootCmd.AddCommand(backupCmd)
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/efvincent/archex5/processor"
+	"github.com/spf13/cobra"
+)
+
+var exportNs string
+var exportPrefix string
+var exportOut string
+
+// exportCmd represents the export command
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports streams as NDJSON",
+	Long: `Writes the events of every stream (or those in the namespace, or starting with the prefix
+given) as NDJSON, one event per line with its namespace, stream ID, sequence number, timestamp,
+type and payload. Payloads are exported decrypted, so treat the export as sensitive. The keys the
+exported products' supplier contacts are sealed with are written ahead of the events, wrapped
+with the encryption keyfile when there is one, so the importing environment needs the same one.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if len(exportOut) > 0 {
+			f, err := os.OpenFile(exportOut, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		keys, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+		cp := processor.MakeCmdProcWithStore(store)
+		cp.SetKeyStore(keys)
+		report, err := cp.Export(w, maintenance.ExportOptions{Namespace: exportNs, StreamPrefix: exportPrefix})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Exported %v events from %v streams and %v keys\n", report.Events, report.Streams, report.Keys)
+		return nil
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringVar(&exportNs, "ns", "", "Only export this namespace")
+	exportCmd.Flags().StringVar(&exportPrefix, "stream-prefix", "", "Only export streams whose IDs start with this")
+	exportCmd.Flags().StringVar(&exportOut, "out", "", "File to write, standard output when not given")
+	rootCmd.AddCommand(exportCmd)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/spf13/cobra"
+)
+
+var fsckNs string
+var fsckRepair bool
+
+// fsckCmd represents the fsck command
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Checks the event store for inconsistencies",
+	Long: `Scans the event store and reports gaps or duplicates in sequence numbers, timestamps that go
+backwards, events of unregistered types, payloads that can't be read, streams that don't start
+with the right event, and broken hash chains.
+
+With --repair, streams whose only problems are identical duplicates are rewritten without them,
+and their hash chain is rebuilt. Duplicates that differ are only reported, since there's no
+telling which copy is right, and so are gaps, since they may be events that have been lost and
+renumbering the events after them would break references to them. Not every backend can rewrite
+streams, and the other problems are only ever reported.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		if _, ok := eventStore.Raw(store).(eventStore.StreamRewriter); fsckRepair && !ok {
+			return errors.New("This event store backend can't repair streams")
+		}
+		report, err := maintenance.Fsck(store, maintenance.FsckOptions{Namespace: fsckNs, Repair: fsckRepair})
+		if err != nil {
+			return err
+		}
+		for _, p := range report.Problems {
+			fmt.Println(p)
+		}
+		for _, s := range report.Repaired {
+			fmt.Printf("Repaired %s\n", s)
+		}
+		fmt.Printf("Checked %v events in %v streams, %v problems, %v streams repaired\n",
+			report.Events, report.Streams, len(report.Problems), len(report.Repaired))
+		repaired := map[string]bool{}
+		for _, s := range report.Repaired {
+			repaired[s] = true
+		}
+		remaining := 0
+		for _, p := range report.Problems {
+			if !repaired[p.Namespace+"/"+p.StreamId] {
+				remaining++
+			}
+		}
+		if remaining > 0 {
+			return errors.New(fmt.Sprintf("%v problems remain", remaining))
+		}
+		return nil
+	},
+}
+
+func init() {
+	fsckCmd.Flags().StringVar(&fsckNs, "ns", "", "Only check this namespace")
+	fsckCmd.Flags().BoolVar(&fsckRepair, "repair", false, "Rewrite streams whose only problems are identical duplicates")
+	rootCmd.AddCommand(fsckCmd)
+}
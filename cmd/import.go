@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/efvincent/archex5/processor"
+	"github.com/spf13/cobra"
+)
+
+var importPrefix string
+var importIn string
+var importRefuseNonEmpty bool
+
+// importCmd represents the import command
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports streams exported as NDJSON",
+	Long: `Reads events written by export and appends them to their streams, keeping their timestamps
+and types. Each stream is written as a single batch. With --refuse-non-empty the import stops at
+the first stream that already has events, streams imported before it are kept. The keys exported
+with the streams are added to the key store first.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		var r io.Reader = os.Stdin
+		if len(importIn) > 0 {
+			f, err := os.Open(importIn)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		keys, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+		cp := processor.MakeCmdProcWithStore(store)
+		cp.SetKeyStore(keys)
+		report, err := cp.Import(r, maintenance.ImportOptions{
+			StreamPrefix:   importPrefix,
+			RefuseNonEmpty: importRefuseNonEmpty,
+		})
+		fmt.Printf("Imported %v events into %v streams and %v keys\n", report.Events, report.Streams, report.Keys)
+		return err
+	},
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importPrefix, "stream-prefix", "", "Only import streams whose IDs start with this")
+	importCmd.Flags().StringVar(&importIn, "in", "", "File to read, standard input when not given")
+	importCmd.Flags().BoolVar(&importRefuseNonEmpty, "refuse-non-empty", false,
+		"Fail rather than append to streams that already have events")
+	rootCmd.AddCommand(importCmd)
+}
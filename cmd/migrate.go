@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/spf13/cobra"
+)
+
+var migrateFrom string
+var migrateFromDir string
+var migrateTo string
+var migrateToDir string
+var migrateFromKeyFile string
+var migrateToKeyFile string
+var migrateFollow bool
+var migrateInterval time.Duration
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Copies the event store to another backend",
+	Long: `Copies every namespace and stream from one event store backend to another, exactly as the
+events are stored, then checks that each copied stream matches the source event for event. Run
+again, it only copies the events written since, so a migration can be stopped and resumed.
+Events the source's retention policies have trimmed since are trimmed from the target, and
+streams deleted from the source are deleted from the target.
+
+With --follow it keeps copying new events every --interval until it's interrupted, so the target
+keeps up with a live system. To cut over, stop the writers, wait for a pass that copies nothing,
+interrupt the migration (which makes one last pass), and restart the writers on the target.
+
+The keys sensitive fields are sealed with are copied first, from the source's file key store to
+the target's, which are the key files in the data directories unless --from-key-file and
+--to-key-file say otherwise. Both have to be readable with the configured encryption keyfile.
+Keys destroyed in the source, because a supplier contact was forgotten, are destroyed in the
+target too, and never copied to it again.
+
+The memory backend only lives as long as the process using it, so it can't be migrated from or
+to by this command.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := openMigrateBackend(migrateFrom, migrateFromDir)
+		if err != nil {
+			return err
+		}
+		to, err := openMigrateBackend(migrateTo, migrateToDir)
+		if err != nil {
+			return err
+		}
+		if migrateFrom == migrateTo && migrateFromDir == migrateToDir {
+			return errors.New("The source and target are the same event store")
+		}
+		fromKeys, err := openKeyBackend(KEYS_FILE, migrateFromKeyFile, migrateFrom, migrateFromDir)
+		if err != nil {
+			return err
+		}
+		toKeys, err := openKeyBackend(KEYS_FILE, migrateToKeyFile, migrateTo, migrateToDir)
+		if err != nil {
+			return err
+		}
+		pass := func() error {
+			copied, err := maintenance.MigrateKeys(fromKeys, toKeys)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Copied %v keys\n", copied)
+			return migratePass(from, to)
+		}
+		if !migrateFollow {
+			return pass()
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		ticker := time.NewTicker(migrateInterval)
+		defer ticker.Stop()
+		for {
+			// while following, a pass can fail because the source was read mid-write, the next
+			// pass picks up from where the target is
+			if err := pass(); err != nil {
+				log.Printf("migrate: %v, retrying", err)
+			}
+			select {
+			case <-stop:
+				log.Printf("migrate: interrupted, making a final pass")
+				return pass()
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+func migratePass(from eventStore.EventStore, to eventStore.EventStore) error {
+	report, err := maintenance.Migrate(from, to)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Copied %v events, %v events in %v streams verified, %v events trimmed and %v streams deleted\n",
+		report.Copied, report.Events, report.Streams, report.Trimmed, report.Deleted)
+	return nil
+}
+
+func openMigrateBackend(storeType string, dir string) (eventStore.EventStore, error) {
+	switch storeType {
+	case STORE_MEMORY:
+		return nil, errors.New("The memory event store can't be migrated by a separate process")
+	case "sqlite":
+		return nil, errors.New("There is no sqlite event store backend")
+	}
+	return openBackend(storeType, dir)
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", STORE_FILE, "Event store backend to copy from")
+	migrateCmd.Flags().StringVar(&migrateFromDir, "from-dir", "", "Data directory of the backend to copy from")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", STORE_FILE, "Event store backend to copy to")
+	migrateCmd.Flags().StringVar(&migrateToDir, "to-dir", "", "Data directory of the backend to copy to")
+	migrateCmd.Flags().StringVar(&migrateFromKeyFile, "from-key-file", "",
+		"Key store to copy keys from, "+keyFileName+" in --from-dir when not given")
+	migrateCmd.Flags().StringVar(&migrateToKeyFile, "to-key-file", "",
+		"Key store to copy keys to, "+keyFileName+" in --to-dir when not given")
+	migrateCmd.Flags().BoolVar(&migrateFollow, "follow", false, "Keep copying new events until interrupted")
+	migrateCmd.Flags().DurationVar(&migrateInterval, "interval", time.Second, "How often to copy new events with --follow")
+	rootCmd.AddCommand(migrateCmd)
+}
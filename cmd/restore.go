@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/efvincent/archex5/maintenance"
+	"github.com/spf13/cobra"
+)
+
+var restoreForce bool
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <full backup> [incremental backup...]",
+	Short: "Restores the event store from backups",
+	Long: `Restores a full backup, followed by the incremental backups taken after it in the order they
+were taken. Every archive is checked before anything is written. Streams the store already has
+are not overwritten unless --force is given, in which case they're replaced by the backup's.
+The keys in the last archive are added to the key store before any events are written. Keys the
+key store has destroyed, because a supplier contact was forgotten after the archive was taken,
+aren't added back, and keys the archive records as destroyed are destroyed in the key store.`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		keys, err := openKeyStore()
+		if err != nil {
+			return err
+		}
+		archives := []io.Reader{}
+		for _, a := range args {
+			f, err := os.Open(a)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			archives = append(archives, f)
+		}
+		report, err := maintenance.Restore(store, keys, archives, restoreForce)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored %v events in %v streams and %v keys from %v archives, up to position %v\n",
+			report.Events, report.Streams, report.Keys, report.Archives, report.Position)
+		return nil
+	},
+}
+
+func init() {
+	restoreCmd.Flags().BoolVar(&restoreForce, "force", false, "Replace streams the event store already has")
+	rootCmd.AddCommand(restoreCmd)
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 
@@ -17,6 +18,8 @@ var rootCmd = &cobra.Command{
 	Use:   "archex5",
 	Short: "Architecture Example #5",
 	Long:  "",
+	// errors are printed once, by Execute
+	SilenceErrors: true,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -32,6 +35,24 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.archex5.yaml)")
+	rootCmd.PersistentFlags().String("encryption-keyfile", "",
+		"keyfile used to encrypt event payloads at rest (config encryption.keyfile), no encryption when empty")
+	viper.BindPFlag("encryption.keyfile", rootCmd.PersistentFlags().Lookup("encryption-keyfile"))
+	rootCmd.PersistentFlags().String("store", STORE_MEMORY,
+		"event store backend, memory or file (config store.type)")
+	viper.BindPFlag("store.type", rootCmd.PersistentFlags().Lookup("store"))
+	rootCmd.PersistentFlags().String("data-dir", "",
+		"directory the file event store keeps events in (config store.path)")
+	viper.BindPFlag("store.path", rootCmd.PersistentFlags().Lookup("data-dir"))
+	rootCmd.PersistentFlags().String("key-store", "",
+		"key store for the keys sensitive fields are sealed with, memory or file (config keys.type), the same kind as the event store when empty")
+	viper.BindPFlag("keys.type", rootCmd.PersistentFlags().Lookup("key-store"))
+	rootCmd.PersistentFlags().String("key-file", "",
+		"file the file key store keeps keys in (config keys.path), "+keyFileName+" in the data directory when empty")
+	viper.BindPFlag("keys.path", rootCmd.PersistentFlags().Lookup("key-file"))
+	rootCmd.PersistentFlags().String("api-keyfile", "",
+		"keyfile holding the API keys requests are authenticated with (config auth.apiKeyfile), no authentication when empty")
+	viper.BindPFlag("auth.apiKeyfile", rootCmd.PersistentFlags().Lookup("api-keyfile"))
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -49,6 +70,8 @@ func initConfig() {
 		viper.SetConfigName(".archex5")
 	}
 
+	// nested keys such as encryption.keyfile are read from variables like ENCRYPTION_KEYFILE
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/efvincent/archex5/eventStore/EncryptedEventStore"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// rotateKeyCmd represents the rotate-key command
+var rotateKeyCmd = &cobra.Command{
+	Use:   "rotate-key",
+	Short: "Adds a new encryption key to the keyfile",
+	Long: `Adds a new random key to the encryption keyfile and makes it the current key, creating the
+keyfile if it doesn't exist. New events are encrypted with the new key, events written before
+the rotation are still read with the keys they were written with, so old keys are kept.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keyfile := viper.GetString("encryption.keyfile")
+		if len(keyfile) == 0 {
+			return errors.New("No keyfile configured, use --encryption-keyfile or encryption.keyfile in the config")
+		}
+		id, err := EncryptedEventStore.RotateKeyfile(keyfile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added key %s to %s, it is now the current key\n", id, keyfile)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateKeyCmd)
+}
@@ -1,28 +1,188 @@
 package cmd
 
 import (
+	"log"
+	"time"
+
 	"github.com/efvincent/archex5/API"
+	"github.com/efvincent/archex5/auth"
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/headcheck"
+	"github.com/efvincent/archex5/processManager"
+	"github.com/efvincent/archex5/processor"
+	"github.com/efvincent/archex5/scheduler"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // holds the port & host config parameters (see init())
 var port string
 var host string
 
+// how often the scheduler checks for scheduled changes that are due
+var scheduleInterval time.Duration
+
+// limits on the HTTP requests made by head checks
+var headCheckTimeout time.Duration
+var headCheckMaxRedirects int
+
+// how the background head check worker picks products and paces its checks
+var headCheckMaxAge time.Duration
+var headCheckSweep time.Duration
+var headCheckConcurrency int
+var headCheckHostGap time.Duration
+
+// how many consecutive failed head checks it takes to deactivate a product
+var deactivateAfterFailures int
+
+// how often retention policies are enforced, and how often streams with one are snapshotted
+var scavengeSweep time.Duration
+var snapshotEvery int
+
+// whether the administrative API routes are served
+var enableAdmin bool
+
+// whether writes to namespaces that haven't been created fail
+var strictNamespaces bool
+
+// where commands sent asynchronously are queued, how many workers process them, and how long
+// their outcomes are kept
+var queueDir string
+var queueWorkers int
+var queueRetain time.Duration
+
 // serverCmd represents the server command
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Start the API",
-	Long: `Starts the HTTP API on the specificed port (defaults to 8080).
+	Long: `Starts the HTTP API on the specificed port (defaults to 8080), along with the scheduler
+that carries out scheduled product changes, the worker that keeps head checks fresh, and the
+monitor that deactivates products whose head checks keep failing, the scavenger that
+enforces retention policies, and the workers that process commands sent asynchronously.
 		
 Note the server blocks the process. Press CTRL-C to stop the server running`,
 	Run: func(cmd *cobra.Command, args []string) {
-		API.Run(host, port)
+		store, err := openEventStore()
+		if err != nil {
+			log.Fatalf("Could not open the event store: %v", err)
+		}
+		keys, err := openKeyStore()
+		if err != nil {
+			log.Fatalf("Could not open the key store: %v", err)
+		}
+		if strictNamespaces {
+			strict, ok := eventStore.Raw(store).(eventStore.StrictNamespaces)
+			if !ok {
+				log.Fatalf("This event store backend can't refuse writes to unknown namespaces")
+			}
+			strict.SetStrictNamespaces(true)
+		}
+		cp := processor.MakeCmdProcWithStore(store)
+		cp.SetKeyStore(keys)
+		cp.SetHeadChecker(headcheck.MakeHTTPChecker(headCheckTimeout, headCheckMaxRedirects))
+		cp.SetSnapshotEvery(snapshotEvery)
+		authenticator, err := openAuthenticator()
+		if err != nil {
+			log.Fatalf("Could not set up authentication: %v", err)
+		}
+		if path := viper.GetString("auth.policy"); len(path) > 0 {
+			if authenticator == nil {
+				log.Fatalf("A policy needs requests to be authenticated, configure API keys or bearer tokens")
+			}
+			policy, err := auth.LoadPolicy(path, commands.CommandTypes)
+			if err != nil {
+				log.Fatalf("Could not load the policy: %v", err)
+			}
+			log.Printf("Authorizing commands with the %v rules in %s", len(policy.Rules), path)
+			cp.SetPolicy(policy)
+		}
+		if err := scheduler.MakeScheduler(cp, scheduleInterval).Start(); err != nil {
+			log.Fatalf("Could not start the scheduler: %v", err)
+		}
+		var monitor *processManager.HeadCheckMonitor
+		if deactivateAfterFailures > 0 {
+			monitor = processManager.MakeHeadCheckMonitor(cp, deactivateAfterFailures)
+			if err := monitor.Start(); err != nil {
+				log.Fatalf("Could not start the head check monitor: %v", err)
+			}
+		}
+		if headCheckMaxAge > 0 {
+			worker := scheduler.MakeHeadCheckWorker(cp, headCheckMaxAge, headCheckSweep,
+				headCheckConcurrency, headCheckHostGap)
+			if monitor != nil {
+				worker.AlsoCheck(monitor.WantsHeadCheck)
+			}
+			worker.Start()
+		}
+		if scavengeSweep > 0 {
+			scheduler.MakeScavenger(cp, scavengeSweep).Start()
+		}
+		var queue *scheduler.CommandQueue
+		if len(queueDir) > 0 {
+			queue, err = scheduler.MakeCommandQueue(cp, queueDir, queueWorkers, queueRetain)
+			if err != nil {
+				log.Fatalf("Could not open the command queue: %v", err)
+			}
+			queue.Start()
+		}
+		API.Run(cp, host, port, API.Options{EnableAdmin: enableAdmin, Authenticator: authenticator, Queue: queue})
 	},
 }
 
 func init() {
 	serverCmd.Flags().StringVar(&host, "host", "localhost", "The HTTP Host for the API.")
 	serverCmd.Flags().StringVar(&port, "port", "8080", "The HTTP Port for the API.")
+	serverCmd.Flags().DurationVar(&scheduleInterval, "schedule-interval", time.Second,
+		"How often the scheduler checks for scheduled changes that are due.")
+	serverCmd.Flags().DurationVar(&headCheckTimeout, "headcheck-timeout", headcheck.DefaultTimeout,
+		"How long a head check waits for each URL to respond.")
+	serverCmd.Flags().IntVar(&headCheckMaxRedirects, "headcheck-max-redirects", headcheck.DefaultMaxRedirects,
+		"How many redirects a head check follows before giving up on a URL.")
+	serverCmd.Flags().DurationVar(&headCheckMaxAge, "headcheck-max-age", scheduler.DefaultHeadCheckMaxAge,
+		"How old an active product's last head check can get before the worker checks it again. 0 disables the worker.")
+	serverCmd.Flags().DurationVar(&headCheckSweep, "headcheck-sweep-interval", scheduler.DefaultHeadCheckSweep,
+		"How often the head check worker looks for products that are due a check.")
+	serverCmd.Flags().IntVar(&headCheckConcurrency, "headcheck-concurrency", scheduler.DefaultHeadCheckConcurrency,
+		"How many head checks the worker runs at once.")
+	serverCmd.Flags().DurationVar(&headCheckHostGap, "headcheck-host-interval", scheduler.DefaultHeadCheckHostGap,
+		"The minimum time between the worker's head checks that hit the same host.")
+	serverCmd.Flags().IntVar(&deactivateAfterFailures, "deactivate-after-failures", processManager.DefaultFailureThreshold,
+		"How many consecutive failed head checks deactivate a product. 0 disables automatic deactivation.")
+	serverCmd.Flags().DurationVar(&scavengeSweep, "scavenge-interval", scheduler.DefaultScavengeSweep,
+		"How often events that retention policies no longer keep are removed. 0 disables the scavenger.")
+	serverCmd.Flags().IntVar(&snapshotEvery, "snapshot-every", processor.DefaultSnapshotEvery,
+		"How many events a stream with a retention policy gets between snapshots.")
+	serverCmd.Flags().BoolVar(&enableAdmin, "enable-admin", false,
+		"Serve the administrative API routes, which can permanently delete data.")
+	serverCmd.Flags().BoolVar(&strictNamespaces, "strict-namespaces", false,
+		"Refuse writes to namespaces that haven't been created through /api/namespaces.")
+	serverCmd.Flags().StringVar(&queueDir, "queue-dir", "",
+		"Directory commands sent with ?async=true are queued in. Commands can't be sent asynchronously when it isn't set.")
+	serverCmd.Flags().IntVar(&queueWorkers, "queue-workers", scheduler.DefaultQueueWorkers,
+		"How many workers process queued commands. Commands for the same product are always processed in order.")
+	serverCmd.Flags().DurationVar(&queueRetain, "queue-retain", scheduler.DefaultQueueRetain,
+		"How long the outcomes of queued commands are kept after they've been processed.")
+	serverCmd.Flags().String("jwt-jwks", "",
+		"JWKS file holding the public keys bearer tokens are verified with (config auth.jwt.jwks).")
+	viper.BindPFlag("auth.jwt.jwks", serverCmd.Flags().Lookup("jwt-jwks"))
+	serverCmd.Flags().StringSlice("jwt-public-key", nil,
+		"PEM file holding a public key bearer tokens are verified with, can be repeated (config auth.jwt.publicKeys).")
+	viper.BindPFlag("auth.jwt.publicKeys", serverCmd.Flags().Lookup("jwt-public-key"))
+	serverCmd.Flags().String("jwt-issuer", "",
+		"When set, the issuer bearer tokens have to name (config auth.jwt.issuer).")
+	viper.BindPFlag("auth.jwt.issuer", serverCmd.Flags().Lookup("jwt-issuer"))
+	serverCmd.Flags().String("jwt-audience", "",
+		"When set, the audience bearer tokens have to be for (config auth.jwt.audience).")
+	viper.BindPFlag("auth.jwt.audience", serverCmd.Flags().Lookup("jwt-audience"))
+	serverCmd.Flags().String("jwt-namespaces-claim", auth.DefaultNamespacesClaim,
+		"The bearer token claim listing the namespaces its subject can use (config auth.jwt.namespacesClaim).")
+	viper.BindPFlag("auth.jwt.namespacesClaim", serverCmd.Flags().Lookup("jwt-namespaces-claim"))
+	serverCmd.Flags().String("jwt-roles-claim", auth.DefaultRolesClaim,
+		"The bearer token claim listing its subject's roles (config auth.jwt.rolesClaim).")
+	viper.BindPFlag("auth.jwt.rolesClaim", serverCmd.Flags().Lookup("jwt-roles-claim"))
+	serverCmd.Flags().String("policy", "",
+		"Policy file deciding which commands authenticated principals can send (config auth.policy).")
+	viper.BindPFlag("auth.policy", serverCmd.Flags().Lookup("policy"))
 	rootCmd.AddCommand(serverCmd)
 }
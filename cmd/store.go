@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/EncryptedEventStore"
+	"github.com/efvincent/archex5/eventStore/FileEventStore"
+	"github.com/efvincent/archex5/eventStore/MemoryEventStore"
+	"github.com/efvincent/archex5/keystore"
+	"github.com/spf13/viper"
+)
+
+// The event store backends that can be selected with --store
+const (
+	STORE_MEMORY = "memory"
+	STORE_FILE   = "file"
+)
+
+// The key store backends that can be selected with --key-store
+const (
+	KEYS_MEMORY = "memory"
+	KEYS_FILE   = "file"
+)
+
+// The file key store is kept in this file in the data directory, unless --key-file says otherwise
+const keyFileName = "keys.json"
+
+// Opens the event store the configuration asks for. When an encryption keyfile is configured
+// the store is wrapped so that event payloads are encrypted at rest
+func openEventStore() (eventStore.EventStore, error) {
+	store, err := openBackend(viper.GetString("store.type"), viper.GetString("store.path"))
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := loadKeyring()
+	if err != nil || keyring == nil {
+		return store, err
+	}
+	log.Printf("Encrypting event payloads with key %s from %s", keyring.Current, viper.GetString("encryption.keyfile"))
+	return EncryptedEventStore.MakeEncryptedEventStore(store, keyring)
+}
+
+// Reads the keyring the configuration names, nil when no keyfile is configured
+func loadKeyring() (*EncryptedEventStore.Keyring, error) {
+	keyfile := viper.GetString("encryption.keyfile")
+	if len(keyfile) == 0 {
+		return nil, nil
+	}
+	return EncryptedEventStore.LoadKeyfile(keyfile)
+}
+
+// Opens one of the event store backends, without encryption
+func openBackend(storeType string, path string) (eventStore.EventStore, error) {
+	switch storeType {
+	case STORE_MEMORY, "":
+		return MemoryEventStore.SingletonMemoryEventStore, nil
+	case STORE_FILE:
+		if len(path) == 0 {
+			return nil, errors.New("The file event store needs a data directory, use --data-dir or store.path in the config")
+		}
+		return FileEventStore.MakeFileEventStore(path)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown event store '%s', expected %s or %s", storeType, STORE_MEMORY, STORE_FILE))
+	}
+}
+
+// Opens the key store the configuration asks for, which is the same kind as the event store
+// unless it says otherwise. Data keys are wrapped with the encryption keyfile when there is one
+func openKeyStore() (keystore.KeyStore, error) {
+	return openKeyBackend(viper.GetString("keys.type"), viper.GetString("keys.path"),
+		viper.GetString("store.type"), viper.GetString("store.path"))
+}
+
+// Opens one of the key store backends for the event store backend it's used with. An event store
+// that keeps events across restarts needs a key store that keeps keys across them, otherwise the
+// sealed data in its events can't be opened after a restart
+func openKeyBackend(keysType string, path string, storeType string, dataDir string) (keystore.KeyStore, error) {
+	if len(storeType) == 0 {
+		storeType = STORE_MEMORY
+	}
+	if len(keysType) == 0 {
+		keysType = storeType
+	}
+	switch keysType {
+	case KEYS_MEMORY:
+		if storeType != STORE_MEMORY {
+			return nil, errors.New(fmt.Sprintf("The %s event store keeps events across restarts but the memory key store "+
+				"doesn't keep the keys they're sealed with, use --key-store %s", storeType, KEYS_FILE))
+		}
+		return keystore.SingletonMemoryKeyStore, nil
+	case KEYS_FILE:
+		if len(path) == 0 {
+			if len(dataDir) == 0 {
+				return nil, errors.New("The file key store needs a file, use --key-file or keys.path in the config")
+			}
+			path = filepath.Join(dataDir, keyFileName)
+		}
+		keyring, err := loadKeyring()
+		if err != nil {
+			return nil, err
+		}
+		// a nil keyring has to be passed as a nil KeyWrapper, not as a KeyWrapper holding nil
+		var wrapper keystore.KeyWrapper
+		if keyring != nil {
+			wrapper = keyring
+		}
+		return keystore.MakeFileKeyStore(path, wrapper)
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown key store '%s', expected %s or %s", keysType, KEYS_MEMORY, KEYS_FILE))
+	}
+}
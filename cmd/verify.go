@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/efvincent/archex5/processor"
+	"github.com/spf13/cobra"
+)
+
+var verifyNs string
+var verifyStream string
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verifies the hash chains of the event store's streams",
+	Long: `Walks the hash chain of every stream in the event store (or just the namespace or stream
+given) and reports the first broken link in each stream, where an event was altered, removed
+or reordered after it was written. Exits with an error if any chain is broken.`,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(verifyStream) > 0 && len(verifyNs) == 0 {
+			return errors.New("--stream needs --ns")
+		}
+		store, err := openEventStore()
+		if err != nil {
+			return err
+		}
+		cp := processor.MakeCmdProcWithStore(store)
+
+		nss := []string{verifyNs}
+		if len(verifyNs) == 0 {
+			if nss, err = store.GetNamespaces(); err != nil {
+				return err
+			}
+		}
+		sort.Strings(nss)
+		streams, broken := 0, 0
+		for _, ns := range nss {
+			ids := []string{verifyStream}
+			if len(verifyStream) == 0 {
+				if ids, err = store.GetStreams(ns); err != nil {
+					return err
+				}
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				v, err := cp.VerifyStream(ns, id)
+				if err != nil {
+					return err
+				}
+				streams++
+				if !v.Ok {
+					broken++
+					fmt.Printf("BROKEN %s/%s at sequence %v: %s\n", ns, id, v.BrokenAt, v.Reason)
+				}
+			}
+		}
+		fmt.Printf("Verified %v streams, %v broken\n", streams, broken)
+		if broken > 0 {
+			return errors.New(fmt.Sprintf("%v streams have broken hash chains", broken))
+		}
+		return nil
+	},
+}
+
+func init() {
+	verifyCmd.Flags().StringVar(&verifyNs, "ns", "", "Only verify streams in this namespace")
+	verifyCmd.Flags().StringVar(&verifyStream, "stream", "", "Only verify this stream (needs --ns)")
+	rootCmd.AddCommand(verifyCmd)
+}
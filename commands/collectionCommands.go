@@ -0,0 +1,50 @@
+package commands
+
+// Collections group products for merchandising. Collection commands identify the collection
+// rather than a SKU, the SKUs they refer to are members of the collection
+type CollectionCmd struct {
+	Namespace    string `json:"ns" binding:"required"`
+	Timestamp    int    `json:"ts" binding:"required"`
+	UID          string `json:"uid" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+}
+
+func (c CollectionCmd) GetNamespace() string {
+	return c.Namespace
+}
+
+// A request to create a collection that explicitly does not exist
+type CreateCollectionCmd struct {
+	CollectionCmd
+	Name string `json:"name"`
+}
+
+type RenameCollectionCmd struct {
+	CollectionCmd
+	Name string `json:"name"`
+}
+
+// Adds a product to the end of the collection. The product must exist in the
+// collection's namespace
+type AddCollectionProductCmd struct {
+	CollectionCmd
+	SKU string `json:"sku"`
+}
+
+type RemoveCollectionProductCmd struct {
+	CollectionCmd
+	SKU string `json:"sku"`
+}
+
+// Sets the order of the members of a collection. The SKUs must be exactly the
+// current members of the collection, in the new order
+type ReorderCollectionCmd struct {
+	CollectionCmd
+	SKUs []string `json:"skus"`
+}
+
+// Sets the product featured by the collection. The hero must be a member of the collection
+type SetCollectionHeroCmd struct {
+	CollectionCmd
+	SKU string `json:"sku"`
+}
@@ -0,0 +1,49 @@
+package commands
+
+import "reflect"
+
+// The command types the API accepts, by the name a command gives as its commandType. Each is
+// one of UnmarshalAsTypedCommand's cases
+var CommandTypes = []string{
+	"create-product",
+	"update-product-attribs",
+	"update-product-images",
+	"update-product-price",
+	"approve-price-change",
+	"reject-price-change",
+	"set-product-price-list",
+	"product-headcheck",
+	"set-product-supplier",
+	"forget-product-supplier",
+	"delete-product",
+	"product-set-active",
+	"add-product-variant",
+	"update-product-variant",
+	"retire-product-variant",
+	"create-collection",
+	"rename-collection",
+	"add-collection-product",
+	"remove-collection-product",
+	"reorder-collection",
+	"set-collection-hero",
+	"schedule-price-change",
+	"schedule-set-active",
+	"cancel-schedule",
+}
+
+// the name of each command type, found by unmarshaling an empty command of each
+var typeNames = map[reflect.Type]string{}
+
+func init() {
+	for _, name := range CommandTypes {
+		if cmd, err := UnmarshalAsTypedCommand(name, []byte("{}")); err == nil {
+			typeNames[reflect.TypeOf(cmd)] = name
+		}
+	}
+}
+
+// Gets the name of a command's type, empty for the commands the API doesn't accept, which only
+// the server issues
+func CommandTypeOf(cmd interface{}) string {
+	return typeNames[reflect.TypeOf(cmd)]
+}
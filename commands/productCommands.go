@@ -34,18 +34,126 @@ func UnmarshalAsTypedCommand(cmdTypeKey string, rawJson []byte) (interface{}, er
 			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
 		}
 		return cmd, nil
+	case "approve-price-change":
+		cmd := &ApprovePriceChangeCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "reject-price-change":
+		cmd := &RejectPriceChangeCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "set-product-price-list":
+		cmd := &SetPriceListCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
 	case "product-headcheck":
 		cmd := &HeadCheckCmd{}
 		if err := json.Unmarshal(rawJson, cmd); err != nil {
 			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
 		}
 		return cmd, nil
+	case "set-product-supplier":
+		cmd := &SetSupplierContactCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "forget-product-supplier":
+		cmd := &ForgetSupplierContactCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "delete-product":
+		cmd := &DeleteProductCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
 	case "product-set-active":
 		cmd := &SetActiveCmd{}
 		if err := json.Unmarshal(rawJson, cmd); err != nil {
 			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
 		}
 		return cmd, nil
+	case "add-product-variant":
+		cmd := &AddVariantCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "update-product-variant":
+		cmd := &UpdateVariantCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "retire-product-variant":
+		cmd := &RetireVariantCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "create-collection":
+		cmd := &CreateCollectionCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "rename-collection":
+		cmd := &RenameCollectionCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "add-collection-product":
+		cmd := &AddCollectionProductCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "remove-collection-product":
+		cmd := &RemoveCollectionProductCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "reorder-collection":
+		cmd := &ReorderCollectionCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "set-collection-hero":
+		cmd := &SetCollectionHeroCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "schedule-price-change":
+		cmd := &SchedulePriceChangeCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "schedule-set-active":
+		cmd := &ScheduleSetActiveCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
+	case "cancel-schedule":
+		cmd := &CancelScheduleCmd{}
+		if err := json.Unmarshal(rawJson, cmd); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal raw json as '%s'", cmdTypeKey))
+		}
+		return cmd, nil
 	}
 	return nil, errors.New(fmt.Sprintf("Unknown event type '%s'", cmdTypeKey))
 }
@@ -55,6 +163,28 @@ type ProductCmd struct {
 	Timestamp int    `json:"ts" binding:"required"`
 	UID       string `json:"uid" binding:"required"`
 	SKU       string `json:"sku" binding:"required"`
+	// identifies the event that caused this command to be issued, when it was issued in
+	// reaction to an event rather than by a person (see events.EventRef). Only the server's own
+	// process managers set it, it's never read from a command the API is sent
+	CausationId string `json:"-"`
+}
+
+// Implemented by commands that apply to a single namespace, which is all of them
+type Namespaced interface {
+	GetNamespace() string
+}
+
+func (c ProductCmd) GetNamespace() string {
+	return c.Namespace
+}
+
+// Implemented by commands for a single product
+type ForProduct interface {
+	GetSKU() string
+}
+
+func (c ProductCmd) GetSKU() string {
+	return c.SKU
 }
 
 // A request to create a new product (Namespace + SKU) that explicitly does not exist -
@@ -67,6 +197,14 @@ type CreateProductCmd struct {
 	Product   models.ProductModel `json:"product"`
 }
 
+func (c CreateProductCmd) GetNamespace() string {
+	return c.Product.Namespace
+}
+
+func (c CreateProductCmd) GetSKU() string {
+	return c.Product.SKU
+}
+
 // Used to update attributes on the product that do not require special
 // handling or verification
 type UpdateProductAttributesCmd struct {
@@ -82,10 +220,33 @@ type UpdateProductImagesCmd struct {
 	PrimaryImgIdx int      `json:"primaryImgIdx"`
 }
 
+// Updates the product's base price. The price must be in the same currency as the current
+// base price, prices in other currencies are set with SetPriceListCmd
 type UpdatePriceCmd struct {
 	ProductCmd
-	Version int64   `json:"version"`
-	Price   float32 `json:"price"`
+	Version int64        `json:"version"`
+	Price   models.Money `json:"price"`
+}
+
+// Approves a price change that was held because it looked suspicious, applying the price
+type ApprovePriceChangeCmd struct {
+	ProductCmd
+	RequestId string `json:"requestId"`
+	Note      string `json:"note"`
+}
+
+// Rejects a price change that was held because it looked suspicious
+type RejectPriceChangeCmd struct {
+	ProductCmd
+	RequestId string `json:"requestId"`
+	Reason    string `json:"reason"`
+}
+
+// Replaces the product's price list - its prices in currencies other than the base price
+// currency. Currencies missing from the list are no longer offered
+type SetPriceListCmd struct {
+	ProductCmd
+	Prices []models.Money `json:"prices"`
 }
 
 type HeadCheckCmd struct {
@@ -95,5 +256,58 @@ type HeadCheckCmd struct {
 
 type SetActiveCmd struct {
 	ProductCmd
-	Active bool `json:"active"`
+	Active bool   `json:"active"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Sets the product's supplier contact details
+type SetSupplierContactCmd struct {
+	ProductCmd
+	Supplier models.SupplierContact `json:"supplier"`
+}
+
+// Forgets the product's supplier contact details by destroying the keys they were sealed with.
+// This can't be undone, and covers every supplier contact the product has had
+type ForgetSupplierContactCmd struct {
+	ProductCmd
+	Reason string `json:"reason"`
+}
+
+// Deletes a product by writing a tombstone to its stream. The stream keeps its history, but the
+// product no longer appears in listings and accepts no commands until the SKU is created again
+type DeleteProductCmd struct {
+	ProductCmd
+	Reason string `json:"reason"`
+}
+
+// Adds a new variant (size, colour etc) to an existing product. The variant SKU must be
+// unique within the product
+type AddVariantCmd struct {
+	ProductCmd
+	Variant models.VariantModel `json:"variant"`
+}
+
+// Replaces the attributes of an existing variant, identified by the variant's SKU
+type UpdateVariantCmd struct {
+	ProductCmd
+	Variant models.VariantModel `json:"variant"`
+}
+
+// Retires a variant. Retired variants remain part of the product's history but can
+// no longer be updated, and their variant SKU cannot be reused
+type RetireVariantCmd struct {
+	ProductCmd
+	VariantSKU string `json:"variantSku"`
+	Reason     string `json:"reason"`
+}
+
+// Records that the head check monitor has dealt with a head check, and what it decided to do
+// about it. Issued by the monitor rather than by API callers, so it has no command type key.
+// The causation ID refers to the HeadCheckPerformed event
+type RecordHeadCheckObservedCmd struct {
+	ProductCmd
+	HeadCheckSeqNum int64  `json:"headCheckSeqNum"`
+	Success         bool   `json:"success"`
+	Decision        string `json:"decision,omitempty"`
+	Reason          string `json:"reason,omitempty"`
 }
@@ -0,0 +1,43 @@
+package commands
+
+import (
+	"time"
+
+	"github.com/efvincent/archex5/models"
+)
+
+// Schedules a change to the product's base price at a future time. If an end time is given
+// the price in effect when the change starts is restored at the end time, which is how a sale
+// is set up. Times are RFC 3339, for example "2021-04-02T00:00:00-04:00"
+type SchedulePriceChangeCmd struct {
+	ProductCmd
+	Price   models.Money `json:"price"`
+	StartAt time.Time    `json:"startAt"`
+	EndAt   *time.Time   `json:"endAt,omitempty"`
+}
+
+// Schedules activating or deactivating the product at a future time, a product launch for example
+type ScheduleSetActiveCmd struct {
+	ProductCmd
+	Active bool      `json:"active"`
+	At     time.Time `json:"at"`
+}
+
+// Cancels a scheduled change that hasn't happened yet
+type CancelScheduleCmd struct {
+	ProductCmd
+	ScheduleId string `json:"scheduleId"`
+	Reason     string `json:"reason"`
+}
+
+// Records what happened when the scheduler acted on a scheduled change. This is issued by the
+// scheduler rather than by API callers, so it has no command type key
+type RecordScheduleOutcomeCmd struct {
+	ProductCmd
+	ScheduleId  string        `json:"scheduleId"`
+	Outcome     string        `json:"outcome"`
+	RevertPrice *models.Money `json:"revertPrice,omitempty"`
+	// when a sale is started, the request ID its price change will be made with
+	PriceChangeId string `json:"priceChangeId,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
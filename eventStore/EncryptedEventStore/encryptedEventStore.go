@@ -0,0 +1,176 @@
+//
+// The encrypted event store wraps any other event store and encrypts event payloads at rest.
+// Envelopes are encrypted with the keyring's current key on the way in, and the key's ID is
+// stored on the envelope, so they can be decrypted with the right key on the way out even after
+// the current key has been rotated. Envelopes without a key ID were written before encryption
+// was turned on and are returned as they are.
+//
+
+package EncryptedEventStore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	es "github.com/efvincent/archex5/eventStore"
+)
+
+type EncryptedEventStore struct {
+	inner   es.EventStore
+	keyring *Keyring
+}
+
+// Wraps an event store so that the payloads written to it are encrypted with the keyring
+func MakeEncryptedEventStore(inner es.EventStore, keyring *Keyring) (es.EventStore, error) {
+	if err := keyring.validate(); err != nil {
+		return nil, err
+	}
+	return EncryptedEventStore{inner, keyring}, nil
+}
+
+// Gets the wrapped store, which returns envelopes as they're stored - encrypted
+func (ees EncryptedEventStore) Unwrap() es.EventStore {
+	return ees.inner
+}
+
+func (ees EncryptedEventStore) GetNamespaces() ([]string, error) {
+	return ees.inner.GetNamespaces()
+}
+
+func (ees EncryptedEventStore) GetStreams(ns string) ([]string, error) {
+	return ees.inner.GetStreams(ns)
+}
+
+func (ees EncryptedEventStore) CreateNamespace(ns string, settings es.NamespaceSettings) error {
+	return ees.inner.CreateNamespace(ns, settings)
+}
+
+func (ees EncryptedEventStore) DeleteNamespace(ns string) error {
+	return ees.inner.DeleteNamespace(ns)
+}
+
+func (ees EncryptedEventStore) GetNamespaceInfo(ns string) (es.NamespaceInfo, error) {
+	return ees.inner.GetNamespaceInfo(ns)
+}
+
+func (ees EncryptedEventStore) SetNamespaceSettings(ns string, settings es.NamespaceSettings) error {
+	return ees.inner.SetNamespaceSettings(ns, settings)
+}
+
+func (ees EncryptedEventStore) NamespaceExists(ns string) (bool, error) {
+	return ees.inner.NamespaceExists(ns)
+}
+
+func (ees EncryptedEventStore) StreamExists(ns string, streamId string) (bool, error) {
+	return ees.inner.StreamExists(ns, streamId)
+}
+
+func (ees EncryptedEventStore) DeleteStream(ns string, streamId string) error {
+	return ees.inner.DeleteStream(ns, streamId)
+}
+
+func (ees EncryptedEventStore) GetStreamMetadata(ns string, streamId string) (es.StreamMetadata, error) {
+	return ees.inner.GetStreamMetadata(ns, streamId)
+}
+
+func (ees EncryptedEventStore) SetStreamMetadata(ns string, streamId string,
+	expected int64, m es.StreamMetadata) (int64, error) {
+	return ees.inner.SetStreamMetadata(ns, streamId, expected, m)
+}
+
+func (ees EncryptedEventStore) Scavenge() (es.ScavengeReport, error) {
+	return ees.inner.Scavenge()
+}
+
+func (ees EncryptedEventStore) WriteEvent(ns string, streamId string,
+	cMode es.ConcurrencyMode, expected int64, e *es.EventEnvelope) (int64, error) {
+	return ees.WriteBatch(ns, streamId, cMode, expected, []es.EventEnvelope{*e})
+}
+
+// The envelopes are encrypted into a new slice, the caller's envelopes are left in plaintext
+func (ees EncryptedEventStore) WriteBatch(ns string, streamId string,
+	cMode es.ConcurrencyMode, expected int64, events []es.EventEnvelope) (int64, error) {
+	encrypted := make([]es.EventEnvelope, len(events))
+	for i, e := range events {
+		if err := ees.encrypt(ns, streamId, &e); err != nil {
+			return 0, err
+		}
+		encrypted[i] = e
+	}
+	return ees.inner.WriteBatch(ns, streamId, cMode, expected, encrypted)
+}
+
+func (ees EncryptedEventStore) GetEvent(ns string, streamId string, seqNum int64) (*es.EventEnvelope, error) {
+	e, err := ees.inner.GetEvent(ns, streamId, seqNum)
+	if err != nil {
+		return nil, err
+	}
+	d := *e
+	if err := ees.decrypt(ns, streamId, &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (ees EncryptedEventStore) GetEventRange(ns string, streamId string,
+	starting int64, ending int64) ([]es.EventEnvelope, error) {
+	events, err := ees.inner.GetEventRange(ns, streamId, starting, ending)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make([]es.EventEnvelope, len(events))
+	for i, e := range events {
+		if err := ees.decrypt(ns, streamId, &e); err != nil {
+			return nil, err
+		}
+		decrypted[i] = e
+	}
+	return decrypted, nil
+}
+
+// The namespace, stream and event type are authenticated along with the payload, so an encrypted
+// payload can't be passed off as a different event
+func additionalData(ns string, streamId string, e *es.EventEnvelope) []byte {
+	return []byte(fmt.Sprintf("%s/%s/%s", ns, streamId, e.EventType))
+}
+
+func (ees EncryptedEventStore) encrypt(ns string, streamId string, e *es.EventEnvelope) error {
+	gcm, err := ees.gcm(ees.keyring.Current)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	e.Data = gcm.Seal(nonce, nonce, e.Data, additionalData(ns, streamId, e))
+	e.KeyId = ees.keyring.Current
+	return nil
+}
+
+func (ees EncryptedEventStore) decrypt(ns string, streamId string, e *es.EventEnvelope) error {
+	if len(e.KeyId) == 0 {
+		return nil
+	}
+	gcm, err := ees.gcm(e.KeyId)
+	if err != nil {
+		return err
+	}
+	if len(e.Data) < gcm.NonceSize() {
+		return errors.New(fmt.Sprintf("Event %v in stream %s is too short to be encrypted", e.SeqNum, streamId))
+	}
+	nonce, ciphertext := e.Data[:gcm.NonceSize()], e.Data[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, additionalData(ns, streamId, e))
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not decrypt event %v in stream %s: %v", e.SeqNum, streamId, err))
+	}
+	e.Data = data
+	e.KeyId = ""
+	return nil
+}
+
+func (ees EncryptedEventStore) gcm(keyId string) (cipher.AEAD, error) {
+	return ees.keyring.gcm(keyId)
+}
@@ -0,0 +1,206 @@
+package EncryptedEventStore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	es "github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/FileEventStore"
+)
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "encryptedeventstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func innerStore(t *testing.T) es.EventStore {
+	t.Helper()
+	store, err := FileEventStore.MakeFileEventStore(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func keyring(id string) *Keyring {
+	return &Keyring{Current: id, Keys: map[string][]byte{id: bytes.Repeat([]byte(id[:1]), 32)}}
+}
+
+func encrypted(t *testing.T, inner es.EventStore, kr *Keyring) es.EventStore {
+	t.Helper()
+	store, err := MakeEncryptedEventStore(inner, kr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func write(t *testing.T, store es.EventStore, streamId string, events ...es.EventEnvelope) {
+	t.Helper()
+	if _, err := store.WriteBatch("ns", streamId, es.ANY, 0, events); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectData(t *testing.T, store es.EventStore, streamId string, data ...string) {
+	t.Helper()
+	got, err := store.GetEventRange("ns", streamId, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("expected %v events in %s, got %v", len(data), streamId, len(got))
+	}
+	for i, e := range got {
+		if string(e.Data) != data[i] || len(e.KeyId) != 0 {
+			t.Fatalf("expected event %v of %s to be %s, got %s (key %q)", i, streamId, data[i], e.Data, e.KeyId)
+		}
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	inner := innerStore(t)
+	store := encrypted(t, inner, keyring("k1"))
+	write(t, store, "s", es.EventEnvelope{EventType: "a", Data: []byte(`{"secret":1}`)},
+		es.EventEnvelope{EventType: "b", Data: []byte(`{"secret":2}`)})
+	if _, err := store.WriteEvent("ns", "s", es.ANY, 0, &es.EventEnvelope{EventType: "c", Data: []byte(`{"secret":3}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	expectData(t, store, "s", `{"secret":1}`, `{"secret":2}`, `{"secret":3}`)
+	e, err := store.GetEvent("ns", "s", 1)
+	if err != nil || string(e.Data) != `{"secret":2}` {
+		t.Fatalf("expected the event to be decrypted, got %v %v", e, err)
+	}
+
+	raw, _ := inner.GetEventRange("ns", "s", 0, -1)
+	for _, e := range raw {
+		if e.KeyId != "k1" || bytes.Contains(e.Data, []byte("secret")) {
+			t.Fatalf("expected the payload to be stored encrypted with k1, got %s (key %q)", e.Data, e.KeyId)
+		}
+	}
+}
+
+func TestEncryptedReadAfterRotation(t *testing.T) {
+	path := filepath.Join(tempDir(t), "keyfile.json")
+	first, err := RotateKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr, err := LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := innerStore(t)
+	write(t, encrypted(t, inner, kr), "s", es.EventEnvelope{EventType: "a", Data: []byte("before")})
+
+	second, err := RotateKeyfile(path)
+	if err != nil || second == first {
+		t.Fatalf("expected a new current key, got %s %v", second, err)
+	}
+	if kr, err = LoadKeyfile(path); err != nil {
+		t.Fatal(err)
+	}
+	store := encrypted(t, inner, kr)
+	write(t, store, "s", es.EventEnvelope{EventType: "b", Data: []byte("after")})
+	expectData(t, store, "s", "before", "after")
+
+	raw, _ := inner.GetEventRange("ns", "s", 0, -1)
+	if raw[0].KeyId != first || raw[1].KeyId != second {
+		t.Fatalf("expected the events to be encrypted with %s then %s, got %s and %s",
+			first, second, raw[0].KeyId, raw[1].KeyId)
+	}
+}
+
+func TestEncryptedLegacyPassThrough(t *testing.T) {
+	inner := innerStore(t)
+	write(t, inner, "s", es.EventEnvelope{EventType: "a", Data: []byte(`{"plain":true}`)})
+	store := encrypted(t, inner, keyring("k1"))
+	write(t, store, "s", es.EventEnvelope{EventType: "b", Data: []byte(`{"plain":false}`)})
+	expectData(t, store, "s", `{"plain":true}`, `{"plain":false}`)
+}
+
+func TestEncryptedAuthenticatesWhereEventsAre(t *testing.T) {
+	inner := innerStore(t)
+	store := encrypted(t, inner, keyring("k1"))
+	write(t, store, "s", es.EventEnvelope{EventType: "a", Data: []byte("payload")})
+	raw, _ := inner.GetEventRange("ns", "s", 0, -1)
+	stored := raw[0]
+
+	tampered := stored
+	tampered.Data = append([]byte{}, stored.Data...)
+	tampered.Data[len(tampered.Data)-1] ^= 1
+	retyped := stored
+	retyped.EventType = "b"
+
+	for streamId, e := range map[string]es.EventEnvelope{"tampered": tampered, "retyped": retyped, "moved": stored} {
+		write(t, inner, streamId, e)
+		if _, err := store.GetEventRange("ns", streamId, 0, -1); err == nil {
+			t.Fatalf("expected the %s event to fail to decrypt", streamId)
+		}
+		if _, err := store.GetEvent("ns", streamId, 0); err == nil {
+			t.Fatalf("expected the %s event to fail to decrypt", streamId)
+		}
+	}
+
+	truncated := stored
+	truncated.Data = stored.Data[:4]
+	write(t, inner, "truncated", truncated)
+	if _, err := store.GetEventRange("ns", "truncated", 0, -1); err == nil {
+		t.Fatal("expected the truncated event to fail to decrypt")
+	}
+
+	// the original still reads
+	expectData(t, store, "s", "payload")
+}
+
+func TestEncryptedUnknownKey(t *testing.T) {
+	inner := innerStore(t)
+	write(t, encrypted(t, inner, keyring("k1")), "s", es.EventEnvelope{EventType: "a", Data: []byte("payload")})
+	if _, err := encrypted(t, inner, keyring("k2")).GetEventRange("ns", "s", 0, -1); err == nil {
+		t.Fatal("expected an event encrypted with a key that isn't in the keyring to fail")
+	}
+}
+
+func TestEncryptedWriteLeavesEnvelopes(t *testing.T) {
+	store := encrypted(t, innerStore(t), keyring("k1"))
+	batch := []es.EventEnvelope{
+		{EventType: "a", Data: []byte("one")},
+		{EventType: "b", Data: []byte("two")},
+	}
+	write(t, store, "s", batch...)
+	if _, err := store.WriteBatch("ns", "s", es.ANY, 0, batch); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"one", "two"} {
+		if string(batch[i].Data) != want || len(batch[i].KeyId) != 0 {
+			t.Fatalf("expected envelope %v to be left as %s, got %s (key %q)", i, want, batch[i].Data, batch[i].KeyId)
+		}
+	}
+
+	e := &es.EventEnvelope{EventType: "c", Data: []byte("three")}
+	if _, err := store.WriteEvent("ns", "s", es.ANY, 0, e); err != nil {
+		t.Fatal(err)
+	}
+	if string(e.Data) != "three" || len(e.KeyId) != 0 {
+		t.Fatalf("expected the envelope to be left in plaintext, got %s (key %q)", e.Data, e.KeyId)
+	}
+}
+
+func TestEncryptedRefusesBadKeyring(t *testing.T) {
+	if _, err := MakeEncryptedEventStore(innerStore(t), &Keyring{Current: "k1", Keys: map[string][]byte{}}); err == nil {
+		t.Fatal("expected a keyring without its current key to be refused")
+	}
+	if _, err := MakeEncryptedEventStore(innerStore(t), &Keyring{Current: "k1",
+		Keys: map[string][]byte{"k1": []byte("short")}}); err == nil {
+		t.Fatal("expected a key that isn't 32 bytes to be refused")
+	}
+}
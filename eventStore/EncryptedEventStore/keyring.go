@@ -0,0 +1,127 @@
+package EncryptedEventStore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// The keys used to encrypt event payloads. New events are encrypted with the current key, the
+// other keys are kept so that events written before a rotation can still be read. The keyfile is
+// JSON, with keys written as base64:
+//
+//	{"current": "2021-04", "keys": {"2021-01": "...", "2021-04": "..."}}
+type Keyring struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// Reads a keyring from a keyfile
+func LoadKeyfile(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	kr := &Keyring{}
+	if err := json.Unmarshal(b, kr); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read keyfile %s: %v", path, err))
+	}
+	if err := kr.validate(); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid keyfile %s: %v", path, err))
+	}
+	return kr, nil
+}
+
+func (kr *Keyring) validate() error {
+	if _, ok := kr.Keys[kr.Current]; !ok {
+		return errors.New(fmt.Sprintf("The current key '%s' is not in the keyfile", kr.Current))
+	}
+	for id, k := range kr.Keys {
+		if len(k) != 32 {
+			return errors.New(fmt.Sprintf("Key '%s' is %v bytes, keys must be 32 bytes (AES-256)", id, len(k)))
+		}
+	}
+	return nil
+}
+
+// Data keys are wrapped with additional data of their own, so a wrapped key can't be passed off as
+// an encrypted event payload or the other way round
+var wrappedKeyData = []byte("archex5 data key")
+
+// Wraps a data key (see keystore.KeyWrapper) with the current key
+func (kr *Keyring) WrapKey(key []byte) (string, []byte, error) {
+	gcm, err := kr.gcm(kr.Current)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return kr.Current, gcm.Seal(nonce, nonce, key, wrappedKeyData), nil
+}
+
+// Unwraps a data key wrapped with the key with the given ID, which has to still be in the keyring
+func (kr *Keyring) UnwrapKey(wrappedWith string, wrapped []byte) ([]byte, error) {
+	gcm, err := kr.gcm(wrappedWith)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("The wrapped key is too short")
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, wrappedKeyData)
+}
+
+func (kr *Keyring) gcm(keyId string) (cipher.AEAD, error) {
+	key, ok := kr.Keys[keyId]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Key '%s' is not in the keyring", keyId))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Adds a new random key to the keyfile and makes it the current key, creating the keyfile if it
+// doesn't exist. Returns the new key's ID
+func RotateKeyfile(path string) (string, error) {
+	kr := &Keyring{Keys: map[string][]byte{}}
+	if _, err := os.Stat(path); err == nil {
+		if kr, err = LoadKeyfile(path); err != nil {
+			return "", err
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	// a key is never replaced, events encrypted with it would become unreadable
+	id := time.Now().UTC().Format("20060102T150405Z")
+	for n := 2; kr.Keys[id] != nil; n++ {
+		id = fmt.Sprintf("%s-%v", time.Now().UTC().Format("20060102T150405Z"), n)
+	}
+	kr.Keys[id] = key
+	kr.Current = id
+
+	b, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// the keyfile is written somewhere else and moved into place, so a failed write never
+	// loses the keys that existing events need
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return "", err
+	}
+	return id, os.Rename(tmp, path)
+}
@@ -0,0 +1,651 @@
+//
+// The file event store keeps events on disk, so they survive restarts and can be read by the
+// command line tools. Each namespace is a directory, and each stream is a file in it with one JSON
+// envelope per line. Events are only ever appended, and each batch is synced to disk before the
+// write returns. Only one process should write to a data directory at a time, since the store
+// keeps track of the last global position it assigned in memory. A stream's metadata is kept in a
+// file next to the stream's, and the namespace's settings in a file in its directory whose name
+// can't be mistaken for a stream's.
+//
+
+package FileEventStore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/eventStore"
+	es "github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/esErrors.go"
+)
+
+const streamFileExt = ".ndjson"
+const metaFileExt = ".meta.json"
+
+// escaped names never start with a dot, see escapeName
+const namespaceFile = ".namespace.json"
+
+// What's kept in a namespace's file. Namespaces created before the store kept these have none
+type storedNamespace struct {
+	Created  int64                `json:"created"`
+	Settings es.NamespaceSettings `json:"settings"`
+}
+
+type FileEventStore struct {
+	dir      string
+	position *int64
+	// whether writes to namespaces that haven't been created fail
+	strict *bool
+	mutex  *sync.Mutex
+}
+
+// Opens the event store in the given directory, creating the directory if it doesn't exist. Every
+// stream is read to find the last global position the store assigned
+func MakeFileEventStore(dir string) (es.EventStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	fs := FileEventStore{dir: dir, position: new(int64), strict: new(bool), mutex: &sync.Mutex{}}
+	nss, err := fs.GetNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range nss {
+		ids, err := fs.GetStreams(ns)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			strm, err := readStream(fs.streamFile(ns, id))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range strm {
+				if e.Position > *fs.position {
+					*fs.position = e.Position
+				}
+			}
+		}
+	}
+	return fs, nil
+}
+
+// Namespaces and stream IDs are escaped to make file names, so they can hold any character.
+// A leading dot is escaped too, so nothing maps to "." or ".." or a hidden file
+func escapeName(name string) string {
+	n := url.PathEscape(name)
+	if strings.HasPrefix(n, ".") {
+		n = "%2E" + n[1:]
+	}
+	return n
+}
+
+func unescapeName(name string) (string, error) {
+	return url.PathUnescape(name)
+}
+
+func (fs FileEventStore) nsDir(ns string) string {
+	return filepath.Join(fs.dir, escapeName(ns))
+}
+
+func (fs FileEventStore) streamFile(ns string, streamId string) string {
+	return filepath.Join(fs.nsDir(ns), escapeName(streamId)+streamFileExt)
+}
+
+func (fs FileEventStore) streamMetaFile(ns string, streamId string) string {
+	return filepath.Join(fs.nsDir(ns), escapeName(streamId)+metaFileExt)
+}
+
+func (fs FileEventStore) namespaceFile(ns string) string {
+	return filepath.Join(fs.nsDir(ns), namespaceFile)
+}
+
+func (fs FileEventStore) readNamespace(ns string) (storedNamespace, error) {
+	var n storedNamespace
+	b, err := ioutil.ReadFile(fs.namespaceFile(ns))
+	if os.IsNotExist(err) {
+		return n, nil
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := json.Unmarshal(b, &n); err != nil {
+		return n, errors.New(fmt.Sprintf("Could not read the settings of namespace %s: %v", ns, err))
+	}
+	return n, nil
+}
+
+func (fs FileEventStore) writeNamespace(ns string, n storedNamespace) error {
+	b, err := json.Marshal(&n)
+	if err != nil {
+		return err
+	}
+	return replaceFile(fs.namespaceFile(ns), string(b)+"\n")
+}
+
+// Must be called with the mutex held
+func (fs FileEventStore) createNamespace(ns string, settings es.NamespaceSettings) error {
+	if err := os.MkdirAll(fs.nsDir(ns), 0700); err != nil {
+		return err
+	}
+	return fs.writeNamespace(ns, storedNamespace{time.Now().UnixNano(), settings})
+}
+
+func readMeta(path string) (es.StreamMetadata, error) {
+	var m es.StreamMetadata
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, errors.New(fmt.Sprintf("Could not read %s: %v", path, err))
+	}
+	return m, nil
+}
+
+// The retention policy that applies to a stream, the namespace's with the stream's laid over it
+func (fs FileEventStore) retention(ns string, streamId string) (es.RetentionPolicy, error) {
+	n, err := fs.readNamespace(ns)
+	if err != nil {
+		return es.RetentionPolicy{}, err
+	}
+	streamMeta, err := readMeta(fs.streamMetaFile(ns, streamId))
+	if err != nil {
+		return es.RetentionPolicy{}, err
+	}
+	return n.Settings.DefaultRetention.Merge(streamMeta.Retention), nil
+}
+
+func (fs FileEventStore) GetNamespaces() ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	entries, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	nss := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		ns, err := unescapeName(e.Name())
+		if err != nil {
+			return nil, err
+		}
+		nss = append(nss, ns)
+	}
+	return nss, nil
+}
+
+func (fs FileEventStore) GetStreams(ns string) ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return fs.streams(ns)
+}
+
+// Must be called with the mutex held
+func (fs FileEventStore) streams(ns string) ([]string, error) {
+	entries, err := ioutil.ReadDir(fs.nsDir(ns))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	streams := []string{}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), streamFileExt) {
+			continue
+		}
+		id, err := unescapeName(strings.TrimSuffix(e.Name(), streamFileExt))
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, id)
+	}
+	return streams, nil
+}
+
+// Sets whether writes to namespaces that haven't been created fail, see eventStore.StrictNamespaces
+func (fs FileEventStore) SetStrictNamespaces(strict bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	*fs.strict = strict
+}
+
+func (fs FileEventStore) CreateNamespace(ns string, settings es.NamespaceSettings) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	found, err := exists(fs.nsDir(ns))
+	if err != nil {
+		return err
+	}
+	if found {
+		return errors.New(fmt.Sprintf("Namespace %s already exists", ns))
+	}
+	return fs.createNamespace(ns, settings)
+}
+
+// Removes the namespace's directory and everything in it
+func (fs FileEventStore) DeleteNamespace(ns string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	found, err := exists(fs.nsDir(ns))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	return os.RemoveAll(fs.nsDir(ns))
+}
+
+func (fs FileEventStore) GetNamespaceInfo(ns string) (es.NamespaceInfo, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	found, err := exists(fs.nsDir(ns))
+	if err != nil {
+		return es.NamespaceInfo{}, err
+	}
+	if !found {
+		return es.NamespaceInfo{}, errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	n, err := fs.readNamespace(ns)
+	if err != nil {
+		return es.NamespaceInfo{}, err
+	}
+	ids, err := fs.streams(ns)
+	if err != nil {
+		return es.NamespaceInfo{}, err
+	}
+	return es.NamespaceInfo{Namespace: ns, Created: n.Created, Streams: len(ids), Settings: n.Settings}, nil
+}
+
+func (fs FileEventStore) SetNamespaceSettings(ns string, settings es.NamespaceSettings) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	found, err := exists(fs.nsDir(ns))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	n, err := fs.readNamespace(ns)
+	if err != nil {
+		return err
+	}
+	n.Settings = settings
+	return fs.writeNamespace(ns, n)
+}
+
+func (fs FileEventStore) NamespaceExists(ns string) (bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return exists(fs.nsDir(ns))
+}
+
+func (fs FileEventStore) StreamExists(ns string, streamId string) (bool, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return exists(fs.streamFile(ns, streamId))
+}
+
+func exists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (fs FileEventStore) WriteEvent(ns string, streamId string,
+	cMode es.ConcurrencyMode, expected int64, e *es.EventEnvelope) (int64, error) {
+	return fs.WriteBatch(ns, streamId, cMode, expected, []es.EventEnvelope{*e})
+}
+
+// Checks the consistency mode against the stream as it is, then appends the whole batch with a
+// single write. See MemoryEventStore.WriteBatch for how the consistency modes apply to batches
+func (fs FileEventStore) WriteBatch(ns string, streamId string,
+	cMode es.ConcurrencyMode, expected int64, events []es.EventEnvelope) (int64, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// a namespace that hasn't been seen before is created with no settings, unless the store is
+	// strict and namespaces have to be created with CreateNamespace first
+	nsFound, err := exists(fs.nsDir(ns))
+	if err != nil {
+		return 0, err
+	}
+	if !nsFound && *fs.strict {
+		return 0, errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+
+	path := fs.streamFile(ns, streamId)
+	found, err := exists(path)
+	if err != nil {
+		return 0, err
+	}
+	strm := []es.EventEnvelope{}
+	if found {
+		if strm, err = readStream(path); err != nil {
+			return 0, err
+		}
+	}
+
+	switch cMode {
+	case eventStore.NEW_STREAM:
+		if found {
+			return 0, esErrors.NewStreamExists(streamId)
+		}
+	case eventStore.EXISTING_STREAM:
+		if !found {
+			return 0, esErrors.NewStreamDoesNotExist(streamId)
+		}
+	case eventStore.EXPECTING_SEQ_NUM:
+		if !found {
+			return 0, esErrors.NewStreamDoesNotExist(streamId)
+		}
+		if len(strm) == 0 {
+			return 0, esErrors.NewSeqExpectedErr(streamId, expected, -1)
+		}
+		if last := strm[len(strm)-1].SeqNum; last != expected {
+			return 0, esErrors.NewSeqExpectedErr(streamId, expected, last)
+		}
+	}
+
+	next, prevHash := eventStore.StreamStart(events)
+	if len(strm) > 0 {
+		next = strm[len(strm)-1].SeqNum + 1
+		prevHash = strm[len(strm)-1].Hash
+	}
+	batch := make([]es.EventEnvelope, len(events))
+	for i, e := range events {
+		e.SeqNum = next + int64(i)
+		// a position used by a batch that then fails to write is never reused, which leaves a gap
+		// but never gives two events the same position
+		*fs.position++
+		e.Position = *fs.position
+		batch[i] = e
+	}
+	eventStore.ChainEnvelopes(ns, streamId, prevHash, batch)
+
+	var sb strings.Builder
+	for _, e := range batch {
+		b, err := json.Marshal(&e)
+		if err != nil {
+			return 0, err
+		}
+		sb.Write(b)
+		sb.WriteString("\n")
+	}
+	if !nsFound {
+		if err := fs.createNamespace(ns, es.NamespaceSettings{}); err != nil {
+			return 0, err
+		}
+	}
+	if err := appendAndSync(path, sb.String()); err != nil {
+		return 0, err
+	}
+	return batch[len(batch)-1].SeqNum, nil
+}
+
+// Gets the position of the last event written to the store
+func (fs FileEventStore) Position() (int64, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return *fs.position, nil
+}
+
+func appendAndSync(path string, data string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readStream(path string) ([]es.EventEnvelope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	strm := []es.EventEnvelope{}
+	scanner := bufio.NewScanner(f)
+	// envelopes can be much longer than the scanner's default line limit
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var e es.EventEnvelope
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read line %v of %s: %v", line, path, err))
+		}
+		strm = append(strm, e)
+	}
+	return strm, scanner.Err()
+}
+
+func (fs FileEventStore) GetEvent(ns string, streamId string, seqNum int64) (*es.EventEnvelope, error) {
+	strm, err := fs.GetEventRange(ns, streamId, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range strm {
+		if e.SeqNum == seqNum {
+			return &e, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Event sequence %v not found in stream %s, namespace %s",
+		seqNum, streamId, ns))
+}
+
+// Gets the events with sequence numbers from starting to ending inclusive. An ending before
+// starting (-1 for example) means the rest of the stream
+func (fs FileEventStore) GetEventRange(ns string, streamId string,
+	starting int64, ending int64) ([]es.EventEnvelope, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.streamFile(ns, streamId)
+	found, err := exists(path)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Stream %s not found in namespace %s", streamId, ns))
+	}
+	strm, err := readStream(path)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := fs.retention(ns, streamId)
+	if err != nil {
+		return nil, err
+	}
+	strm = strm[es.RetainFrom(strm, policy, time.Now().UnixNano()):]
+	rng := []es.EventEnvelope{}
+	for _, e := range strm {
+		if e.SeqNum >= starting && (ending < starting || e.SeqNum <= ending) {
+			rng = append(rng, e)
+		}
+	}
+	return rng, nil
+}
+
+// Removes the stream's file. The namespace's directory is left, even if it's now empty
+func (fs FileEventStore) DeleteStream(ns string, streamId string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	err := os.Remove(fs.streamFile(ns, streamId))
+	if os.IsNotExist(err) {
+		return esErrors.NewStreamDoesNotExist(streamId)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(fs.streamMetaFile(ns, streamId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fs FileEventStore) GetStreamMetadata(ns string, streamId string) (es.StreamMetadata, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	return readMeta(fs.streamMetaFile(ns, streamId))
+}
+
+// Metadata can only be set on streams that exist
+func (fs FileEventStore) SetStreamMetadata(ns string, streamId string,
+	expected int64, m es.StreamMetadata) (int64, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	found, err := exists(fs.streamFile(ns, streamId))
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, esErrors.NewStreamDoesNotExist(streamId)
+	}
+	path := fs.streamMetaFile(ns, streamId)
+	current, err := readMeta(path)
+	if err != nil {
+		return 0, err
+	}
+	if expected != es.ANY_VERSION && expected != current.Version {
+		return 0, esErrors.NewMetaVersionExpectedErr(streamId, expected, current.Version)
+	}
+	m.Version = current.Version + 1
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceFile(path, string(b)+"\n"); err != nil {
+		return 0, err
+	}
+	return m.Version, nil
+}
+
+// Rewrites the files of streams that hold events their retention policies no longer keep. The
+// envelopes that are kept are written as they were, hashes included
+func (fs FileEventStore) Scavenge() (es.ScavengeReport, error) {
+	report := es.ScavengeReport{}
+	nss, err := fs.GetNamespaces()
+	if err != nil {
+		return report, err
+	}
+	for _, ns := range nss {
+		ids, err := fs.GetStreams(ns)
+		if err != nil {
+			return report, err
+		}
+		for _, id := range ids {
+			removed, err := fs.scavengeStream(ns, id)
+			if err != nil {
+				return report, err
+			}
+			if removed > 0 {
+				report.Streams++
+				report.Removed += removed
+			}
+		}
+	}
+	return report, nil
+}
+
+func (fs FileEventStore) scavengeStream(ns string, streamId string) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	policy, err := fs.retention(ns, streamId)
+	if err != nil || policy.IsZero() {
+		return 0, err
+	}
+	path := fs.streamFile(ns, streamId)
+	strm, err := readStream(path)
+	if err != nil {
+		return 0, err
+	}
+	from := es.RetainFrom(strm, policy, time.Now().UnixNano())
+	if from == 0 {
+		return 0, nil
+	}
+	if err := writeStreamFile(path, strm[from:]); err != nil {
+		return 0, err
+	}
+	return from, nil
+}
+
+// Replaces a stream's envelopes, see eventStore.StreamRewriter. The new stream is written to a
+// temporary file and moved into place, so the stream is never left half written
+func (fs FileEventStore) RewriteStream(ns string, streamId string, events []es.EventEnvelope) error {
+	if len(events) == 0 {
+		return errors.New(fmt.Sprintf("Cannot rewrite stream %s with no events, delete it instead", streamId))
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	path := fs.streamFile(ns, streamId)
+	found, err := exists(path)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return esErrors.NewStreamDoesNotExist(streamId)
+	}
+
+	rewritten := make([]es.EventEnvelope, len(events))
+	copy(rewritten, events)
+	for i := range rewritten {
+		rewritten[i].SeqNum = events[0].SeqNum + int64(i)
+	}
+	_, prevHash := eventStore.StreamStart(rewritten)
+	eventStore.ChainEnvelopes(ns, streamId, prevHash, rewritten)
+	return writeStreamFile(path, rewritten)
+}
+
+func writeStreamFile(path string, strm []es.EventEnvelope) error {
+	var sb strings.Builder
+	for _, e := range strm {
+		b, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		sb.Write(b)
+		sb.WriteString("\n")
+	}
+	return replaceFile(path, sb.String())
+}
+
+// Writes the file's new content to a temporary file and moves it into place, so the file is never
+// left half written
+func replaceFile(path string, data string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := appendAndSync(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
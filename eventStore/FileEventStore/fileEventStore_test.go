@@ -0,0 +1,197 @@
+package FileEventStore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	es "github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/esErrors.go"
+)
+
+func openStore(t *testing.T, dir string) es.EventStore {
+	t.Helper()
+	store, err := MakeFileEventStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func envelopes(types ...string) []es.EventEnvelope {
+	batch := []es.EventEnvelope{}
+	for i, t := range types {
+		batch = append(batch, es.EventEnvelope{Timestamp: int64(i), EventType: t, Data: []byte(`{"t":"` + t + `"}`)})
+	}
+	return batch
+}
+
+func expectCode(t *testing.T, err error, code esErrors.ESErrorCode) {
+	t.Helper()
+	e, ok := err.(*esErrors.ESError)
+	if !ok || e.ErrCode != code {
+		t.Fatalf("expected error code %v, got %v", code, err)
+	}
+}
+
+func expectStream(t *testing.T, store es.EventStore, ns string, streamId string, types ...string) {
+	t.Helper()
+	strm, err := store.GetEventRange(ns, streamId, 0, -1)
+	if err != nil {
+		t.Fatalf("reading %s: %v", streamId, err)
+	}
+	if len(strm) != len(types) {
+		t.Fatalf("expected %v events in %s, got %v", len(types), streamId, len(strm))
+	}
+	for i, e := range strm {
+		if e.SeqNum != int64(i) || e.EventType != types[i] || string(e.Data) != `{"t":"`+types[i]+`"}` {
+			t.Fatalf("expected event %v to be %s, got %v %s %s", i, types[i], e.SeqNum, e.EventType, e.Data)
+		}
+	}
+}
+
+func TestEventsSurviveReopening(t *testing.T) {
+	dir := t.TempDir()
+	store := openStore(t, dir)
+	if _, err := store.WriteBatch("nike", "102", es.NEW_STREAM, 0, envelopes("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteEvent("nike", "102", es.EXPECTING_SEQ_NUM, 1, &envelopes("c")[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openStore(t, dir)
+	expectStream(t, reopened, "nike", "102", "a", "b", "c")
+	last, err := reopened.WriteEvent("nike", "102", es.EXPECTING_SEQ_NUM, 2, &envelopes("d")[0])
+	if err != nil || last != 3 {
+		t.Fatalf("expected to append at 3 after reopening, got %v %v", last, err)
+	}
+}
+
+func TestNamesAreEscaped(t *testing.T) {
+	dir := t.TempDir()
+	store := openStore(t, dir)
+	names := []string{"a/b", "..", ".hidden", "$collections", "with space"}
+	for _, n := range names {
+		if _, err := store.WriteEvent(n, n, es.NEW_STREAM, 0, &envelopes("a")[0]); err != nil {
+			t.Fatalf("writing %s: %v", n, err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name()[0] == '.' {
+			t.Fatalf("namespace directory %s is hidden or escapes the data directory", e.Name())
+		}
+	}
+
+	nss, err := store.GetNamespaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(nss)
+	sort.Strings(names)
+	if len(nss) != len(names) {
+		t.Fatalf("expected namespaces %v, got %v", names, nss)
+	}
+	for i := range names {
+		if nss[i] != names[i] {
+			t.Fatalf("expected namespaces %v, got %v", names, nss)
+		}
+		streams, err := store.GetStreams(names[i])
+		if err != nil || len(streams) != 1 || streams[0] != names[i] {
+			t.Fatalf("expected stream %s in namespace %s, got %v %v", names[i], names[i], streams, err)
+		}
+	}
+}
+
+func TestConsistencyModes(t *testing.T) {
+	store := openStore(t, t.TempDir())
+	_, err := store.WriteBatch("ns", "s", es.EXISTING_STREAM, 0, envelopes("a"))
+	expectCode(t, err, esErrors.STREAM_DOES_NOT_EXIST)
+	_, err = store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 0, envelopes("a"))
+	expectCode(t, err, esErrors.STREAM_DOES_NOT_EXIST)
+	if found, _ := store.StreamExists("ns", "s"); found {
+		t.Fatal("a failed write created the stream")
+	}
+
+	if _, err := store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("c"))
+	expectCode(t, err, esErrors.STREAM_EXISTS)
+	_, err = store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 0, envelopes("c", "d"))
+	expectCode(t, err, esErrors.SEQ_NUM_EXPECTATION_FAILED)
+	expectStream(t, store, "ns", "s", "a", "b")
+
+	if _, err := store.WriteBatch("ns", "s", es.EXISTING_STREAM, 0, envelopes("c")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteBatch("ns", "s", es.ANY, 0, envelopes("d")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteBatch("ns", "other", es.ANY, 0, envelopes("a")); err != nil {
+		t.Fatal(err)
+	}
+	expectStream(t, store, "ns", "s", "a", "b", "c", "d")
+	expectStream(t, store, "ns", "other", "a")
+}
+
+func TestGetEvents(t *testing.T) {
+	store := openStore(t, t.TempDir())
+	store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a", "b", "c", "d"))
+
+	rng, err := store.GetEventRange("ns", "s", 1, 2)
+	if err != nil || len(rng) != 2 || rng[0].EventType != "b" || rng[1].EventType != "c" {
+		t.Fatalf("expected events 1 to 2, got %v %v", rng, err)
+	}
+	rng, err = store.GetEventRange("ns", "s", 2, -1)
+	if err != nil || len(rng) != 2 || rng[0].EventType != "c" || rng[1].EventType != "d" {
+		t.Fatalf("expected events 2 on, got %v %v", rng, err)
+	}
+	e, err := store.GetEvent("ns", "s", 3)
+	if err != nil || e.EventType != "d" {
+		t.Fatalf("expected event 3, got %v %v", e, err)
+	}
+	if _, err := store.GetEvent("ns", "s", 4); err == nil {
+		t.Fatal("expected an error getting an event past the end of the stream")
+	}
+	if _, err := store.GetEventRange("ns", "missing", 0, -1); err == nil {
+		t.Fatal("expected an error reading a stream that doesn't exist")
+	}
+}
+
+func TestBlankLinesAreSkipped(t *testing.T) {
+	dir := t.TempDir()
+	store := openStore(t, dir)
+	store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a"))
+	f, err := os.OpenFile(filepath.Join(dir, "ns", "s"+streamFileExt), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n  \n")
+	f.Close()
+	if _, err := store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 0, envelopes("b")); err != nil {
+		t.Fatal(err)
+	}
+	expectStream(t, store, "ns", "s", "a", "b")
+}
+
+func TestDeleteStream(t *testing.T) {
+	store := openStore(t, t.TempDir())
+	store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a"))
+	if err := store.DeleteStream("ns", "s"); err != nil {
+		t.Fatal(err)
+	}
+	if found, _ := store.StreamExists("ns", "s"); found {
+		t.Fatal("the stream still exists after it was deleted")
+	}
+	expectCode(t, store.DeleteStream("ns", "s"), esErrors.STREAM_DOES_NOT_EXIST)
+	if _, err := store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("b")); err != nil {
+		t.Fatalf("could not recreate a deleted stream: %v", err)
+	}
+}
@@ -3,7 +3,9 @@ package MemoryEventStore
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/efvincent/archex5/eventStore"
 	es "github.com/efvincent/archex5/eventStore"
@@ -11,8 +13,15 @@ import (
 )
 
 type MemoryEventStore struct {
-	nss   map[string]map[string][]es.EventEnvelope
-	mutex *sync.Mutex
+	nss      map[string]map[string][]es.EventEnvelope
+	position *int64
+	// metadata by namespace then stream ID
+	meta map[string]map[string]es.StreamMetadata
+	// when each namespace was created and its settings, the stream count is worked out on reads
+	namespaces map[string]es.NamespaceInfo
+	// whether writes to namespaces that haven't been created fail
+	strict *bool
+	mutex  *sync.Mutex
 }
 
 // Create an initialized memory event store
@@ -21,8 +30,12 @@ type MemoryEventStore struct {
 // map of streams and then a mutex to sync each stream. Left as an exercise.
 func makeMemoryEventStore() es.EventStore {
 	return MemoryEventStore{
-		nss:   map[string]map[string][]es.EventEnvelope{},
-		mutex: &sync.Mutex{},
+		nss:        map[string]map[string][]es.EventEnvelope{},
+		position:   new(int64),
+		meta:       map[string]map[string]es.StreamMetadata{},
+		namespaces: map[string]es.NamespaceInfo{},
+		strict:     new(bool),
+		mutex:      &sync.Mutex{},
 	}
 }
 
@@ -57,6 +70,67 @@ func (ms MemoryEventStore) GetStreams(ns string) ([]string, error) {
 	return []string{}, nil
 }
 
+// Sets whether writes to namespaces that haven't been created fail, see eventStore.StrictNamespaces
+func (ms MemoryEventStore) SetStrictNamespaces(strict bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	*ms.strict = strict
+}
+
+// Must be called with the mutex held
+func (ms MemoryEventStore) createNamespace(ns string, settings es.NamespaceSettings) map[string][]es.EventEnvelope {
+	nspace := map[string][]es.EventEnvelope{}
+	ms.nss[ns] = nspace
+	ms.namespaces[ns] = es.NamespaceInfo{Namespace: ns, Created: time.Now().UnixNano(), Settings: settings}
+	return nspace
+}
+
+func (ms MemoryEventStore) CreateNamespace(ns string, settings es.NamespaceSettings) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.nss[ns]; ok {
+		return errors.New(fmt.Sprintf("Namespace %s already exists", ns))
+	}
+	ms.createNamespace(ns, settings)
+	return nil
+}
+
+func (ms MemoryEventStore) DeleteNamespace(ns string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.nss[ns]; !ok {
+		return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	delete(ms.nss, ns)
+	delete(ms.meta, ns)
+	delete(ms.namespaces, ns)
+	return nil
+}
+
+func (ms MemoryEventStore) GetNamespaceInfo(ns string) (es.NamespaceInfo, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	nspace, ok := ms.nss[ns]
+	if !ok {
+		return es.NamespaceInfo{}, errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	info := ms.namespaces[ns]
+	info.Streams = len(nspace)
+	return info, nil
+}
+
+func (ms MemoryEventStore) SetNamespaceSettings(ns string, settings es.NamespaceSettings) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if _, ok := ms.nss[ns]; !ok {
+		return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	info := ms.namespaces[ns]
+	info.Settings = settings
+	ms.namespaces[ns] = info
+	return nil
+}
+
 // Checks if a namespace exists
 func (ms MemoryEventStore) NamespaceExists(ns string) (bool, error) {
 	ms.mutex.Lock()
@@ -92,69 +166,75 @@ func (ms MemoryEventStore) WriteBatch(ns string, streamId string,
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
-	// The memory based event store creates the namespace when it
-	// hasn't been seen before. This might not be possible in all
-	// implementations, and might make sense to have an explicit
-	// create namespace api on the event store interface
+	// A namespace that hasn't been seen before is created with no settings, unless the store
+	// is strict and namespaces have to be created with CreateNamespace first
 	nspace, ok := ms.nss[ns]
 	if !ok {
-		nspace = map[string][]es.EventEnvelope{}
-		ms.nss[ns] = nspace
-	}
-
-	// I'm assuming that the pass by value here does a deep copy of the event so
-	// that the event store is storing a copy that cannot be mutated later
-	insertEvent := func(e es.EventEnvelope) (int64, error) {
-		if strm, ok := nspace[streamId]; ok {
-			switch cMode {
-			case eventStore.ANY:
-			case eventStore.EXISTING_STREAM:
-				e.SeqNum = int64(len(strm))
-				nspace[streamId] = append(strm, e)
-				return e.SeqNum, nil
-			case eventStore.EXPECTING_SEQ_NUM:
-				if len(strm) == 0 {
-					return 0, esErrors.NewSeqExpectedErr(streamId, expected, -1)
-				}
-				last := strm[len(strm)-1].SeqNum
-				if last != expected {
-					return 0, esErrors.NewSeqExpectedErr(streamId, expected, last)
-				}
-				e.SeqNum = last + 1
-				nspace[streamId] = append(strm, e)
-				return e.SeqNum, nil
-			case eventStore.NEW_STREAM:
-				return 0, esErrors.NewStreamExists(streamId)
-			}
-		} else {
-			switch cMode {
-			case eventStore.ANY:
-			case eventStore.NEW_STREAM:
-				e.SeqNum = int64(len(strm))
-				nspace[streamId] = append(strm, e)
-				return e.SeqNum, nil
-			default:
-				return 0, esErrors.NewStreamDoesNotExist(streamId)
-			}
+		if *ms.strict {
+			return 0, errors.New(fmt.Sprintf("Namespace %s not found", ns))
 		}
-		panic("unreachable code reached")
+		nspace = ms.createNamespace(ns, es.NamespaceSettings{})
 	}
 
-	var lastId int64
-	for i, e := range events {
-		last, err := insertEvent(e)
-		if err != nil {
-			// remove elements from the stream that were part of the batch and written (stored
-			// in the map) before this error
-			s := nspace[streamId]
-			l := len(s)
-			nspace[streamId] = s[:l-i]
-
-			return 0, err
+	// The consistency mode applies to the stream as it was before the batch, each event in the
+	// batch then follows the one before it. Checking up front means a failed batch never leaves
+	// part of itself in the stream
+	strm, exists := nspace[streamId]
+	switch cMode {
+	case eventStore.NEW_STREAM:
+		if exists {
+			return 0, esErrors.NewStreamExists(streamId)
 		}
-		lastId = last
+	case eventStore.EXISTING_STREAM:
+		if !exists {
+			return 0, esErrors.NewStreamDoesNotExist(streamId)
+		}
+	case eventStore.EXPECTING_SEQ_NUM:
+		if !exists {
+			return 0, esErrors.NewStreamDoesNotExist(streamId)
+		}
+		if len(strm) == 0 {
+			return 0, esErrors.NewSeqExpectedErr(streamId, expected, -1)
+		}
+		if last := strm[len(strm)-1].SeqNum; last != expected {
+			return 0, esErrors.NewSeqExpectedErr(streamId, expected, last)
+		}
+	}
+
+	next, prevHash := eventStore.StreamStart(events)
+	if len(strm) > 0 {
+		next = strm[len(strm)-1].SeqNum + 1
+		prevHash = strm[len(strm)-1].Hash
 	}
-	return lastId, nil
+
+	// The envelopes are copied (pass by value) as they're appended so that the event store is
+	// storing copies that cannot be mutated later. Copying the stream before appending means
+	// slices of it that were handed out by earlier reads never see the new events
+	updated := make([]es.EventEnvelope, len(strm), len(strm)+len(events))
+	copy(updated, strm)
+	for _, e := range events {
+		e.SeqNum = next
+		*ms.position++
+		e.Position = *ms.position
+		updated = append(updated, e)
+		next = next + 1
+	}
+	eventStore.ChainEnvelopes(ns, streamId, prevHash, updated[len(strm):])
+	nspace[streamId] = updated
+	return next - 1, nil
+}
+
+// Gets the position of the last event written to the store
+func (ms MemoryEventStore) Position() (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return *ms.position, nil
+}
+
+// Gets the part of a stream its retention policy keeps. Must be called with the mutex held
+func (ms MemoryEventStore) retained(ns string, streamId string, stream []es.EventEnvelope) []es.EventEnvelope {
+	policy := ms.namespaces[ns].Settings.DefaultRetention.Merge(ms.meta[ns][streamId].Retention)
+	return stream[es.RetainFrom(stream, policy, time.Now().UnixNano()):]
 }
 
 func (ms MemoryEventStore) GetEvent(ns string, streamId string,
@@ -163,7 +243,7 @@ func (ms MemoryEventStore) GetEvent(ns string, streamId string,
 	defer ms.mutex.Unlock()
 	if nspace, ok := ms.nss[ns]; ok {
 		if stream, ok := nspace[streamId]; ok {
-			for _, e := range stream {
+			for _, e := range ms.retained(ns, streamId, stream) {
 				if e.SeqNum == seqNum {
 					return &e, nil
 				}
@@ -182,15 +262,113 @@ func (ms MemoryEventStore) GetEventRange(ns string, streamId string,
 	defer ms.mutex.Unlock()
 	if nspace, ok := ms.nss[ns]; ok {
 		if stream, ok := nspace[streamId]; ok {
-			if starting < 0 {
-				starting = 0
+			// a stream retention has cut doesn't start at 0, so the events are found by their
+			// sequence numbers rather than their positions in the slice
+			stream = ms.retained(ns, streamId, stream)
+			from := sort.Search(len(stream), func(i int) bool { return stream[i].SeqNum >= starting })
+			to := len(stream)
+			if ending >= starting {
+				to = sort.Search(len(stream), func(i int) bool { return stream[i].SeqNum > ending })
 			}
-			if ending >= int64(len(stream)) || ending < 0 || ending < starting {
-				return stream[starting:], nil
-			}
-			return stream[starting : ending+1], nil
+			return stream[from:to], nil
 		}
 		return nil, errors.New(fmt.Sprintf("Stream %s not found in namespace %s", streamId, ns))
 	}
 	return nil, errors.New(fmt.Sprintf("Namespace %s not found", ns))
 }
+
+// Removes a stream from a namespace. The namespace remains even if it no longer has any streams
+func (ms MemoryEventStore) DeleteStream(ns string, streamId string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if nspace, ok := ms.nss[ns]; ok {
+		if _, ok := nspace[streamId]; ok {
+			delete(nspace, streamId)
+			delete(ms.meta[ns], streamId)
+			return nil
+		}
+		return esErrors.NewStreamDoesNotExist(streamId)
+	}
+	return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+}
+
+// Replaces a stream's envelopes, see eventStore.StreamRewriter
+func (ms MemoryEventStore) RewriteStream(ns string, streamId string, events []es.EventEnvelope) error {
+	if len(events) == 0 {
+		return errors.New(fmt.Sprintf("Cannot rewrite stream %s with no events, delete it instead", streamId))
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	nspace, ok := ms.nss[ns]
+	if !ok {
+		return errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	if _, ok := nspace[streamId]; !ok {
+		return esErrors.NewStreamDoesNotExist(streamId)
+	}
+	nspace[streamId] = renumber(ns, streamId, events)
+	return nil
+}
+
+func (ms MemoryEventStore) GetStreamMetadata(ns string, streamId string) (es.StreamMetadata, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.meta[ns][streamId], nil
+}
+
+// Metadata can only be set on streams that exist
+func (ms MemoryEventStore) SetStreamMetadata(ns string, streamId string,
+	expected int64, m es.StreamMetadata) (int64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	nspace, ok := ms.nss[ns]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Namespace %s not found", ns))
+	}
+	if _, ok := nspace[streamId]; !ok {
+		return 0, esErrors.NewStreamDoesNotExist(streamId)
+	}
+	current := ms.meta[ns][streamId]
+	if expected != es.ANY_VERSION && expected != current.Version {
+		return 0, esErrors.NewMetaVersionExpectedErr(streamId, expected, current.Version)
+	}
+	if _, ok := ms.meta[ns]; !ok {
+		ms.meta[ns] = map[string]es.StreamMetadata{}
+	}
+	m.Version = current.Version + 1
+	ms.meta[ns][streamId] = m
+	return m.Version, nil
+}
+
+// Drops the events retention policies no longer keep. Streams are replaced with copies rather
+// than sliced, so the dropped events can be garbage collected
+func (ms MemoryEventStore) Scavenge() (es.ScavengeReport, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	report := es.ScavengeReport{}
+	for ns, nspace := range ms.nss {
+		for id, stream := range nspace {
+			kept := ms.retained(ns, id, stream)
+			if len(kept) == len(stream) {
+				continue
+			}
+			nspace[id] = append([]es.EventEnvelope{}, kept...)
+			report.Streams++
+			report.Removed += len(stream) - len(kept)
+		}
+	}
+	return report, nil
+}
+
+// Copies envelopes, numbering them on from the first one's sequence number and rebuilding the
+// hash chain
+func renumber(ns string, streamId string, events []es.EventEnvelope) []es.EventEnvelope {
+	rewritten := make([]es.EventEnvelope, len(events))
+	copy(rewritten, events)
+	for i := range rewritten {
+		rewritten[i].SeqNum = events[0].SeqNum + int64(i)
+	}
+	_, prevHash := eventStore.StreamStart(rewritten)
+	eventStore.ChainEnvelopes(ns, streamId, prevHash, rewritten)
+	return rewritten
+}
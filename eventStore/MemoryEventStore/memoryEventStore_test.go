@@ -0,0 +1,104 @@
+package MemoryEventStore
+
+import (
+	"testing"
+
+	es "github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/esErrors.go"
+)
+
+func envelopes(types ...string) []es.EventEnvelope {
+	batch := []es.EventEnvelope{}
+	for _, t := range types {
+		batch = append(batch, es.EventEnvelope{EventType: t, Data: []byte("{}")})
+	}
+	return batch
+}
+
+func expectCode(t *testing.T, err error, code esErrors.ESErrorCode) {
+	t.Helper()
+	e, ok := err.(*esErrors.ESError)
+	if !ok || e.ErrCode != code {
+		t.Fatalf("expected error code %v, got %v", code, err)
+	}
+}
+
+func expectStream(t *testing.T, store es.EventStore, streamId string, types ...string) {
+	t.Helper()
+	strm, err := store.GetEventRange("ns", streamId, 0, -1)
+	if err != nil {
+		t.Fatalf("reading %s: %v", streamId, err)
+	}
+	if len(strm) != len(types) {
+		t.Fatalf("expected %v events in %s, got %v", len(types), streamId, len(strm))
+	}
+	for i, e := range strm {
+		if e.SeqNum != int64(i) || e.EventType != types[i] {
+			t.Fatalf("expected event %v to be %s, got %v %s", i, types[i], e.SeqNum, e.EventType)
+		}
+	}
+}
+
+func TestWriteBatchNewStream(t *testing.T) {
+	store := makeMemoryEventStore()
+	last, err := store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a", "b", "c"))
+	if err != nil || last != 2 {
+		t.Fatalf("expected the batch to be written up to 2, got %v %v", last, err)
+	}
+	expectStream(t, store, "s", "a", "b", "c")
+
+	_, err = store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("d"))
+	expectCode(t, err, esErrors.STREAM_EXISTS)
+	expectStream(t, store, "s", "a", "b", "c")
+}
+
+func TestWriteBatchExpectingSeqNum(t *testing.T) {
+	store := makeMemoryEventStore()
+	_, err := store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 0, envelopes("a"))
+	expectCode(t, err, esErrors.STREAM_DOES_NOT_EXIST)
+	if found, _ := store.StreamExists("ns", "s"); found {
+		t.Fatal("a failed batch created the stream")
+	}
+
+	store.WriteEvent("ns", "s", es.NEW_STREAM, 0, &envelopes("a")[0])
+	last, err := store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 0, envelopes("b", "c"))
+	if err != nil || last != 2 {
+		t.Fatalf("expected the batch to be written up to 2, got %v %v", last, err)
+	}
+	_, err = store.WriteBatch("ns", "s", es.EXPECTING_SEQ_NUM, 1, envelopes("d", "e"))
+	expectCode(t, err, esErrors.SEQ_NUM_EXPECTATION_FAILED)
+	expectStream(t, store, "s", "a", "b", "c")
+}
+
+func TestWriteBatchExistingStream(t *testing.T) {
+	store := makeMemoryEventStore()
+	_, err := store.WriteBatch("ns", "s", es.EXISTING_STREAM, 0, envelopes("a", "b"))
+	expectCode(t, err, esErrors.STREAM_DOES_NOT_EXIST)
+
+	store.WriteEvent("ns", "s", es.NEW_STREAM, 0, &envelopes("a")[0])
+	if _, err := store.WriteBatch("ns", "s", es.EXISTING_STREAM, 0, envelopes("b", "c")); err != nil {
+		t.Fatal(err)
+	}
+	expectStream(t, store, "s", "a", "b", "c")
+}
+
+func TestWriteBatchAny(t *testing.T) {
+	store := makeMemoryEventStore()
+	if _, err := store.WriteBatch("ns", "s", es.ANY, 0, envelopes("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.WriteBatch("ns", "s", es.ANY, 42, envelopes("c")); err != nil {
+		t.Fatal(err)
+	}
+	expectStream(t, store, "s", "a", "b", "c")
+}
+
+func TestWriteBatchDoesNotChangeEarlierReads(t *testing.T) {
+	store := makeMemoryEventStore()
+	store.WriteBatch("ns", "s", es.NEW_STREAM, 0, envelopes("a", "b"))
+	read, _ := store.GetEventRange("ns", "s", 0, -1)
+	store.WriteBatch("ns", "s", es.ANY, 0, envelopes("c"))
+	if len(read) != 2 || read[0].EventType != "a" || read[1].EventType != "b" {
+		t.Fatalf("an earlier read changed after a write: %v", read)
+	}
+}
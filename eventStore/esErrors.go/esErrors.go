@@ -16,12 +16,17 @@ func NewSeqExpectedErr(sid string, expected int64, actual int64) *ESError {
 	return &ESError{SEQ_NUM_EXPECTATION_FAILED, sid, expected, actual}
 }
 
+func NewMetaVersionExpectedErr(sid string, expected int64, actual int64) *ESError {
+	return &ESError{META_VERSION_EXPECTATION_FAILED, sid, expected, actual}
+}
+
 type ESErrorCode int
 
 const (
 	STREAM_EXISTS ESErrorCode = iota
 	STREAM_DOES_NOT_EXIST
 	SEQ_NUM_EXPECTATION_FAILED
+	META_VERSION_EXPECTATION_FAILED
 )
 
 type ESError struct {
@@ -45,6 +50,9 @@ func (e ESError) Error() string {
 			return fmt.Sprintf("Stream (%s) Expected last sequnce = %v, actual last sequence = %v",
 				e.StreamId, e.Expected, e.Actual)
 		}
+	case META_VERSION_EXPECTATION_FAILED:
+		return fmt.Sprintf("Stream (%s) Expected metadata version = %v, actual metadata version = %v",
+			e.StreamId, e.Expected, e.Actual)
 	default:
 		return fmt.Sprintf("Unknown error code: %v", e.ErrCode)
 	}
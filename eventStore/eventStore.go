@@ -14,11 +14,38 @@ type EventEnvelope struct {
 	Timestamp int64  `json:"ts"`
 	EventType string `json:"et"`
 	Data      []byte `json:"d"`
+	// the key Data is encrypted with, empty when it isn't encrypted (see EncryptedEventStore)
+	KeyId string `json:"k,omitempty"`
+	// the hash chain, computed by the store as the envelope is written (see ComputeHash)
+	Hash     string `json:"h,omitempty"`
+	PrevHash string `json:"ph,omitempty"`
+	// the event's position among every event in the store, assigned by the store as it's written.
+	// Events written later have higher positions, events written before stores numbered them have
+	// none (see Positioned)
+	Position int64 `json:"g,omitempty"`
+	// marks an event that holds the whole state of the stream's aggregate, which retention can cut
+	// the stream at (see RetentionPolicy)
+	Snapshot bool `json:"s,omitempty"`
+	// who sent the command the event was written for, the authenticated principal's name. Empty
+	// for events the server wrote on its own account, or when the API doesn't authenticate
+	Actor string `json:"a,omitempty"`
 }
 
 type EventStore interface {
 	GetNamespaces() ([]string, error)
 
+	// Creates an empty namespace with the given settings. Stores that aren't strict (see
+	// StrictNamespaces) also create a namespace, with no settings, when it's first written to
+	CreateNamespace(ns string, settings NamespaceSettings) error
+
+	// Permanently removes a namespace, every stream in it and their metadata
+	DeleteNamespace(ns string) error
+
+	GetNamespaceInfo(ns string) (NamespaceInfo, error)
+
+	// Replaces a namespace's settings. A new default retention policy takes effect straight away
+	SetNamespaceSettings(ns string, settings NamespaceSettings) error
+
 	GetStreams(ns string) ([]string, error)
 
 	NamespaceExists(ns string) (bool, error)
@@ -36,4 +63,27 @@ type EventStore interface {
 
 	GetEventRange(ns string, streamId string,
 		starting int64, ending int64) ([]EventEnvelope, error)
+
+	// Permanently removes a stream and all of its events. This is an administrative operation,
+	// the normal way to retire an aggregate is with an event that says so
+	DeleteStream(ns string, streamId string) error
+
+	// Gets a stream's metadata. Metadata that has never been set is empty, at version 0
+	GetStreamMetadata(ns string, streamId string) (StreamMetadata, error)
+
+	// Replaces a stream's metadata if it's still at the expected version (or whatever its version
+	// when expected is ANY_VERSION), returning the new version. The version in m is ignored. A
+	// retention policy in the metadata takes effect straight away, events it doesn't keep are left
+	// out of reads and removed for good by Scavenge
+	SetStreamMetadata(ns string, streamId string, expected int64, m StreamMetadata) (int64, error)
+
+	// Removes the events that retention policies no longer keep
+	Scavenge() (ScavengeReport, error)
+}
+
+// Implemented by event stores that give every event they store a global position, which tools
+// that need a consistent view across streams (backups, for example) rely on. Position is the
+// position of the last event written
+type Positioned interface {
+	Position() (int64, error)
 }
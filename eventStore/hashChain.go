@@ -0,0 +1,102 @@
+package eventStore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
+
+// Computes the hash of an envelope, covering where it's stored, its content, and the hash of the
+// envelope before it in the stream. Changing, removing or reordering any event in a stream breaks
+// the chain from that point on. The hash is of the envelope as it's stored, so for encrypted
+// envelopes it covers the ciphertext and key ID
+func ComputeHash(ns string, streamId string, e *EventEnvelope) string {
+	h := sha256.New()
+	fields := []string{ns, streamId, strconv.FormatInt(e.SeqNum, 10), strconv.FormatInt(e.Timestamp, 10),
+		e.EventType, e.KeyId, string(e.Data), e.PrevHash}
+	if e.Snapshot {
+		// only covered when it's set, so the hashes of envelopes from before snapshots are unchanged
+		fields = append(fields, "snapshot")
+	}
+	if len(e.Actor) > 0 {
+		// likewise only covered when there is one
+		fields = append(fields, "actor", e.Actor)
+	}
+	for _, f := range fields {
+		// each field is length prefixed, so no two different envelopes hash the same input
+		binary.Write(h, binary.BigEndian, uint64(len(f)))
+		h.Write([]byte(f))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Links envelopes that are about to be appended to a stream into the stream's hash chain. The
+// envelopes must already have their sequence numbers, prevHash is the hash of the stream's last
+// envelope, or empty for a new stream
+func ChainEnvelopes(ns string, streamId string, prevHash string, es []EventEnvelope) {
+	for i := range es {
+		es[i].PrevHash = prevHash
+		es[i].Hash = ComputeHash(ns, streamId, &es[i])
+		prevHash = es[i].Hash
+	}
+}
+
+// The outcome of walking a stream's hash chain. BrokenAt is the sequence number of the first
+// envelope whose link is broken, when Ok is false
+type VerifyResult struct {
+	Namespace string `json:"ns"`
+	StreamId  string `json:"streamId"`
+	Events    int    `json:"events"`
+	Ok        bool   `json:"ok"`
+	BrokenAt  int64  `json:"brokenAt,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Walks a whole stream's envelopes, as they're stored, and reports the first broken link. A stream
+// retention has cut is verified from the snapshot it starts with
+func VerifyStream(ns string, streamId string, es []EventEnvelope) VerifyResult {
+	r := VerifyResult{Namespace: ns, StreamId: streamId, Events: len(es), Ok: true}
+	_, prevHash := StreamStart(es)
+	for _, e := range es {
+		reason := ""
+		switch {
+		case e.PrevHash != prevHash:
+			reason = fmt.Sprintf("Previous hash %s does not match the hash of the event before it", e.PrevHash)
+		case e.Hash != ComputeHash(ns, streamId, &e):
+			reason = "Hash does not match the event's content"
+		}
+		if len(reason) > 0 {
+			r.Ok, r.BrokenAt, r.Reason = false, e.SeqNum, reason
+			return r
+		}
+		prevHash = e.Hash
+	}
+	return r
+}
+
+// Implemented by event stores that can replace a stream's envelopes wholesale, which tools that
+// repair the event store need. It isn't part of EventStore because it's not something the
+// system ever does in the normal course of events. The envelopes are renumbered from their
+// first sequence number and the stream's hash chain is rebuilt
+type StreamRewriter interface {
+	RewriteStream(ns string, streamId string, es []EventEnvelope) error
+}
+
+// Implemented by event stores that wrap another store and change envelopes on their way in and
+// out, the encrypted event store for example
+type Unwrapper interface {
+	Unwrap() EventStore
+}
+
+// Gets the innermost store, which returns envelopes exactly as they're stored
+func Raw(store EventStore) EventStore {
+	for {
+		u, ok := store.(Unwrapper)
+		if !ok {
+			return store
+		}
+		store = u.Unwrap()
+	}
+}
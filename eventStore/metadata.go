@@ -0,0 +1,71 @@
+package eventStore
+
+import "encoding/json"
+
+// Passed as the expected version to set metadata whatever its current version
+const ANY_VERSION int64 = -1
+
+// What's kept about a stream apart from its events. The well-known keys are the ones the store
+// and the command processor know the meaning of, anything else goes in Custom. Metadata has a
+// version of its own, which is 0 until it's first set and goes up by one every time it's set
+// (see SetStreamMetadata)
+type StreamMetadata struct {
+	Version int64 `json:"version"`
+	// who may do what with the stream
+	Acl *StreamAcl `json:"acl,omitempty"`
+	// how much of the stream the store keeps, laid over the namespace's default
+	Retention RetentionPolicy `json:"retention"`
+	// the media type of the stream's event payloads
+	ContentType string `json:"contentType,omitempty"`
+	// the team that owns the stream
+	OwnerTeam string `json:"ownerTeam,omitempty"`
+	// anything else, kept as it's given
+	Custom map[string]json.RawMessage `json:"custom,omitempty"`
+}
+
+// The principals (users, API keys or roles) allowed to read, write and delete a stream, and to
+// read and write its metadata. An empty list leaves the decision to whatever authorizes requests
+type StreamAcl struct {
+	Read      []string `json:"read,omitempty"`
+	Write     []string `json:"write,omitempty"`
+	Delete    []string `json:"delete,omitempty"`
+	MetaRead  []string `json:"metaRead,omitempty"`
+	MetaWrite []string `json:"metaWrite,omitempty"`
+}
+
+// The kinds of access a StreamAcl gives
+const (
+	ACL_READ       = "read"
+	ACL_WRITE      = "write"
+	ACL_DELETE     = "delete"
+	ACL_META_READ  = "metaRead"
+	ACL_META_WRITE = "metaWrite"
+)
+
+// The principals given the access
+func (a StreamAcl) Principals(access string) []string {
+	switch access {
+	case ACL_READ:
+		return a.Read
+	case ACL_WRITE:
+		return a.Write
+	case ACL_DELETE:
+		return a.Delete
+	case ACL_META_READ:
+		return a.MetaRead
+	case ACL_META_WRITE:
+		return a.MetaWrite
+	}
+	return nil
+}
+
+// Whether two sets of metadata hold the same keys, whatever their versions
+func (m StreamMetadata) SameAs(other StreamMetadata) bool {
+	m.Version, other.Version = 0, 0
+	a, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other)
+	return err == nil && string(a) == string(b)
+}
@@ -0,0 +1,35 @@
+package eventStore
+
+// Settings that apply to every stream in a namespace
+type NamespaceSettings struct {
+	// the currencies prices in the namespace can be in, any supported currency when empty
+	AllowedCurrencies []string `json:"allowedCurrencies,omitempty"`
+	// the retention policy of the namespace's streams, which their own policies are laid over
+	DefaultRetention RetentionPolicy `json:"defaultRetention"`
+	Quotas           NamespaceQuotas `json:"quotas"`
+}
+
+// Limits on how much a namespace holds and how hard it can be driven. Each limit is optional,
+// zero means no limit. The store only keeps them, they're enforced by the command processor
+type NamespaceQuotas struct {
+	MaxStreams         int64 `json:"maxStreams,omitempty"`
+	MaxEventsPerStream int64 `json:"maxEventsPerStream,omitempty"`
+	// the size of an event's payload, in bytes
+	MaxPayloadBytes int64 `json:"maxPayloadBytes,omitempty"`
+	// the sustained rate commands are accepted at. Up to a second's worth can come at once
+	CommandsPerSecond float64 `json:"commandsPerSecond,omitempty"`
+}
+
+type NamespaceInfo struct {
+	Namespace string `json:"namespace"`
+	// when the namespace was created, in unix nanos, zero if the store doesn't know
+	Created  int64             `json:"created"`
+	Streams  int               `json:"streams"`
+	Settings NamespaceSettings `json:"settings"`
+}
+
+// Implemented by event stores that can refuse writes to namespaces that haven't been created
+// with CreateNamespace, rather than creating them on their first write
+type StrictNamespaces interface {
+	SetStrictNamespaces(strict bool)
+}
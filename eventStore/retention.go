@@ -0,0 +1,80 @@
+package eventStore
+
+// How much of a stream the event store keeps. Each limit is optional (zero means no limit), and
+// a stream's policy is the namespace's policy with the stream's own limits laid over it (see
+// Merge). Retention only ever removes the events before a snapshot, so that whatever is kept can
+// still be folded into the aggregate, and never removes the last event, so the stream's sequence
+// carries on. That means a stream can hold more than its limits allow, until a snapshot is
+// written that lets the store drop the older events
+type RetentionPolicy struct {
+	// the most events to keep
+	MaxCount int64 `json:"maxCount,omitempty"`
+	// the oldest event to keep, in seconds
+	MaxAge int64 `json:"maxAge,omitempty"`
+	// events before this sequence number are not kept
+	TruncateBefore int64 `json:"truncateBefore,omitempty"`
+}
+
+func (p RetentionPolicy) IsZero() bool {
+	return p == RetentionPolicy{}
+}
+
+// Lays another policy (a stream's, over its namespace's) over this one, the other policy's limits
+// taking the place of this one's where it has them
+func (p RetentionPolicy) Merge(over RetentionPolicy) RetentionPolicy {
+	if over.MaxCount > 0 {
+		p.MaxCount = over.MaxCount
+	}
+	if over.MaxAge > 0 {
+		p.MaxAge = over.MaxAge
+	}
+	if over.TruncateBefore > 0 {
+		p.TruncateBefore = over.TruncateBefore
+	}
+	return p
+}
+
+// Works out which of a stream's envelopes the policy keeps, as of now (in unix nanos), returning
+// the index of the first one kept. The policy's limits give the earliest envelope that has to go,
+// and the stream is cut at the last snapshot at or before it
+func RetainFrom(es []EventEnvelope, p RetentionPolicy, now int64) int {
+	if p.IsZero() || len(es) == 0 {
+		return 0
+	}
+	cut := 0
+	if p.MaxCount > 0 && int64(len(es)) > p.MaxCount {
+		cut = len(es) - int(p.MaxCount)
+	}
+	for i := cut; i < len(es); i++ {
+		tooOld := p.MaxAge > 0 && es[i].Timestamp < now-p.MaxAge*1e9
+		if !tooOld && es[i].SeqNum >= p.TruncateBefore {
+			break
+		}
+		cut = i + 1
+	}
+	if cut > len(es)-1 {
+		cut = len(es) - 1
+	}
+	for ; cut > 0; cut-- {
+		if es[cut].Snapshot {
+			return cut
+		}
+	}
+	return 0
+}
+
+// Where a new stream's sequence numbers and hash chain start. A stream starts at 0 unless it's a
+// copy of a stream that retention has cut, which starts at its snapshot and keeps the snapshot's
+// link to the events that were removed
+func StreamStart(es []EventEnvelope) (int64, string) {
+	if len(es) > 0 && es[0].Snapshot {
+		return es[0].SeqNum, es[0].PrevHash
+	}
+	return 0, ""
+}
+
+// What a scavenge removed
+type ScavengeReport struct {
+	Streams int `json:"streams"`
+	Removed int `json:"removed"`
+}
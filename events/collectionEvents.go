@@ -0,0 +1,49 @@
+package events
+
+const CollectionCreatedT = "colCreated-1"
+
+type CollectionCreated struct {
+	Namespace    string `json:"ns" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+	Name         string `json:"name"`
+}
+
+const CollectionRenamedT = "colRenamed-1"
+
+type CollectionRenamed struct {
+	Namespace    string `json:"ns" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+	Name         string `json:"name"`
+}
+
+const CollectionProductAddedT = "colProdAdd-1"
+
+type CollectionProductAdded struct {
+	Namespace    string `json:"ns" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+	SKU          string `json:"sku" binding:"required"`
+}
+
+const CollectionProductRemovedT = "colProdRem-1"
+
+type CollectionProductRemoved struct {
+	Namespace    string `json:"ns" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+	SKU          string `json:"sku" binding:"required"`
+}
+
+const CollectionReorderedT = "colReorder-1"
+
+type CollectionReordered struct {
+	Namespace    string   `json:"ns" binding:"required"`
+	CollectionId string   `json:"collectionId" binding:"required"`
+	SKUs         []string `json:"skus"`
+}
+
+const CollectionHeroSetT = "colHero-1"
+
+type CollectionHeroSet struct {
+	Namespace    string `json:"ns" binding:"required"`
+	CollectionId string `json:"collectionId" binding:"required"`
+	SKU          string `json:"sku" binding:"required"`
+}
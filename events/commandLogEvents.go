@@ -0,0 +1,31 @@
+package events
+
+import "encoding/json"
+
+// What became of a command the API was sent
+const (
+	COMMAND_ACCEPTED = "accepted"
+	COMMAND_REJECTED = "rejected"
+	// refused because its stream changed while it was being processed, sending it again may work
+	COMMAND_CONFLICT = "conflict"
+)
+
+// The API was sent a command, whatever became of it. Kept in the namespace's command log
+const CommandLoggedT = "cmdLogged-1"
+
+type CommandLogged struct {
+	Namespace   string `json:"ns" binding:"required"`
+	UID         string `json:"uid" binding:"required"`
+	CommandType string `json:"commandType"`
+	// the product the command was for, empty for commands that aren't for a product
+	SKU string `json:"sku,omitempty"`
+	// the command as the API was sent it, with the ts and uid the API added, left out for commands
+	// refused before they were processed
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// who sent it, empty when the API doesn't authenticate requests
+	Principal string `json:"principal,omitempty"`
+	Outcome   string `json:"outcome"`
+	Error     string `json:"error,omitempty"`
+	// the events the command wrote, as event refs (see EventRef), which hold their sequence numbers
+	Events []string `json:"events,omitempty"`
+}
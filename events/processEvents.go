@@ -0,0 +1,54 @@
+package events
+
+import (
+	"fmt"
+
+	"github.com/efvincent/archex5/models"
+)
+
+// Identifies an event by where it's stored, for example "nike/102/5" is the event with sequence
+// number 5 in the stream for SKU 102 in the nike namespace. Used as a causation ID by commands and
+// events that were issued in reaction to another event
+func EventRef(ns string, streamId string, seqNum int64) string {
+	return fmt.Sprintf("%s/%s/%v", ns, streamId, seqNum)
+}
+
+// The head check monitor saw the outcome of a head check. CausationId refers to the
+// HeadCheckPerformed event
+const HeadCheckObservedT = "pmHcObserved-1"
+
+type HeadCheckObserved struct {
+	Namespace       string `json:"ns" binding:"required"`
+	SKU             string `json:"sku" binding:"required"`
+	HeadCheckSeqNum int64  `json:"headCheckSeqNum"`
+	Success         bool   `json:"success"`
+	CausationId     string `json:"causationId"`
+}
+
+// The head check monitor deactivated the product after too many consecutive failed head checks
+const ProductAutoDeactivatedT = "pmAutoDeact-1"
+
+type ProductAutoDeactivated struct {
+	Namespace   string `json:"ns" binding:"required"`
+	SKU         string `json:"sku" binding:"required"`
+	Reason      string `json:"reason"`
+	CausationId string `json:"causationId"`
+}
+
+// The head check monitor reactivated a product it had deactivated, after a successful head check
+const ProductAutoReactivatedT = "pmAutoReact-1"
+
+type ProductAutoReactivated struct {
+	Namespace   string `json:"ns" binding:"required"`
+	SKU         string `json:"sku" binding:"required"`
+	Reason      string `json:"reason"`
+	CausationId string `json:"causationId"`
+}
+
+// The head check monitor's whole state for a product as of the event before it, see
+// ProductSnapshot
+const HeadCheckMonitorSnapshotT = "pmHcSnapshot-1"
+
+type HeadCheckMonitorSnapshot struct {
+	State models.HeadCheckMonitorModel `json:"state"`
+}
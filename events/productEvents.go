@@ -11,6 +11,9 @@ type ProductCreated struct {
 	SKU       string               `json:"sku" binding:"required"`
 	Source    string               `json:"source"`
 	Product   *models.ProductModel `json:"product"`
+	// the product's supplier contact, which is personal data, is sealed rather than
+	// being written as part of the product
+	Supplier *models.Sealed `json:"supplier,omitempty"`
 }
 
 const AttribsUpdatedT = "attrUpd-1"
@@ -32,28 +35,159 @@ type ImagesUpdated struct {
 	PrimaryImgIdx int      `json:"primatyImgIdx"`
 }
 
-const PriceUpdatedT = "priceUpd-1"
+// Version 1 of the price updated event held the price as a float32 with no currency. It's
+// no longer written, but streams may still contain it, see UpcastEvent
+const PriceUpdatedV1T = "priceUpd-1"
 
-type PriceUpdated struct {
+type PriceUpdatedV1 struct {
 	Namespace string  `json:"ns" binding:"required"`
 	SKU       string  `json:"sku" binding:"required"`
 	Price     float32 `json:"price"`
 }
 
-const HeadCheckPerformedT = "headcheck-1"
+const PriceUpdatedT = "priceUpd-2"
 
-type HeadCheckPerformed struct {
+// Sets the product's active price. RequestId refers to the PriceChangeRequested event that
+// the price was applied for, it's empty for prices applied before requests were recorded
+type PriceUpdated struct {
+	Namespace string       `json:"ns" binding:"required"`
+	SKU       string       `json:"sku" binding:"required"`
+	Price     models.Money `json:"price"`
+	RequestId string       `json:"requestId,omitempty"`
+}
+
+// Records a request to change the price, separately from the decision to apply it
+const PriceChangeRequestedT = "priceChgReq-1"
+
+type PriceChangeRequested struct {
+	Namespace      string       `json:"ns" binding:"required"`
+	SKU            string       `json:"sku" binding:"required"`
+	RequestId      string       `json:"requestId" binding:"required"`
+	Price          models.Money `json:"price"`
+	ReferencePrice models.Money `json:"referencePrice"`
+}
+
+// A requested price change looked suspicious and is waiting for approval
+const PriceChangeHeldT = "priceChgHeld-1"
+
+type PriceChangeHeld struct {
+	Namespace string `json:"ns" binding:"required"`
+	SKU       string `json:"sku" binding:"required"`
+	RequestId string `json:"requestId" binding:"required"`
+	Reason    string `json:"reason"`
+}
+
+const PriceChangeApprovedT = "priceChgApproved-1"
+
+type PriceChangeApproved struct {
+	Namespace string `json:"ns" binding:"required"`
+	SKU       string `json:"sku" binding:"required"`
+	RequestId string `json:"requestId" binding:"required"`
+	Note      string `json:"note"`
+}
+
+const PriceChangeRejectedT = "priceChgRejected-1"
+
+type PriceChangeRejected struct {
 	Namespace string `json:"ns" binding:"required"`
 	SKU       string `json:"sku" binding:"required"`
+	RequestId string `json:"requestId" binding:"required"`
 	Reason    string `json:"reason"`
-	Success   bool   `json:"success"`
-	Info      string `json:"info"`
+}
+
+// Replaces a product's prices in currencies other than its base price currency
+const PriceListSetT = "priceListSet-1"
+
+type PriceListSet struct {
+	Namespace string                  `json:"ns" binding:"required"`
+	SKU       string                  `json:"sku" binding:"required"`
+	Prices    map[string]models.Money `json:"prices"`
+}
+
+const HeadCheckPerformedT = "headcheck-1"
+
+// Info summarizes the checks for people, Checks holds the result of checking each URL. Events
+// recorded while head checks were simulated have no checks
+type HeadCheckPerformed struct {
+	Namespace string            `json:"ns" binding:"required"`
+	SKU       string            `json:"sku" binding:"required"`
+	Reason    string            `json:"reason"`
+	Success   bool              `json:"success"`
+	Info      string            `json:"info"`
+	Checks    []models.UrlCheck `json:"checks,omitempty"`
 }
 
 const ActiveStateSetT = "setactivestate-1"
 
 type ActiveStateSet struct {
+	Namespace   string `json:"ns" binding:"required"`
+	SKU         string `json:"sku" binding:"required"`
+	Active      bool   `json:"active" binding:"required"`
+	Reason      string `json:"reason,omitempty"`
+	CausationId string `json:"causationId,omitempty"`
+}
+
+// The product's supplier contact was set, sealed with the product's key
+const SupplierContactSetT = "supplierSet-1"
+
+type SupplierContactSet struct {
+	Namespace string        `json:"ns" binding:"required"`
+	SKU       string        `json:"sku" binding:"required"`
+	Supplier  models.Sealed `json:"supplier"`
+}
+
+// The keys that sealed the product's supplier contacts were destroyed, so every supplier
+// contact ever recorded for the product is unreadable
+const SupplierContactForgottenT = "supplierForgot-1"
+
+type SupplierContactForgotten struct {
 	Namespace string `json:"ns" binding:"required"`
 	SKU       string `json:"sku" binding:"required"`
-	Active    bool   `json:"active" binding:"required"`
+	Reason    string `json:"reason"`
+}
+
+// A tombstone, the product was deleted. A ProductCreated event may follow if the SKU is reused
+const ProductDeletedT = "prodDeleted-1"
+
+type ProductDeleted struct {
+	Namespace string `json:"ns" binding:"required"`
+	SKU       string `json:"sku" binding:"required"`
+	Reason    string `json:"reason"`
+}
+
+// The whole product as of the event before it, so the product can be rebuilt from here once
+// retention has removed the events before it. Written with the envelope marked as a snapshot
+const ProductSnapshotT = "prodSnapshot-1"
+
+type ProductSnapshot struct {
+	Namespace string               `json:"ns" binding:"required"`
+	SKU       string               `json:"sku" binding:"required"`
+	Product   *models.ProductModel `json:"product"`
+	// sealed, as it is on ProductCreated
+	Supplier *models.Sealed `json:"supplier,omitempty"`
+}
+
+const VariantAddedT = "variantAdd-1"
+
+type VariantAdded struct {
+	Namespace string              `json:"ns" binding:"required"`
+	SKU       string              `json:"sku" binding:"required"`
+	Variant   models.VariantModel `json:"variant"`
+}
+
+const VariantUpdatedT = "variantUpd-1"
+
+type VariantUpdated struct {
+	Namespace string              `json:"ns" binding:"required"`
+	SKU       string              `json:"sku" binding:"required"`
+	Variant   models.VariantModel `json:"variant"`
+}
+
+const VariantRetiredT = "variantRet-1"
+
+type VariantRetired struct {
+	Namespace  string `json:"ns" binding:"required"`
+	SKU        string `json:"sku" binding:"required"`
+	VariantSKU string `json:"variantSku" binding:"required"`
+	Reason     string `json:"reason"`
 }
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Every event type that can be found in the event store, including older versions that are
+// upcast as they're read, mapped to a function that makes an empty event of that type. Tools that
+// check the event store use it to tell whether an envelope holds an event we know how to read
+var registry = map[string]func() interface{}{
+	CollectionCreatedT:        func() interface{} { return &CollectionCreated{} },
+	CollectionRenamedT:        func() interface{} { return &CollectionRenamed{} },
+	CollectionProductAddedT:   func() interface{} { return &CollectionProductAdded{} },
+	CollectionProductRemovedT: func() interface{} { return &CollectionProductRemoved{} },
+	CollectionReorderedT:      func() interface{} { return &CollectionReordered{} },
+	CollectionHeroSetT:        func() interface{} { return &CollectionHeroSet{} },
+	CommandLoggedT:            func() interface{} { return &CommandLogged{} },
+	HeadCheckObservedT:        func() interface{} { return &HeadCheckObserved{} },
+	ProductAutoDeactivatedT:   func() interface{} { return &ProductAutoDeactivated{} },
+	ProductAutoReactivatedT:   func() interface{} { return &ProductAutoReactivated{} },
+	HeadCheckMonitorSnapshotT: func() interface{} { return &HeadCheckMonitorSnapshot{} },
+	ProductCreatedT:           func() interface{} { return &ProductCreated{} },
+	AttribsUpdatedT:           func() interface{} { return &AttribsUpdated{} },
+	ImagesUpdatedT:            func() interface{} { return &ImagesUpdated{} },
+	PriceUpdatedV1T:           func() interface{} { return &PriceUpdatedV1{} },
+	PriceUpdatedT:             func() interface{} { return &PriceUpdated{} },
+	PriceChangeRequestedT:     func() interface{} { return &PriceChangeRequested{} },
+	PriceChangeHeldT:          func() interface{} { return &PriceChangeHeld{} },
+	PriceChangeApprovedT:      func() interface{} { return &PriceChangeApproved{} },
+	PriceChangeRejectedT:      func() interface{} { return &PriceChangeRejected{} },
+	PriceListSetT:             func() interface{} { return &PriceListSet{} },
+	HeadCheckPerformedT:       func() interface{} { return &HeadCheckPerformed{} },
+	ActiveStateSetT:           func() interface{} { return &ActiveStateSet{} },
+	SupplierContactSetT:       func() interface{} { return &SupplierContactSet{} },
+	SupplierContactForgottenT: func() interface{} { return &SupplierContactForgotten{} },
+	ProductDeletedT:           func() interface{} { return &ProductDeleted{} },
+	ProductSnapshotT:          func() interface{} { return &ProductSnapshot{} },
+	VariantAddedT:             func() interface{} { return &VariantAdded{} },
+	VariantUpdatedT:           func() interface{} { return &VariantUpdated{} },
+	VariantRetiredT:           func() interface{} { return &VariantRetired{} },
+	ScheduleCreatedT:          func() interface{} { return &ScheduleCreated{} },
+	ScheduleStartedT:          func() interface{} { return &ScheduleStarted{} },
+	ScheduleCompletedT:        func() interface{} { return &ScheduleCompleted{} },
+	ScheduleFailedT:           func() interface{} { return &ScheduleFailed{} },
+	ScheduleCancelledT:        func() interface{} { return &ScheduleCancelled{} },
+}
+
+// Reports whether the event type is one this version of the system knows how to read
+func IsRegistered(eventType string) bool {
+	_, ok := registry[eventType]
+	return ok
+}
+
+// Gets the registered event types
+func RegisteredTypes() []string {
+	ts := make([]string, 0, len(registry))
+	for t := range registry {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// Unmarshals an event payload as its registered type
+func UnmarshalEvent(eventType string, data []byte) (interface{}, error) {
+	newEvent, ok := registry[eventType]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unregistered event type %s", eventType))
+	}
+	e := newEvent()
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
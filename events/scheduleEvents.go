@@ -0,0 +1,50 @@
+package events
+
+import "github.com/efvincent/archex5/models"
+
+const ScheduleCreatedT = "schedCreated-1"
+
+type ScheduleCreated struct {
+	Namespace string                 `json:"ns" binding:"required"`
+	SKU       string                 `json:"sku" binding:"required"`
+	Schedule  models.ScheduledChange `json:"schedule"`
+}
+
+// A scheduled change with an end time was applied. RevertPrice is the price to restore at
+// the end time
+const ScheduleStartedT = "schedStarted-1"
+
+type ScheduleStarted struct {
+	Namespace   string        `json:"ns" binding:"required"`
+	SKU         string        `json:"sku" binding:"required"`
+	ScheduleId  string        `json:"scheduleId" binding:"required"`
+	RevertPrice *models.Money `json:"revertPrice,omitempty"`
+	// the request ID the sale's price change is made with
+	PriceChangeId string `json:"priceChangeId,omitempty"`
+}
+
+const ScheduleCompletedT = "schedCompleted-1"
+
+type ScheduleCompleted struct {
+	Namespace  string `json:"ns" binding:"required"`
+	SKU        string `json:"sku" binding:"required"`
+	ScheduleId string `json:"scheduleId" binding:"required"`
+}
+
+const ScheduleFailedT = "schedFailed-1"
+
+type ScheduleFailed struct {
+	Namespace  string `json:"ns" binding:"required"`
+	SKU        string `json:"sku" binding:"required"`
+	ScheduleId string `json:"scheduleId" binding:"required"`
+	Error      string `json:"error"`
+}
+
+const ScheduleCancelledT = "schedCancelled-1"
+
+type ScheduleCancelled struct {
+	Namespace  string `json:"ns" binding:"required"`
+	SKU        string `json:"sku" binding:"required"`
+	ScheduleId string `json:"scheduleId" binding:"required"`
+	Reason     string `json:"reason"`
+}
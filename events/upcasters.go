@@ -0,0 +1,41 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/models"
+)
+
+// Events are immutable, so when the shape of an event changes a new version of the event type
+// is introduced and the old version stays in the event store. Upcasting converts an envelope
+// holding an older version into the current version as it's read, so reducers only need to
+// understand the current version of each event. Envelopes already at the current version are
+// returned unchanged.
+func UpcastEvent(e eventStore.EventEnvelope) (eventStore.EventEnvelope, error) {
+	switch e.EventType {
+	case PriceUpdatedV1T:
+		var v1 PriceUpdatedV1
+		if err := json.Unmarshal(e.Data, &v1); err != nil {
+			return e, errors.New(fmt.Sprintf("Could not unmarshal PriceUpdatedV1 event"))
+		}
+		price, err := models.MoneyFromFloat32(v1.Price, models.DefaultCurrency)
+		if err != nil {
+			return e, err
+		}
+		data, err := json.Marshal(&PriceUpdated{
+			Namespace: v1.Namespace,
+			SKU:       v1.SKU,
+			Price:     price,
+		})
+		if err != nil {
+			return e, errors.New(fmt.Sprintf("Could not marshal PriceUpdated event"))
+		}
+		e.EventType = PriceUpdatedT
+		e.Data = data
+		return UpcastEvent(e)
+	}
+	return e, nil
+}
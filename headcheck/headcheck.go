@@ -0,0 +1,134 @@
+//
+// Head checks make sure a product's page and images can still be reached. The command processor
+// uses a Checker to do the actual checking, so tests can point it at httptest servers or
+// replace it with one that doesn't touch the network at all.
+//
+
+package headcheck
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/models"
+)
+
+type Checker interface {
+	// Checks that the URL can be reached, recording the response status and latency
+	Check(url string) models.UrlCheck
+}
+
+const (
+	DefaultTimeout      = 5 * time.Second
+	DefaultMaxRedirects = 5
+)
+
+// Checks URLs with an HTTP HEAD request, falling back to a GET for servers that don't
+// support HEAD
+type HTTPChecker struct {
+	client *http.Client
+}
+
+// Makes an HTTP checker where each request times out after the given duration and follows
+// at most maxRedirects redirects
+func MakeHTTPChecker(timeout time.Duration, maxRedirects int) *HTTPChecker {
+	return &HTTPChecker{&http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return errors.New(fmt.Sprintf("stopped after %v redirects", maxRedirects))
+			}
+			return nil
+		},
+	}}
+}
+
+// Makes an HTTP checker using the default timeout and redirect limit
+func MakeDefaultChecker() *HTTPChecker {
+	return MakeHTTPChecker(DefaultTimeout, DefaultMaxRedirects)
+}
+
+func (c *HTTPChecker) Check(url string) models.UrlCheck {
+	result := c.request(http.MethodHead, url)
+
+	// plenty of servers answer HEAD with an error even though the resource is there, and
+	// some don't answer it at all, so anything other than success is tried again with a GET
+	if !result.Ok() {
+		result = c.request(http.MethodGet, url)
+	}
+	return result
+}
+
+// What checking a product found
+type Result struct {
+	// whether every URL passed, false when there were none to check
+	Success bool
+	// a line for each URL's check, separated by semicolons
+	Info   string
+	Checks []models.UrlCheck
+}
+
+// Checks a product's page, when it has one, followed by its images. The URLs are checked
+// concurrently, a product with many slow images would otherwise take the sum of all their
+// timeouts, and the checks are kept in that order
+func CheckProduct(c Checker, url string, images []string) Result {
+	urls := []string{}
+	if len(url) > 0 {
+		urls = append(urls, url)
+	}
+	urls = append(urls, images...)
+
+	checks := make([]models.UrlCheck, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			checks[i] = c.Check(url)
+		}(i, url)
+	}
+	wg.Wait()
+
+	success := len(checks) > 0
+	info := []string{}
+	for _, c := range checks {
+		success = success && c.Ok()
+		if len(c.Error) > 0 {
+			info = append(info, fmt.Sprintf("%s %s failed after %vms: %s", c.Method, c.Url, c.LatencyMs, c.Error))
+		} else {
+			info = append(info, fmt.Sprintf("%s %s %v in %vms", c.Method, c.Url, c.Status, c.LatencyMs))
+		}
+	}
+	if len(checks) == 0 {
+		info = append(info, "Product has no url or images to check")
+	}
+	return Result{success, strings.Join(info, "; "), checks}
+}
+
+func (c *HTTPChecker) request(method string, url string) models.UrlCheck {
+	result := models.UrlCheck{Url: url, Method: method}
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	// only the status matters, but a little of the body is read so the connection can be reused
+	io.CopyN(ioutil.Discard, resp.Body, 4096)
+	result.Status = resp.StatusCode
+	return result
+}
@@ -0,0 +1,145 @@
+package headcheck
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efvincent/archex5/models"
+)
+
+func server(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Answers HEAD with the status, and GET with 200
+func headStatus(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func TestCheckHead(t *testing.T) {
+	s := server(t, headStatus(http.StatusOK))
+	c := MakeDefaultChecker().Check(s.URL)
+	if !c.Ok() || c.Method != http.MethodHead || c.Status != http.StatusOK || c.Url != s.URL {
+		t.Fatalf("expected the HEAD to pass, got %+v", c)
+	}
+}
+
+func TestCheckFallsBackToGet(t *testing.T) {
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		s := server(t, headStatus(status))
+		c := MakeDefaultChecker().Check(s.URL)
+		if !c.Ok() || c.Method != http.MethodGet || c.Status != http.StatusOK {
+			t.Fatalf("expected a HEAD answered with %v to be tried again with a GET, got %+v", status, c)
+		}
+	}
+
+	s := server(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	c := MakeDefaultChecker().Check(s.URL)
+	if c.Ok() || c.Method != http.MethodGet || c.Status != http.StatusNotFound {
+		t.Fatalf("expected the GET's failure to be reported, got %+v", c)
+	}
+}
+
+func TestCheckRedirectLimit(t *testing.T) {
+	// /n redirects to /n-1, and /0 is the page
+	var s *httptest.Server
+	s = server(t, func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("%s/%v", s.URL, n-1), http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	checker := MakeHTTPChecker(DefaultTimeout, 2)
+	if c := checker.Check(s.URL + "/2"); !c.Ok() {
+		t.Fatalf("expected 2 redirects to be followed, got %+v", c)
+	}
+	c := checker.Check(s.URL + "/3")
+	if c.Ok() || !strings.Contains(c.Error, "stopped after 2 redirects") {
+		t.Fatalf("expected 3 redirects to be too many, got %+v", c)
+	}
+}
+
+func TestCheckTimeout(t *testing.T) {
+	s := server(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	start := time.Now()
+	c := MakeHTTPChecker(50*time.Millisecond, DefaultMaxRedirects).Check(s.URL)
+	if c.Ok() || len(c.Error) == 0 || c.Method != http.MethodGet {
+		t.Fatalf("expected both requests to time out, got %+v", c)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("expected the check to give up after its timeout, it took %v", elapsed)
+	}
+}
+
+// Answers with a canned check for each URL, without touching the network
+type fakeChecker map[string]models.UrlCheck
+
+func (f fakeChecker) Check(url string) models.UrlCheck {
+	return f[url]
+}
+
+func TestCheckProduct(t *testing.T) {
+	ok := server(t, headStatus(http.StatusOK))
+	missing := server(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) })
+	checker := MakeDefaultChecker()
+
+	r := CheckProduct(checker, ok.URL+"/page", []string{ok.URL + "/a.png", ok.URL + "/b.png"})
+	if !r.Success || len(r.Checks) != 3 {
+		t.Fatalf("expected every URL to pass, got %+v", r)
+	}
+	for i, url := range []string{ok.URL + "/page", ok.URL + "/a.png", ok.URL + "/b.png"} {
+		if r.Checks[i].Url != url {
+			t.Fatalf("expected the page then the images in order, got %+v", r.Checks)
+		}
+	}
+
+	// one failing image fails the check, whichever URL it is
+	r = CheckProduct(checker, ok.URL+"/page", []string{ok.URL + "/a.png", missing.URL + "/b.png"})
+	if r.Success || len(r.Checks) != 3 {
+		t.Fatalf("expected the missing image to fail the check, got %+v", r)
+	}
+
+	// a product without a page only has its images checked
+	r = CheckProduct(checker, "", []string{ok.URL + "/a.png"})
+	if !r.Success || len(r.Checks) != 1 || r.Checks[0].Url != ok.URL+"/a.png" {
+		t.Fatalf("expected only the image to be checked, got %+v", r)
+	}
+
+	r = CheckProduct(checker, "", nil)
+	if r.Success || len(r.Checks) != 0 || r.Info != "Product has no url or images to check" {
+		t.Fatalf("expected a product with nothing to check to fail, got %+v", r)
+	}
+}
+
+func TestCheckProductInfo(t *testing.T) {
+	checker := fakeChecker{
+		"http://shop/page": {Url: "http://shop/page", Method: "HEAD", Status: 200, LatencyMs: 12},
+		"http://cdn/a.png": {Url: "http://cdn/a.png", Method: "GET", LatencyMs: 5000, Error: "timeout"},
+	}
+	r := CheckProduct(checker, "http://shop/page", []string{"http://cdn/a.png"})
+	want := "HEAD http://shop/page 200 in 12ms; GET http://cdn/a.png failed after 5000ms: timeout"
+	if r.Success || r.Info != want {
+		t.Fatalf("expected a failed check with info %q, got %+v", want, r)
+	}
+}
@@ -0,0 +1,353 @@
+//
+// The file key store keeps data keys in a JSON file, so sealed data can still be opened after a
+// restart. The whole file is rewritten whenever a key is created or a subject is forgotten, by
+// writing it somewhere else and moving it into place, so a failed write never loses keys. When
+// the store is given a KeyWrapper, the keys are wrapped with it before they're written, and the
+// file is no use without the wrapping keys.
+//
+
+package keystore
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Wraps data keys with a key encryption key, such as the keyring event payloads are encrypted with
+type KeyWrapper interface {
+	// Wraps the key, returning the ID of the key it was wrapped with along with the wrapped key
+	WrapKey(key []byte) (string, []byte, error)
+
+	// Unwraps a key wrapped with the key with the given ID
+	UnwrapKey(wrappedWith string, wrapped []byte) ([]byte, error)
+}
+
+// A data key as a key store keeps it
+type StoredKey struct {
+	// the ID of the key it's wrapped with, empty when it isn't wrapped
+	WrappedWith string `json:"wrappedWith,omitempty"`
+	Key         []byte `json:"key"`
+}
+
+// The keys a key store holds, which is what the file key store's file holds, and what's copied
+// when keys are backed up or migrated
+type KeySet struct {
+	Keys     map[string]StoredKey `json:"keys"`
+	Current  map[string]string    `json:"current"`
+	Subjects map[string][]string  `json:"subjects"`
+	// the IDs of the keys destroyed when subjects were forgotten, by subject, so that copying keys
+	// from a store that still has them never brings them back
+	Forgotten map[string][]string `json:"forgotten,omitempty"`
+}
+
+func makeKeySet() KeySet {
+	return KeySet{Keys: map[string]StoredKey{}, Current: map[string]string{}, Subjects: map[string][]string{},
+		Forgotten: map[string][]string{}}
+}
+
+// Implemented by key stores whose keys can be copied to another key store
+type Transferable interface {
+	// Gets every key the store holds, as it's stored
+	Export() (KeySet, error)
+
+	// Adds the keys the store doesn't have yet, returning how many were added. Keys either store
+	// has destroyed are never added, and the keys destroyed in ks are destroyed in the store too
+	Import(ks KeySet) (int, error)
+}
+
+type FileKeyStore struct {
+	path    string
+	wrapper KeyWrapper
+	mutex   *sync.Mutex
+	stored  *KeySet
+	// the unwrapped keys, by key ID
+	keys map[string][]byte
+}
+
+// Opens the key store kept in the file at path, which is created when the first key is. Keys are
+// wrapped with the wrapper when it isn't nil. Every key is unwrapped when the store is opened, so
+// a missing wrapping key is found straight away rather than when data is opened
+func MakeFileKeyStore(path string, wrapper KeyWrapper) (KeyStore, error) {
+	fks := FileKeyStore{path: path, wrapper: wrapper, mutex: &sync.Mutex{}, keys: map[string][]byte{}}
+	stored := makeKeySet()
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &stored); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read key store %s: %v", path, err))
+		}
+	}
+	fks.stored = &stored
+	if err := fks.unwrapAll(stored); err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not read key store %s: %v", path, err))
+	}
+	return fks, nil
+}
+
+func (fks FileKeyStore) unwrapAll(ks KeySet) error {
+	for keyId, sk := range ks.Keys {
+		key, err := fks.unwrap(sk)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Could not unwrap key %s: %v", keyId, err))
+		}
+		fks.keys[keyId] = key
+	}
+	return nil
+}
+
+func (fks FileKeyStore) unwrap(sk StoredKey) ([]byte, error) {
+	if len(sk.WrappedWith) == 0 {
+		return sk.Key, nil
+	}
+	if fks.wrapper == nil {
+		return nil, errors.New(fmt.Sprintf("It's wrapped with '%s', but no keyfile is configured", sk.WrappedWith))
+	}
+	return fks.wrapper.UnwrapKey(sk.WrappedWith, sk.Key)
+}
+
+func (fks FileKeyStore) wrap(key []byte) (StoredKey, error) {
+	if fks.wrapper == nil {
+		return StoredKey{Key: key}, nil
+	}
+	wrappedWith, wrapped, err := fks.wrapper.WrapKey(key)
+	return StoredKey{WrappedWith: wrappedWith, Key: wrapped}, err
+}
+
+// Writes the key set to the file, only replacing what the store holds once it has been written
+func (fks FileKeyStore) save(ks KeySet) error {
+	b, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fks.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, fks.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	*fks.stored = ks
+	return nil
+}
+
+// A copy of the key set, for a change that's only kept once it has been saved
+func (ks KeySet) clone() KeySet {
+	c := makeKeySet()
+	for id, k := range ks.Keys {
+		c.Keys[id] = k
+	}
+	for subject, id := range ks.Current {
+		c.Current[subject] = id
+	}
+	for subject, ids := range ks.Subjects {
+		c.Subjects[subject] = append([]string{}, ids...)
+	}
+	for subject, ids := range ks.Forgotten {
+		c.Forgotten[subject] = append([]string{}, ids...)
+	}
+	return c
+}
+
+// The part of the key set that belongs to the subjects, along with the keys destroyed when they
+// were forgotten
+func (ks KeySet) Only(subjects []string) KeySet {
+	c := makeKeySet()
+	for _, subject := range subjects {
+		if ids, ok := ks.Subjects[subject]; ok {
+			c.Subjects[subject] = append([]string{}, ids...)
+			for _, id := range ids {
+				c.Keys[id] = ks.Keys[id]
+			}
+		}
+		if id, ok := ks.Current[subject]; ok {
+			c.Current[subject] = id
+		}
+		if ids, ok := ks.Forgotten[subject]; ok {
+			c.Forgotten[subject] = append([]string{}, ids...)
+		}
+	}
+	return c
+}
+
+// Whether the key was destroyed when its subject was forgotten
+func (ks KeySet) destroyed(keyId string) bool {
+	for _, ids := range ks.Forgotten {
+		for _, id := range ids {
+			if id == keyId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Destroys a key the set may hold, recording it as forgotten with the subject
+func (ks KeySet) destroy(subject string, keyId string) {
+	delete(ks.Keys, keyId)
+	for s, ids := range ks.Subjects {
+		kept := []string{}
+		for _, id := range ids {
+			if id != keyId {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == 0 {
+			delete(ks.Subjects, s)
+		} else {
+			ks.Subjects[s] = kept
+		}
+	}
+	for s, id := range ks.Current {
+		if id == keyId {
+			delete(ks.Current, s)
+		}
+	}
+	if !ks.destroyed(keyId) {
+		ks.Forgotten[subject] = append(ks.Forgotten[subject], keyId)
+	}
+}
+
+func (fks FileKeyStore) CurrentKey(subject string) (string, []byte, error) {
+	fks.mutex.Lock()
+	defer fks.mutex.Unlock()
+	if keyId, ok := fks.stored.Current[subject]; ok {
+		return keyId, fks.keys[keyId], nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	sk, err := fks.wrap(key)
+	if err != nil {
+		return "", nil, err
+	}
+	keyId := uuid.New().String()
+	ks := fks.stored.clone()
+	ks.Keys[keyId] = sk
+	ks.Current[subject] = keyId
+	ks.Subjects[subject] = append(ks.Subjects[subject], keyId)
+	if err := fks.save(ks); err != nil {
+		return "", nil, err
+	}
+	fks.keys[keyId] = key
+	return keyId, key, nil
+}
+
+func (fks FileKeyStore) Key(keyId string) ([]byte, error) {
+	fks.mutex.Lock()
+	defer fks.mutex.Unlock()
+	if key, ok := fks.keys[keyId]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyDestroyed
+}
+
+// The subject's keys are removed from the file, which is replaced rather than changed in place,
+// and only their IDs are kept. Forgetting a subject that has no keys isn't an error, the outcome
+// is the same
+func (fks FileKeyStore) Forget(subject string) error {
+	fks.mutex.Lock()
+	defer fks.mutex.Unlock()
+	ids, ok := fks.stored.Subjects[subject]
+	if !ok {
+		return nil
+	}
+	ks := fks.stored.clone()
+	for _, keyId := range ids {
+		ks.destroy(subject, keyId)
+	}
+	if err := fks.save(ks); err != nil {
+		return err
+	}
+	for _, keyId := range ids {
+		delete(fks.keys, keyId)
+	}
+	return nil
+}
+
+func (fks FileKeyStore) Export() (KeySet, error) {
+	fks.mutex.Lock()
+	defer fks.mutex.Unlock()
+	return fks.stored.clone(), nil
+}
+
+// Imported keys are unwrapped with the store's wrapper and wrapped again, so they have to have
+// been wrapped with a key the store's wrapper has. A subject that already has a current key
+// keeps it. Subjects forgotten in either store stay forgotten, whichever has the older keys
+func (fks FileKeyStore) Import(in KeySet) (int, error) {
+	fks.mutex.Lock()
+	defer fks.mutex.Unlock()
+	ks := fks.stored.clone()
+	destroyed := []string{}
+	for subject, ids := range in.Forgotten {
+		for _, keyId := range ids {
+			if !ks.destroyed(keyId) {
+				ks.destroy(subject, keyId)
+				destroyed = append(destroyed, keyId)
+			}
+		}
+	}
+	unwrapped := map[string][]byte{}
+	for keyId, sk := range in.Keys {
+		if _, ok := ks.Keys[keyId]; ok || ks.destroyed(keyId) {
+			continue
+		}
+		key, err := fks.unwrap(sk)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Could not unwrap key %s: %v", keyId, err))
+		}
+		if ks.Keys[keyId], err = fks.wrap(key); err != nil {
+			return 0, err
+		}
+		unwrapped[keyId] = key
+	}
+	for subject, ids := range in.Subjects {
+		for _, keyId := range ids {
+			if _, ok := unwrapped[keyId]; ok {
+				ks.Subjects[subject] = append(ks.Subjects[subject], keyId)
+			}
+		}
+	}
+	for subject, keyId := range in.Current {
+		if _, ok := ks.Current[subject]; !ok {
+			if _, ok := ks.Keys[keyId]; ok {
+				ks.Current[subject] = keyId
+			}
+		}
+	}
+	if len(unwrapped) == 0 && len(destroyed) == 0 {
+		return 0, nil
+	}
+	if err := fks.save(ks); err != nil {
+		return 0, err
+	}
+	for _, keyId := range destroyed {
+		delete(fks.keys, keyId)
+	}
+	for keyId, key := range unwrapped {
+		fks.keys[keyId] = key
+	}
+	return len(unwrapped), nil
+}
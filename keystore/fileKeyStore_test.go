@@ -0,0 +1,158 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/efvincent/archex5/eventStore/EncryptedEventStore"
+)
+
+func tempFile(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "filekeystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "keys.json")
+}
+
+func openKeys(t *testing.T, path string, wrapper KeyWrapper) KeyStore {
+	t.Helper()
+	ks, err := MakeFileKeyStore(path, wrapper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func keyring() *EncryptedEventStore.Keyring {
+	return &EncryptedEventStore.Keyring{Current: "k1", Keys: map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}}
+}
+
+func TestFileKeyStoreReopen(t *testing.T) {
+	path := tempFile(t)
+	ks := openKeys(t, path, nil)
+	sealed, err := Seal(ks, "a", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyId, _, _ := ks.CurrentKey("a")
+
+	reopened := openKeys(t, path, nil)
+	if plaintext, err := Open(reopened, sealed); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("expected the reopened store to open the data, got %q %v", plaintext, err)
+	}
+	if again, _, _ := reopened.CurrentKey("a"); again != keyId {
+		t.Fatalf("expected the subject to keep key %s, got %s", keyId, again)
+	}
+}
+
+func TestFileKeyStoreForget(t *testing.T) {
+	path := tempFile(t)
+	ks := openKeys(t, path, nil)
+	sealed, _ := Seal(ks, "a", []byte("secret"))
+	kept, _ := Seal(ks, "b", []byte("other"))
+	_, key, _ := ks.CurrentKey("a")
+	if err := ks.Forget("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Forget("nobody"); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openKeys(t, path, nil)
+	if _, err := Open(reopened, sealed); err != ErrKeyDestroyed {
+		t.Fatalf("expected the forgotten subject's data to stay unreadable, got %v", err)
+	}
+	if _, err := Open(reopened, kept); err != nil {
+		t.Fatal(err)
+	}
+	// only the key's ID is kept, so it's never copied back from another store
+	if b, _ := ioutil.ReadFile(path); bytes.Contains(b, []byte(base64.StdEncoding.EncodeToString(key))) {
+		t.Fatal("the forgotten key is still in the file")
+	}
+}
+
+func TestFileKeyStoreWrapped(t *testing.T) {
+	path := tempFile(t)
+	ks := openKeys(t, path, keyring())
+	sealed, _ := Seal(ks, "a", []byte("secret"))
+	_, key, _ := ks.CurrentKey("a")
+	if b, _ := ioutil.ReadFile(path); bytes.Contains(b, key) {
+		t.Fatal("the key was written unwrapped")
+	}
+
+	if _, err := MakeFileKeyStore(path, nil); err == nil {
+		t.Fatal("expected wrapped keys to need the keyring")
+	}
+	if plaintext, err := Open(openKeys(t, path, keyring()), sealed); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("expected the reopened store to open the data, got %q %v", plaintext, err)
+	}
+}
+
+func TestFileKeyStoreImport(t *testing.T) {
+	from := openKeys(t, tempFile(t), keyring())
+	sealed, _ := Seal(from, "a", []byte("secret"))
+	exported, err := from.(Transferable).Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openKeys(t, tempFile(t), nil).(Transferable).Import(exported); err == nil {
+		t.Fatal("expected wrapped keys to need the keyring to be imported")
+	}
+	path := tempFile(t)
+	to := openKeys(t, path, keyring())
+	for want := 1; want >= 0; want-- {
+		if added, err := to.(Transferable).Import(exported); err != nil || added != want {
+			t.Fatalf("expected %v keys to be added, got %v %v", want, added, err)
+		}
+	}
+	if plaintext, err := Open(openKeys(t, path, keyring()), sealed); err != nil || string(plaintext) != "secret" {
+		t.Fatalf("expected the imported key to open the data, got %q %v", plaintext, err)
+	}
+}
+
+func TestFileKeyStoreImportForgotten(t *testing.T) {
+	from := openKeys(t, tempFile(t), nil)
+	sealed, _ := Seal(from, "a", []byte("secret"))
+	kept, _ := Seal(from, "b", []byte("other"))
+	before, _ := from.(Transferable).Export()
+
+	path := tempFile(t)
+	to := openKeys(t, path, nil)
+	if _, err := to.(Transferable).Import(before); err != nil {
+		t.Fatal(err)
+	}
+	if err := from.Forget("a"); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := from.(Transferable).Export()
+	if _, err := to.(Transferable).Import(after); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(to, sealed); err != ErrKeyDestroyed {
+		t.Fatalf("expected the forget to be carried over, got %v", err)
+	}
+
+	// keys exported before the forget, as an old backup has them, don't bring it back
+	if added, err := to.(Transferable).Import(before); err != nil || added != 0 {
+		t.Fatalf("expected no keys to be added, got %v %v", added, err)
+	}
+	reopened := openKeys(t, path, nil)
+	if _, err := Open(reopened, sealed); err != ErrKeyDestroyed {
+		t.Fatalf("expected the forgotten subject's data to stay unreadable, got %v", err)
+	}
+	if _, err := Open(reopened, kept); err != nil {
+		t.Fatal(err)
+	}
+	// the subject can be given a new key once it has been forgotten
+	if again, _ := Seal(reopened, "a", []byte("new")); again.KeyId == sealed.KeyId {
+		t.Fatal("expected the forgotten subject to get a new key")
+	}
+}
@@ -0,0 +1,135 @@
+//
+// The key store holds the data keys used to encrypt personal or sensitive fields of events.
+// Each subject (a product for example) gets its own keys, and forgetting a subject destroys
+// them. Events are never changed, but once the keys are gone the sealed fields in them can't be
+// read by anyone - the data has been crypto-shredded.
+//
+
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/efvincent/archex5/models"
+	"github.com/google/uuid"
+)
+
+// Returned when sealed data can't be opened because its subject has been forgotten
+var ErrKeyDestroyed = errors.New("The key for this data has been destroyed")
+
+type KeyStore interface {
+	// Gets the key that new data for the subject is sealed with, creating one if the subject
+	// doesn't have a key yet
+	CurrentKey(subject string) (string, []byte, error)
+
+	// Gets a key by its ID. Fails with ErrKeyDestroyed if the key's subject was forgotten
+	Key(keyId string) ([]byte, error)
+
+	// Destroys every key the subject has had
+	Forget(subject string) error
+}
+
+// A key store that keeps keys in memory, the keys are lost when the process ends
+type MemoryKeyStore struct {
+	mutex    *sync.Mutex
+	keys     map[string][]byte
+	current  map[string]string
+	subjects map[string][]string
+}
+
+func MakeMemoryKeyStore() KeyStore {
+	return MemoryKeyStore{
+		mutex:    &sync.Mutex{},
+		keys:     map[string][]byte{},
+		current:  map[string]string{},
+		subjects: map[string][]string{},
+	}
+}
+
+// Make a singleton key store available for all processes to use, see SingletonMemoryEventStore
+var SingletonMemoryKeyStore = MakeMemoryKeyStore()
+
+func (ks MemoryKeyStore) CurrentKey(subject string) (string, []byte, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if keyId, ok := ks.current[subject]; ok {
+		return keyId, ks.keys[keyId], nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	keyId := uuid.New().String()
+	ks.keys[keyId] = key
+	ks.current[subject] = keyId
+	ks.subjects[subject] = append(ks.subjects[subject], keyId)
+	return keyId, key, nil
+}
+
+func (ks MemoryKeyStore) Key(keyId string) ([]byte, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if key, ok := ks.keys[keyId]; ok {
+		return key, nil
+	}
+	return nil, ErrKeyDestroyed
+}
+
+// Forgetting a subject that has no keys isn't an error, the outcome is the same
+func (ks MemoryKeyStore) Forget(subject string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	for _, keyId := range ks.subjects[subject] {
+		delete(ks.keys, keyId)
+	}
+	delete(ks.subjects, subject)
+	delete(ks.current, subject)
+	return nil
+}
+
+// Encrypts the plaintext with the subject's current key using AES-GCM
+func Seal(ks KeyStore, subject string, plaintext []byte) (*models.Sealed, error) {
+	keyId, key, err := ks.CurrentKey(subject)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &models.Sealed{KeyId: keyId, Data: gcm.Seal(nonce, nonce, plaintext, nil)}, nil
+}
+
+// Decrypts sealed data. Fails with ErrKeyDestroyed if the data's subject has been forgotten
+func Open(ks KeyStore, s *models.Sealed) ([]byte, error) {
+	key, err := ks.Key(s.KeyId)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := makeGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Data) < gcm.NonceSize() {
+		return nil, errors.New(fmt.Sprintf("Sealed data for key %s is too short", s.KeyId))
+	}
+	nonce, ciphertext := s.Data[:gcm.NonceSize()], s.Data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func makeGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
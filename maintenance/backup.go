@@ -0,0 +1,321 @@
+//
+// Backups are gzipped NDJSON archives of the event store as of a global position (see
+// eventStore.Positioned). A full backup holds every event up to its position, an incremental
+// backup the events after the position of the backup before it. Events written while a backup
+// is being taken are after its position, so they're left for the next one, which is what makes
+// a backup consistent across streams. Envelopes are archived exactly as they're stored, encrypted
+// payloads included. Deleting a stream isn't an event, so incremental backups don't record it.
+// Every archive also holds the key store's keys as they're stored, so the sealed fields in the
+// events can be opened once they're restored - keys wrapped with the keyfile stay wrapped.
+//
+
+package maintenance
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/keystore"
+)
+
+const BACKUP_FORMAT = "archex5-backup-1"
+
+// The first line of an archive
+type BackupHeader struct {
+	Format string `json:"format"`
+	// a full backup holds every event up to Position, an incremental one those after Since
+	Full     bool  `json:"full"`
+	Since    int64 `json:"since"`
+	Position int64 `json:"position"`
+	Created  int64 `json:"created"`
+}
+
+type BackupEvent struct {
+	Namespace string                   `json:"ns"`
+	StreamId  string                   `json:"stream"`
+	Envelope  eventStore.EventEnvelope `json:"e"`
+}
+
+// The last line of an archive, so a truncated archive can be told from a complete one
+type BackupEnd struct {
+	Events int `json:"events"`
+}
+
+// Each line of an archive holds one of these
+type archiveLine struct {
+	Header *BackupHeader    `json:"header,omitempty"`
+	Keys   *keystore.KeySet `json:"keys,omitempty"`
+	Event  *BackupEvent     `json:"event,omitempty"`
+	End    *BackupEnd       `json:"end,omitempty"`
+}
+
+type RestoreReport struct {
+	Archives int   `json:"archives"`
+	Streams  int   `json:"streams"`
+	Events   int   `json:"events"`
+	Position int64 `json:"position"`
+	// keys the key store didn't have yet
+	Keys int `json:"keys"`
+}
+
+// Writes a backup of the store to w. It's incremental when previous is given, holding the events
+// written since previous was taken, otherwise it's full. Either way it holds every key in keys,
+// which is left out when keys can't be copied, as a memory key store's can't
+func Backup(store eventStore.EventStore, keys keystore.KeyStore, w io.Writer, previous *BackupHeader) (BackupHeader, error) {
+	raw := eventStore.Raw(store)
+	positioned, ok := raw.(eventStore.Positioned)
+	if !ok {
+		return BackupHeader{}, errors.New("This event store backend doesn't give events a global position, so it can't be backed up")
+	}
+	position, err := positioned.Position()
+	if err != nil {
+		return BackupHeader{}, err
+	}
+	header := BackupHeader{Format: BACKUP_FORMAT, Full: true, Position: position, Created: time.Now().UnixNano()}
+	if previous != nil {
+		if previous.Position > position {
+			return header, errors.New(fmt.Sprintf("The previous backup is at position %v, after the store's %v",
+				previous.Position, position))
+		}
+		header.Full, header.Since = false, previous.Position
+	}
+
+	included := []BackupEvent{}
+	nss, err := raw.GetNamespaces()
+	if err != nil {
+		return header, err
+	}
+	sort.Strings(nss)
+	for _, ns := range nss {
+		ids, err := raw.GetStreams(ns)
+		if err != nil {
+			return header, err
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			es, err := raw.GetEventRange(ns, id, 0, -1)
+			if err != nil {
+				return header, err
+			}
+			for _, e := range es {
+				if e.Position <= position && (header.Full || e.Position > header.Since) {
+					included = append(included, BackupEvent{ns, id, e})
+				}
+			}
+		}
+	}
+	// in the order they were written, so a restore writes them in the same order. Events from
+	// before positions were assigned stay in stream order, ahead of the rest
+	sort.SliceStable(included, func(i, j int) bool {
+		return included[i].Envelope.Position < included[j].Envelope.Position
+	})
+
+	var keySet *keystore.KeySet
+	if t, ok := keys.(keystore.Transferable); ok {
+		ks, err := t.Export()
+		if err != nil {
+			return header, err
+		}
+		keySet = &ks
+	}
+
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(archiveLine{Header: &header}); err != nil {
+		return header, err
+	}
+	if keySet != nil {
+		if err := enc.Encode(archiveLine{Keys: keySet}); err != nil {
+			return header, err
+		}
+	}
+	for i := range included {
+		if err := enc.Encode(archiveLine{Event: &included[i]}); err != nil {
+			return header, err
+		}
+	}
+	if err := enc.Encode(archiveLine{End: &BackupEnd{len(included)}}); err != nil {
+		return header, err
+	}
+	return header, gz.Close()
+}
+
+// Reads just the header of an archive, to take an incremental backup after it
+func ReadBackupHeader(r io.Reader) (BackupHeader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return BackupHeader{}, errors.New(fmt.Sprintf("Not a backup archive: %v", err))
+	}
+	var line archiveLine
+	if err := json.NewDecoder(gz).Decode(&line); err != nil || line.Header == nil {
+		return BackupHeader{}, errors.New("Not a backup archive, it doesn't start with a header")
+	}
+	if line.Header.Format != BACKUP_FORMAT {
+		return BackupHeader{}, errors.New(fmt.Sprintf("Unknown backup format %s", line.Header.Format))
+	}
+	return *line.Header, nil
+}
+
+// Reads an archive's header, events and keys, the keys are nil when the archive has none
+func readArchive(r io.Reader) (BackupHeader, []BackupEvent, *keystore.KeySet, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return BackupHeader{}, nil, nil, errors.New(fmt.Sprintf("Not a backup archive: %v", err))
+	}
+	var header *BackupHeader
+	var keys *keystore.KeySet
+	events := []BackupEvent{}
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var line archiveLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return BackupHeader{}, nil, nil, errors.New(fmt.Sprintf("Could not read the archive: %v", err))
+		}
+		switch {
+		case header == nil:
+			if line.Header == nil || line.Header.Format != BACKUP_FORMAT {
+				return BackupHeader{}, nil, nil, errors.New("Not a backup archive, it doesn't start with a header")
+			}
+			header = line.Header
+		case line.Keys != nil:
+			keys = line.Keys
+		case line.Event != nil:
+			events = append(events, *line.Event)
+		case line.End != nil:
+			if line.End.Events != len(events) {
+				return *header, nil, nil, errors.New(fmt.Sprintf("The archive should hold %v events but has %v",
+					line.End.Events, len(events)))
+			}
+			return *header, events, keys, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return BackupHeader{}, nil, nil, err
+	}
+	return BackupHeader{}, nil, nil, errors.New("The archive is incomplete, it has no end")
+}
+
+// Restores a full backup followed by any incremental backups taken after it, in order. Every
+// archive is read and checked before anything is written. Streams in the archives that the store
+// already has are only replaced when force is set. The keys of the last archive that has any are
+// added to keys before any events are written. Each archive holds every key there was when it was
+// taken, so the last one has the keys of all the events being restored. Keys destroyed since, in
+// either the archive or keys, stay destroyed (see keystore.Transferable)
+func Restore(store eventStore.EventStore, keys keystore.KeyStore, archives []io.Reader, force bool) (RestoreReport, error) {
+	report := RestoreReport{}
+	raw := eventStore.Raw(store)
+	all := []BackupEvent{}
+	var keySet *keystore.KeySet
+	for i, r := range archives {
+		header, events, archiveKeys, err := readArchive(r)
+		if err != nil {
+			return report, errors.New(fmt.Sprintf("Archive %v: %v", i+1, err))
+		}
+		switch {
+		case i == 0 && !header.Full:
+			return report, errors.New("The first archive has to be a full backup")
+		case i > 0 && header.Full:
+			return report, errors.New(fmt.Sprintf("Archive %v is a full backup, only the first can be", i+1))
+		case i > 0 && header.Since != report.Position:
+			return report, errors.New(fmt.Sprintf("Archive %v follows position %v, but the archive before it is at %v",
+				i+1, header.Since, report.Position))
+		}
+		report.Archives++
+		report.Position = header.Position
+		all = append(all, events...)
+		if archiveKeys != nil {
+			keySet = archiveKeys
+		}
+	}
+	transferable, ok := keys.(keystore.Transferable)
+	if keySet != nil && !ok {
+		return report, errors.New("The archives hold data keys, but the key store can't keep them")
+	}
+
+	// the last envelope of each stream, to check the restored streams against
+	last := map[string]eventStore.EventEnvelope{}
+	streams := []BackupEvent{}
+	for _, e := range all {
+		key := e.Namespace + "/" + e.StreamId
+		if _, seen := last[key]; !seen {
+			streams = append(streams, e)
+		}
+		last[key] = e.Envelope
+	}
+	for _, s := range streams {
+		exists, err := raw.StreamExists(s.Namespace, s.StreamId)
+		if err != nil {
+			return report, err
+		}
+		if exists && !force {
+			return report, errors.New(fmt.Sprintf("Stream %s/%s already exists, restoring would overwrite it",
+				s.Namespace, s.StreamId))
+		}
+		if exists {
+			if err := raw.DeleteStream(s.Namespace, s.StreamId); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	if keySet != nil {
+		added, err := transferable.Import(*keySet)
+		if err != nil {
+			return report, errors.New(fmt.Sprintf("Could not restore the keys: %v", err))
+		}
+		report.Keys = added
+	}
+
+	// consecutive events of the same stream are written as one batch
+	written := map[string]int64{}
+	for start := 0; start < len(all); {
+		end := start + 1
+		for end < len(all) && all[end].Namespace == all[start].Namespace && all[end].StreamId == all[start].StreamId {
+			end++
+		}
+		ns, id := all[start].Namespace, all[start].StreamId
+		batch := make([]eventStore.EventEnvelope, end-start)
+		for i := range batch {
+			batch[i] = all[start+i].Envelope
+		}
+		cMode, expected := eventStore.NEW_STREAM, int64(0)
+		if seq, ok := written[ns+"/"+id]; ok {
+			cMode, expected = eventStore.EXPECTING_SEQ_NUM, seq
+		}
+		seq, err := raw.WriteBatch(ns, id, cMode, expected, batch)
+		if err != nil {
+			return report, errors.New(fmt.Sprintf("Could not restore %s/%s: %v", ns, id, err))
+		}
+		if want := batch[len(batch)-1].SeqNum; seq != want {
+			return report, errors.New(fmt.Sprintf("%s/%s was restored up to %v, the archives have it up to %v",
+				ns, id, seq, want))
+		}
+		written[ns+"/"+id] = seq
+		report.Events += len(batch)
+		start = end
+	}
+
+	// the restored streams rebuild their hash chains, which match the archived ones only if every
+	// event was restored as it was
+	for _, s := range streams {
+		es, err := raw.GetEventRange(s.Namespace, s.StreamId, 0, -1)
+		if err != nil {
+			return report, err
+		}
+		want := last[s.Namespace+"/"+s.StreamId]
+		if len(es) == 0 || (len(want.Hash) > 0 && es[len(es)-1].Hash != want.Hash) {
+			return report, errors.New(fmt.Sprintf("%s/%s does not match the archives after restoring it",
+				s.Namespace, s.StreamId))
+		}
+		report.Streams++
+	}
+	return report, nil
+}
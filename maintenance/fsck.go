@@ -0,0 +1,215 @@
+//
+// Maintenance tools work on the event store directly rather than through the command processor.
+// The consistency checker (fsck) reads every stream and reports anything the event store should
+// never contain, independently of the store's own write logic. Identical duplicates can be
+// dropped on backends that can rewrite streams, the rest are only reported: a gap may be an event
+// that's been lost, and renumbering the events after it would hide that and break every reference
+// to them (the command log's event refs, a head check monitor's last observed event, a schedule's
+// price change).
+//
+
+package maintenance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+)
+
+// The kinds of problem fsck finds
+const (
+	FSCK_SEQ_GAP          = "seq-gap"
+	FSCK_SEQ_DUPLICATE    = "seq-duplicate"
+	FSCK_TIMESTAMP_ORDER  = "timestamp-order"
+	FSCK_UNKNOWN_TYPE     = "unknown-type"
+	FSCK_BAD_PAYLOAD      = "bad-payload"
+	FSCK_BAD_FIRST_EVENT  = "bad-first-event"
+	FSCK_UNREADABLE       = "unreadable"
+	FSCK_BROKEN_HASHCHAIN = "broken-hash-chain"
+)
+
+type Problem struct {
+	Namespace  string `json:"ns"`
+	StreamId   string `json:"streamId"`
+	SeqNum     int64  `json:"seqNum"`
+	Kind       string `json:"kind"`
+	Detail     string `json:"detail"`
+	Repairable bool   `json:"repairable"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s/%s@%v %s: %s", p.Namespace, p.StreamId, p.SeqNum, p.Kind, p.Detail)
+}
+
+type FsckOptions struct {
+	// only check this namespace, all namespaces when empty
+	Namespace string
+	// rewrite streams whose only problems are identical duplicates
+	Repair bool
+}
+
+type FsckReport struct {
+	Streams  int       `json:"streams"`
+	Events   int       `json:"events"`
+	Problems []Problem `json:"problems"`
+	Repaired []string  `json:"repaired"`
+}
+
+// The event type each kind of stream has to start with, by stream ID prefix. Product streams
+// have no prefix, see processor.ReservedStreamPrefix
+func expectedFirstEvent(streamId string) string {
+	switch {
+	case strings.HasPrefix(streamId, "$col-"):
+		return events.CollectionCreatedT
+	case strings.HasPrefix(streamId, "$"):
+		return ""
+	default:
+		return events.ProductCreatedT
+	}
+}
+
+// Checks every stream in the store. Payloads are read through the store, so they're checked
+// after decryption, everything else is checked on the envelopes as they're stored
+func Fsck(store eventStore.EventStore, opts FsckOptions) (FsckReport, error) {
+	report := FsckReport{Problems: []Problem{}, Repaired: []string{}}
+	nss := []string{opts.Namespace}
+	if len(opts.Namespace) == 0 {
+		var err error
+		if nss, err = store.GetNamespaces(); err != nil {
+			return report, err
+		}
+	}
+	sort.Strings(nss)
+
+	raw := eventStore.Raw(store)
+	rewriter, canRepair := raw.(eventStore.StreamRewriter)
+	for _, ns := range nss {
+		ids, err := store.GetStreams(ns)
+		if err != nil {
+			return report, err
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			report.Streams++
+			stored, err := raw.GetEventRange(ns, id, 0, -1)
+			if err != nil {
+				report.Problems = append(report.Problems, Problem{ns, id, -1, FSCK_UNREADABLE, err.Error(), false})
+				continue
+			}
+			report.Events += len(stored)
+			problems, repaired := checkStructure(ns, id, stored)
+			problems = append(problems, checkPayloads(store, ns, id)...)
+			report.Problems = append(report.Problems, problems...)
+
+			if opts.Repair && canRepair && len(problems) > 0 && allRepairable(problems) {
+				if err := rewriter.RewriteStream(ns, id, repaired); err != nil {
+					return report, err
+				}
+				report.Repaired = append(report.Repaired, ns+"/"+id)
+			}
+		}
+	}
+	return report, nil
+}
+
+func allTimestamps(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Kind != FSCK_TIMESTAMP_ORDER {
+			return false
+		}
+	}
+	return true
+}
+
+func allRepairable(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Repairable {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks sequence numbers, timestamps and the hash chain, and works out the repaired stream:
+// identical duplicates dropped, and the hash chain rebuilt (by the store, when it's rewritten).
+// Nothing is renumbered, the repaired stream is only written when it has no gaps
+func checkStructure(ns string, id string, stored []eventStore.EventEnvelope) ([]Problem, []eventStore.EventEnvelope) {
+	problems := []Problem{}
+	repaired := []eventStore.EventEnvelope{}
+	seen := map[int64]eventStore.EventEnvelope{}
+	// the sequence number of the last event that wasn't a copy of an earlier one
+	var last int64
+	for i, e := range stored {
+		if prev, dup := seen[e.SeqNum]; dup {
+			// an identical copy can be dropped, but when the copies differ there's no telling which
+			// one is right, so the stream is left for someone to look at
+			if prev.EventType == e.EventType && prev.Timestamp == e.Timestamp && string(prev.Data) == string(e.Data) {
+				problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_SEQ_DUPLICATE,
+					"Sequence number appears more than once, this copy is identical and would be dropped", true})
+				continue
+			}
+			problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_SEQ_DUPLICATE,
+				"Sequence number appears more than once, and this copy differs from the first", false})
+		} else {
+			if i > 0 && e.SeqNum != last+1 {
+				problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_SEQ_GAP,
+					fmt.Sprintf("Follows sequence number %v", last), false})
+			}
+			seen[e.SeqNum] = e
+			last = e.SeqNum
+		}
+		if i > 0 && e.Timestamp < stored[i-1].Timestamp {
+			problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_TIMESTAMP_ORDER,
+				fmt.Sprintf("Timestamp %v is earlier than the event before it", e.Timestamp), false})
+		}
+		repaired = append(repaired, e)
+	}
+	// a stream retention has cut starts at a snapshot
+	if len(stored) > 0 && stored[0].SeqNum != 0 && !stored[0].Snapshot {
+		problems = append(problems, Problem{ns, id, stored[0].SeqNum, FSCK_SEQ_GAP,
+			"Stream does not start at sequence number 0", false})
+	}
+
+	// the hash chain is only worth reporting when the sequence numbers don't explain the break,
+	// since gaps and duplicates break it too. Rewriting the stream rebuilds it
+	if allTimestamps(problems) {
+		if v := eventStore.VerifyStream(ns, id, stored); !v.Ok {
+			problems = append(problems, Problem{ns, id, v.BrokenAt, FSCK_BROKEN_HASHCHAIN, v.Reason, false})
+		}
+	}
+	return problems, repaired
+}
+
+// Checks that each event is of a registered type, that its payload reads as that type, and that
+// the stream starts with the right kind of event
+func checkPayloads(store eventStore.EventStore, ns string, id string) []Problem {
+	problems := []Problem{}
+	es, err := store.GetEventRange(ns, id, 0, -1)
+	if err != nil {
+		return append(problems, Problem{ns, id, -1, FSCK_UNREADABLE, err.Error(), false})
+	}
+	if first := expectedFirstEvent(id); len(es) > 0 && len(first) > 0 && !es[0].Snapshot && es[0].EventType != first {
+		problems = append(problems, Problem{ns, id, es[0].SeqNum, FSCK_BAD_FIRST_EVENT,
+			fmt.Sprintf("Stream starts with %s, expected %s", es[0].EventType, first), false})
+	}
+	for _, e := range es {
+		if len(e.KeyId) > 0 {
+			problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_UNREADABLE,
+				fmt.Sprintf("Payload is encrypted with key %s, the keyfile is needed to check it", e.KeyId), false})
+			continue
+		}
+		if !events.IsRegistered(e.EventType) {
+			problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_UNKNOWN_TYPE,
+				fmt.Sprintf("Event type %s is not registered", e.EventType), false})
+			continue
+		}
+		if _, err := events.UnmarshalEvent(e.EventType, e.Data); err != nil {
+			problems = append(problems, Problem{ns, id, e.SeqNum, FSCK_BAD_PAYLOAD,
+				fmt.Sprintf("Payload does not unmarshal as %s: %v", e.EventType, err), false})
+		}
+	}
+	return problems
+}
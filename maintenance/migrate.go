@@ -0,0 +1,290 @@
+//
+// Migration copies every stream from one event store backend to another. Envelopes are copied
+// exactly as they're stored, so encrypted payloads stay encrypted with the keys they were written
+// with, and the target builds a hash chain identical to the source's, which is how the copy is
+// verified. A migration can be run repeatedly against a live source: each pass copies only the
+// events written since the last one, so the target keeps up until writers are cut over. What the
+// source loses between passes is taken out of the target too: the events its retention policies
+// trim, and the streams an admin deletes.
+//
+
+package maintenance
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/keystore"
+)
+
+type MigrateReport struct {
+	Streams int `json:"streams"`
+	// events copied by this pass
+	Copied int `json:"copied"`
+	// events in the target's copies of the source's streams, after this pass
+	Events int `json:"events"`
+	// streams the target had that the source no longer has, or has started again, which this
+	// pass deleted from the target, and events trimmed from the target because the source's
+	// retention policies trimmed them
+	Deleted int `json:"deleted"`
+	Trimmed int `json:"trimmed"`
+}
+
+// Copies the events the target doesn't have yet from every stream in the source, and checks that
+// each stream in the target then matches the source event for event, from the first event the
+// source still has. A stream the target already has has to be a copy of the start of the source's
+// stream, anything else is an error, since it means one of them was written to by something other
+// than the migration. Streams in the target that the source doesn't have were deleted from the
+// source, and are deleted from the target; so are those whose first event isn't the source's,
+// which were deleted and started again, and are copied afresh. Namespaces deleted from the source
+// are left in the target
+func Migrate(from eventStore.EventStore, to eventStore.EventStore) (MigrateReport, error) {
+	report := MigrateReport{}
+	from, to = eventStore.Raw(from), eventStore.Raw(to)
+	nss, err := from.GetNamespaces()
+	if err != nil {
+		return report, err
+	}
+	sort.Strings(nss)
+	for _, ns := range nss {
+		if err := migrateNamespace(from, to, ns); err != nil {
+			return report, err
+		}
+		ids, err := from.GetStreams(ns)
+		if err != nil {
+			return report, err
+		}
+		sort.Strings(ids)
+		deleted, err := deleteRemovedStreams(to, ns, ids)
+		if err != nil {
+			return report, err
+		}
+		report.Deleted += deleted
+		for _, id := range ids {
+			s, err := migrateStream(from, to, ns, id)
+			if err != nil {
+				return report, err
+			}
+			report.Streams++
+			report.Copied += s.copied
+			report.Events += s.events
+			report.Trimmed += s.trimmed
+			if s.restarted {
+				report.Deleted++
+			}
+			if err := migrateMetadata(from, to, ns, id); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// Copies the keys the target key store doesn't have yet from the source key store, returning how
+// many were copied. Keys are copied before events, so the target never has sealed data it doesn't
+// have the keys for. Keys the source has destroyed are destroyed in the target, so forgetting a
+// supplier contact during a migration is carried over
+func MigrateKeys(from keystore.KeyStore, to keystore.KeyStore) (int, error) {
+	src, ok := from.(keystore.Transferable)
+	dst, ok2 := to.(keystore.Transferable)
+	if !ok || !ok2 {
+		return 0, errors.New("Keys can only be migrated between key stores that can copy their keys")
+	}
+	ks, err := src.Export()
+	if err != nil {
+		return 0, err
+	}
+	return dst.Import(ks)
+}
+
+// Creates the namespace in the target with the source's settings, or brings the settings of the
+// target's namespace up to date
+func migrateNamespace(from eventStore.EventStore, to eventStore.EventStore, ns string) error {
+	info, err := from.GetNamespaceInfo(ns)
+	if err != nil {
+		return err
+	}
+	exists, err := to.NamespaceExists(ns)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return to.CreateNamespace(ns, info.Settings)
+	}
+	current, err := to.GetNamespaceInfo(ns)
+	if err != nil || reflect.DeepEqual(current.Settings, info.Settings) {
+		return err
+	}
+	return to.SetNamespaceSettings(ns, info.Settings)
+}
+
+// Copies the metadata of a stream. The target numbers its own versions, so only the keys are
+// compared
+func migrateMetadata(from eventStore.EventStore, to eventStore.EventStore, ns string, id string) error {
+	m, err := from.GetStreamMetadata(ns, id)
+	if err != nil {
+		return err
+	}
+	current, err := to.GetStreamMetadata(ns, id)
+	if err != nil || m.SameAs(current) {
+		return err
+	}
+	_, err = to.SetStreamMetadata(ns, id, current.Version, m)
+	return err
+}
+
+// Deletes the streams the target has in the namespace that the source doesn't, returning how many
+func deleteRemovedStreams(to eventStore.EventStore, ns string, ids []string) (int, error) {
+	exists, err := to.NamespaceExists(ns)
+	if err != nil || !exists {
+		return 0, err
+	}
+	current, err := to.GetStreams(ns)
+	if err != nil {
+		return 0, err
+	}
+	kept := map[string]bool{}
+	for _, id := range ids {
+		kept[id] = true
+	}
+	deleted := 0
+	for _, id := range current {
+		if kept[id] {
+			continue
+		}
+		if err := to.DeleteStream(ns, id); err != nil {
+			return deleted, errors.New(fmt.Sprintf("Could not delete %s/%s from the target: %v", ns, id, err))
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// What migrating a stream did
+type streamMigration struct {
+	copied    int
+	events    int
+	trimmed   int
+	restarted bool
+}
+
+func migrateStream(from eventStore.EventStore, to eventStore.EventStore, ns string, id string) (streamMigration, error) {
+	m := streamMigration{}
+	src, err := from.GetEventRange(ns, id, 0, -1)
+	if err != nil {
+		return m, err
+	}
+	dst, err := targetEvents(to, ns, id)
+	if err != nil {
+		return m, err
+	}
+	if len(src) > 0 && len(dst) > 0 && src[0].SeqNum == 0 && dst[0].SeqNum == 0 && !sameEvent(src[0], dst[0]) {
+		// the stream was deleted from the source and started again
+		if err := to.DeleteStream(ns, id); err != nil {
+			return m, errors.New(fmt.Sprintf("Could not delete %s/%s from the target: %v", ns, id, err))
+		}
+		dst, m.restarted = []eventStore.EventEnvelope{}, true
+	}
+	if dst, m.trimmed, err = trimTarget(to, ns, id, src, dst); err != nil {
+		return m, err
+	}
+	// the target may keep less than the source, when its copy of a retention policy has taken
+	// effect since the source was read
+	if len(dst) > 0 {
+		for len(src) > 0 && src[0].SeqNum < dst[0].SeqNum {
+			src = src[1:]
+		}
+	}
+	if len(dst) > len(src) {
+		return m, errors.New(fmt.Sprintf("%s/%s has %v events in the target but only %v in the source",
+			ns, id, len(dst), len(src)))
+	}
+	if err := compare(ns, id, src[:len(dst)], dst); err != nil {
+		return m, err
+	}
+
+	missing := src[len(dst):]
+	if len(missing) > 0 {
+		cMode, expected := eventStore.NEW_STREAM, int64(0)
+		if len(dst) > 0 {
+			cMode, expected = eventStore.EXPECTING_SEQ_NUM, dst[len(dst)-1].SeqNum
+		}
+		if _, err := to.WriteBatch(ns, id, cMode, expected, missing); err != nil {
+			return m, errors.New(fmt.Sprintf("Could not copy %s/%s: %v", ns, id, err))
+		}
+		if dst, err = targetEvents(to, ns, id); err != nil {
+			return m, err
+		}
+		for len(src) > 0 && len(dst) > 0 && src[0].SeqNum < dst[0].SeqNum {
+			src = src[1:]
+		}
+	}
+	if len(dst) != len(src) {
+		return m, errors.New(fmt.Sprintf("%s/%s has %v events in the target after copying, expected %v",
+			ns, id, len(dst), len(src)))
+	}
+	m.copied, m.events = len(missing), len(dst)
+	return m, compare(ns, id, src, dst)
+}
+
+// Removes the events the source's retention policies have trimmed from the target's copy of a
+// stream, which then starts at the same snapshot as the source's, with the same link to the
+// events that were removed. A target that has none of the events the source still has is
+// deleted, to be copied afresh. Returns the target's events and how many were removed
+func trimTarget(to eventStore.EventStore, ns string, id string, src []eventStore.EventEnvelope,
+	dst []eventStore.EventEnvelope) ([]eventStore.EventEnvelope, int, error) {
+	if len(src) == 0 || len(dst) == 0 || dst[0].SeqNum >= src[0].SeqNum {
+		return dst, 0, nil
+	}
+	if !src[0].Snapshot {
+		return nil, 0, errors.New(fmt.Sprintf("%s/%s starts at sequence number %v in the source without a snapshot, "+
+			"fsck can tell what's wrong with it", ns, id, src[0].SeqNum))
+	}
+	from := 0
+	for from < len(dst) && dst[from].SeqNum < src[0].SeqNum {
+		from++
+	}
+	rewriter, ok := to.(eventStore.StreamRewriter)
+	if from == len(dst) || !ok {
+		if err := to.DeleteStream(ns, id); err != nil {
+			return nil, 0, errors.New(fmt.Sprintf("Could not delete %s/%s from the target: %v", ns, id, err))
+		}
+		return []eventStore.EventEnvelope{}, len(dst), nil
+	}
+	if err := rewriter.RewriteStream(ns, id, dst[from:]); err != nil {
+		return nil, 0, errors.New(fmt.Sprintf("Could not trim %s/%s in the target: %v", ns, id, err))
+	}
+	dst, err := targetEvents(to, ns, id)
+	return dst, from, err
+}
+
+func targetEvents(to eventStore.EventStore, ns string, id string) ([]eventStore.EventEnvelope, error) {
+	exists, err := to.StreamExists(ns, id)
+	if err != nil || !exists {
+		return []eventStore.EventEnvelope{}, err
+	}
+	return to.GetEventRange(ns, id, 0, -1)
+}
+
+// Checks that the target's events are the source's. Events the source stored without a hash,
+// from before the stream was chained, are compared on their content instead
+func compare(ns string, id string, src []eventStore.EventEnvelope, dst []eventStore.EventEnvelope) error {
+	for i := range dst {
+		if !sameEvent(src[i], dst[i]) {
+			return errors.New(fmt.Sprintf("%s/%s@%v in the target does not match the source, "+
+				"if verify finds the source's hash chain is broken it has to be repaired first", ns, id, src[i].SeqNum))
+		}
+	}
+	return nil
+}
+
+func sameEvent(s eventStore.EventEnvelope, d eventStore.EventEnvelope) bool {
+	if len(s.Hash) == 0 {
+		return s.SeqNum == d.SeqNum && s.Timestamp == d.Timestamp && s.EventType == d.EventType &&
+			s.KeyId == d.KeyId && string(s.Data) == string(d.Data)
+	}
+	return s.SeqNum == d.SeqNum && s.Hash == d.Hash
+}
@@ -0,0 +1,252 @@
+//
+// Streams are moved between environments as NDJSON, one event per line with the namespace,
+// stream ID and sequence number it belongs to. Events are exported as the command processor
+// reads them, so an encrypted store exports plaintext and the importing store encrypts them
+// again with its own keys. Hashes aren't exported, the importing store builds its own chain, and
+// neither are retention policies or stream metadata.
+//
+// Fields sealed with the key store (supplier contacts) stay sealed in the exported events. The
+// keys that open them are exported on a line of their own ahead of the events, as the key store
+// keeps them, so keys wrapped with the keyfile stay wrapped and the importing environment needs
+// the same keyfile. A key store that can't copy its keys exports none, and the sealed fields can't
+// be opened where the streams are imported.
+//
+
+package maintenance
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/keystore"
+)
+
+// One line of an export
+type Record struct {
+	Namespace string          `json:"ns"`
+	StreamId  string          `json:"stream"`
+	SeqNum    int64           `json:"seq"`
+	Timestamp int64           `json:"ts"`
+	EventType string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	// set on snapshots, a stream retention has cut starts with one
+	Snapshot bool `json:"snapshot,omitempty"`
+	// who sent the command the event was written for, when the API knew
+	Actor string `json:"actor,omitempty"`
+	// set on the line that holds the keys the events' sealed fields are sealed with, which has
+	// nothing else
+	Keys *keystore.KeySet `json:"keys,omitempty"`
+}
+
+// The line that holds an export's keys
+type keysRecord struct {
+	Keys *keystore.KeySet `json:"keys"`
+}
+
+type ExportOptions struct {
+	// only export this namespace, all namespaces when empty
+	Namespace string
+	// only export streams whose IDs start with this
+	StreamPrefix string
+	// the key store subject that data in a stream's events is sealed for, empty when there's none.
+	// No keys are exported when it isn't set
+	Subject func(ns string, streamId string) string
+}
+
+type ImportOptions struct {
+	// only import streams whose IDs start with this
+	StreamPrefix string
+	// fail rather than append to a stream that already has events
+	RefuseNonEmpty bool
+	// refuses namespaces that can't be written to, such as reserved names, when it's set
+	CheckNamespace func(ns string) error
+}
+
+type TransferReport struct {
+	Streams int `json:"streams"`
+	Events  int `json:"events"`
+	// keys exported, or imported that the key store didn't have yet
+	Keys int `json:"keys"`
+}
+
+// Writes the events of every matching stream to w, one record per line, after a line holding the
+// keys of the streams' subjects (see ExportOptions.Subject) when keys has any. Streams are written
+// in order of namespace and stream ID, and each stream's events in sequence order
+func Export(store eventStore.EventStore, keys keystore.KeyStore, w io.Writer, opts ExportOptions) (TransferReport, error) {
+	report := TransferReport{}
+	nss := []string{opts.Namespace}
+	if len(opts.Namespace) == 0 {
+		var err error
+		if nss, err = store.GetNamespaces(); err != nil {
+			return report, err
+		}
+	}
+	sort.Strings(nss)
+
+	streams := map[string][]string{}
+	subjects := []string{}
+	for _, ns := range nss {
+		ids, err := store.GetStreams(ns)
+		if err != nil {
+			return report, err
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			if !strings.HasPrefix(id, opts.StreamPrefix) {
+				continue
+			}
+			streams[ns] = append(streams[ns], id)
+			if opts.Subject != nil {
+				if subject := opts.Subject(ns, id); len(subject) > 0 {
+					subjects = append(subjects, subject)
+				}
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if len(subjects) > 0 {
+		t, ok := keys.(keystore.Transferable)
+		if !ok {
+			log.Printf("export: The key store can't copy its keys, sealed fields are exported without them")
+		} else {
+			all, err := t.Export()
+			if err != nil {
+				return report, err
+			}
+			keySet := all.Only(subjects)
+			if len(keySet.Keys) > 0 || len(keySet.Forgotten) > 0 {
+				if err := enc.Encode(keysRecord{&keySet}); err != nil {
+					return report, err
+				}
+				report.Keys = len(keySet.Keys)
+			}
+		}
+	}
+	for _, ns := range nss {
+		for _, id := range streams[ns] {
+			es, err := store.GetEventRange(ns, id, 0, -1)
+			if err != nil {
+				return report, err
+			}
+			for _, e := range es {
+				r := Record{ns, id, e.SeqNum, e.Timestamp, e.EventType, json.RawMessage(e.Data), e.Snapshot, e.Actor, nil}
+				if err := enc.Encode(&r); err != nil {
+					return report, errors.New(fmt.Sprintf("Could not export %s/%s@%v: %v", ns, id, e.SeqNum, err))
+				}
+				report.Events++
+			}
+			report.Streams++
+		}
+	}
+	return report, bw.Flush()
+}
+
+// Reads records from r and appends them to their streams, keeping their timestamps and types.
+// Each stream's records have to be together and in sequence, as Export writes them, and are
+// written as one batch. The store numbers the events, so an exported stream keeps its sequence
+// numbers when it's imported as a new stream, and follows on from the last event when it's
+// appended to one that already has events. Retention policies aren't exported or imported. Keys
+// are added to keys as soon as they're read, which is before the events they seal
+func Import(store eventStore.EventStore, keys keystore.KeyStore, r io.Reader, opts ImportOptions) (TransferReport, error) {
+	report := TransferReport{}
+	done := map[string]bool{}
+	var batch []eventStore.EventEnvelope
+	var current Record
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		key := current.Namespace + "/" + current.StreamId
+		if done[key] {
+			return errors.New(fmt.Sprintf("The events of %s are not together in the import", key))
+		}
+		done[key] = true
+		if opts.CheckNamespace != nil {
+			if err := opts.CheckNamespace(current.Namespace); err != nil {
+				return errors.New(fmt.Sprintf("Could not import %s: %v", key, err))
+			}
+		}
+		exists, err := store.StreamExists(current.Namespace, current.StreamId)
+		if err != nil {
+			return err
+		}
+		if exists && opts.RefuseNonEmpty {
+			return errors.New(fmt.Sprintf("Stream %s already has events", key))
+		}
+		cMode := eventStore.ANY
+		if !exists || opts.RefuseNonEmpty {
+			cMode = eventStore.NEW_STREAM
+		}
+		if _, err := store.WriteBatch(current.Namespace, current.StreamId, cMode, 0, batch); err != nil {
+			return errors.New(fmt.Sprintf("Could not import %s: %v", key, err))
+		}
+		report.Streams++
+		report.Events += len(batch)
+		batch = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return report, errors.New(fmt.Sprintf("Could not read line %v: %v", line, err))
+		}
+		if rec.Keys != nil {
+			t, ok := keys.(keystore.Transferable)
+			if !ok {
+				return report, errors.New("The import holds data keys, but the key store can't keep them")
+			}
+			added, err := t.Import(*rec.Keys)
+			if err != nil {
+				return report, errors.New(fmt.Sprintf("Could not import the keys on line %v: %v", line, err))
+			}
+			report.Keys += added
+			continue
+		}
+		if len(rec.Namespace) == 0 || len(rec.StreamId) == 0 || len(rec.EventType) == 0 {
+			return report, errors.New(fmt.Sprintf("Line %v needs ns, stream and type", line))
+		}
+		if !strings.HasPrefix(rec.StreamId, opts.StreamPrefix) {
+			continue
+		}
+		if len(batch) > 0 && (rec.Namespace != current.Namespace || rec.StreamId != current.StreamId) {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+		if len(batch) > 0 && rec.SeqNum != current.SeqNum+1 {
+			return report, errors.New(fmt.Sprintf("Line %v: %s/%s@%v does not follow sequence number %v",
+				line, rec.Namespace, rec.StreamId, rec.SeqNum, current.SeqNum))
+		}
+		current = rec
+		batch = append(batch, eventStore.EventEnvelope{
+			SeqNum:    rec.SeqNum,
+			Timestamp: rec.Timestamp,
+			EventType: rec.EventType,
+			Data:      []byte(rec.Data),
+			Snapshot:  rec.Snapshot,
+			Actor:     rec.Actor,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+	return report, flush()
+}
@@ -0,0 +1,22 @@
+package models
+
+// A merchandising collection - an ordered group of products within a namespace, optionally
+// featuring one of its members as the hero product
+type CollectionModel struct {
+	Namespace    string   `json:"ns" binding:"required"`
+	SequenceNum  int64    `json:"sequenceNum" binding:"required"`
+	CollectionId string   `json:"collectionId" binding:"required"`
+	Name         string   `json:"name"`
+	SKUs         []string `json:"skus"`
+	HeroSKU      string   `json:"heroSku"`
+}
+
+// Returns the position of the SKU in the collection, or -1 if it is not a member
+func (c *CollectionModel) IndexOf(sku string) int {
+	for i, s := range c.SKUs {
+		if s == sku {
+			return i
+		}
+	}
+	return -1
+}
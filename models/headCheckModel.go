@@ -0,0 +1,16 @@
+package models
+
+// The result of checking that one of a product's URLs (the product page or an image) can be
+// reached. Status is 0 if no response was received, in which case Error says why
+type UrlCheck struct {
+	Url       string `json:"url"`
+	Method    string `json:"method"`
+	Status    int    `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// A URL passes the check if it responded with a success or redirect status
+func (c UrlCheck) Ok() bool {
+	return len(c.Error) == 0 && c.Status >= 200 && c.Status < 400
+}
@@ -0,0 +1,20 @@
+package models
+
+// What the head check monitor decided to do after observing a head check
+const (
+	HEADCHECK_MONITOR_DEACTIVATE = "deactivate"
+	HEADCHECK_MONITOR_REACTIVATE = "reactivate"
+)
+
+// The state the head check monitor keeps for one product. LastObserved is the sequence number
+// of the last HeadCheckPerformed event in the product's stream the monitor has dealt with, so
+// events are never counted twice
+type HeadCheckMonitorModel struct {
+	Namespace           string `json:"ns"`
+	SequenceNum         int64  `json:"sequenceNum"`
+	SKU                 string `json:"sku"`
+	LastObserved        int64  `json:"lastObserved"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	AutoDeactivated     bool   `json:"autoDeactivated"`
+	LastCausationId     string `json:"lastCausationId,omitempty"`
+}
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// Prices were originally float32s, which can't represent most decimal amounts exactly (129.99
+// is stored as 129.990005...) and don't say what currency they're in. Money holds an amount in
+// the minor units of an ISO-4217 currency, so $129.99 is {Amount: 12999, Currency: "USD"}
+type Money struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// The currency assumed for prices that were recorded before prices carried a currency
+const DefaultCurrency = "USD"
+
+// ISO-4217 currencies we accept, mapped to the number of digits in their minor unit
+var currencyExponents = map[string]int{
+	"AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CNY": 2, "DKK": 2, "EUR": 2,
+	"GBP": 2, "HKD": 2, "INR": 2, "JPY": 0, "KRW": 0, "KWD": 3, "MXN": 2, "NOK": 2,
+	"NZD": 2, "PLN": 2, "SEK": 2, "SGD": 2, "USD": 2, "ZAR": 2,
+}
+
+// Reports whether the currency code is a supported ISO-4217 currency
+func IsCurrency(currency string) bool {
+	_, ok := currencyExponents[currency]
+	return ok
+}
+
+// Gets the supported currency codes, sorted
+func Currencies() []string {
+	cs := make([]string, 0, len(currencyExponents))
+	for c := range currencyExponents {
+		cs = append(cs, c)
+	}
+	sort.Strings(cs)
+	return cs
+}
+
+// Parses a decimal amount such as "129.99" in the given currency. The conversion is exact,
+// amounts with more decimal places than the currency's minor unit are rejected rather than rounded
+func ParseMoney(amount string, currency string) (Money, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, errors.New(fmt.Sprintf("Unknown currency '%s'", currency))
+	}
+
+	s := strings.TrimSpace(amount)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	whole, frac := s, ""
+	if i := strings.Index(s, "."); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	// trailing zeros don't add precision, "129.990" is a fine way to write 129.99
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		return Money{}, errors.New(fmt.Sprintf("Amount %s has more precision than %s allows", amount, currency))
+	}
+	if len(whole) == 0 {
+		whole = "0"
+	}
+	digits := whole + frac + strings.Repeat("0", exp-len(frac))
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return Money{}, errors.New(fmt.Sprintf("Invalid amount '%s'", amount))
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Money{}, errors.New(fmt.Sprintf("Invalid amount '%s'", amount))
+	}
+	if neg {
+		n = -n
+	}
+	return Money{Amount: n, Currency: currency}, nil
+}
+
+// Converts a legacy float32 price to money. float32s are formatted with the fewest digits
+// that round trip, so a price entered as 129.99 converts to exactly 12999 cents. Legacy prices
+// were never held to the currency's minor unit, so one with more decimal places than that is
+// rounded to it, half away from zero, rather than rejected: 129.995 converts to 13000 cents
+func MoneyFromFloat32(f float32, currency string) (Money, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return Money{}, errors.New(fmt.Sprintf("Unknown currency '%s'", currency))
+	}
+	s := strconv.FormatFloat(float64(f), 'f', -1, 32)
+	i := strings.Index(s, ".")
+	if i < 0 || len(s)-i-1 <= exp {
+		return ParseMoney(s, currency)
+	}
+	roundUp := s[i+1+exp] >= '5'
+	m, err := ParseMoney(s[:i+1+exp], currency)
+	if err != nil || !roundUp {
+		return m, err
+	}
+	if strings.HasPrefix(s, "-") {
+		m.Amount--
+	} else {
+		m.Amount++
+	}
+	return m, nil
+}
+
+// Formats the amount as a decimal in the currency's major unit, for example "129.99"
+func (m Money) Decimal() string {
+	exp := currencyExponents[m.Currency]
+	n := m.Amount
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	s := strconv.FormatInt(n, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+func (m Money) String() string {
+	return fmt.Sprintf("%s %s", m.Decimal(), m.Currency)
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// Money is validatable, so ozzo-validation checks money fields whenever it validates a struct
+// that holds them. Whether zero is an acceptable amount is up to the command being validated
+func (m Money) Validate() error {
+	currencies := []interface{}{}
+	for _, c := range Currencies() {
+		currencies = append(currencies, c)
+	}
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Amount, validation.Min(0)),
+		validation.Field(&m.Currency, validation.Required, validation.In(currencies...)),
+	)
+}
+
+// Money is normally written as {"amount": 12999, "currency": "USD"}, but a string such as
+// "129.99 USD" is also accepted, as is a bare number. Bare numbers are how prices were written
+// before they carried a currency, so events and commands from that time still read correctly.
+// The number is read from its JSON text rather than as a float so no precision is lost.
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	switch {
+	case s == "null":
+		return nil
+	case strings.HasPrefix(s, "{"):
+		// the alias type doesn't have this method, which avoids recursing into it
+		type money Money
+		var v money
+		if err := json.Unmarshal(b, &v); err != nil {
+			return err
+		}
+		*m = Money(v)
+		return nil
+	case strings.HasPrefix(s, "\""):
+		var str string
+		if err := json.Unmarshal(b, &str); err != nil {
+			return err
+		}
+		parts := strings.Fields(str)
+		if len(parts) != 2 {
+			return errors.New(fmt.Sprintf("Invalid money '%s', expected an amount and a currency", str))
+		}
+		v, err := ParseMoney(parts[0], strings.ToUpper(parts[1]))
+		if err != nil {
+			return err
+		}
+		*m = v
+		return nil
+	default:
+		v, err := ParseMoney(s, DefaultCurrency)
+		if err != nil {
+			return err
+		}
+		*m = v
+		return nil
+	}
+}
@@ -1,24 +1,99 @@
 package models
 
+// The states of a price change request. Requests that look reasonable are applied straight
+// away, others are held as pending until they're approved (and applied) or rejected
+const (
+	PRICE_CHANGE_REQUESTED = "requested"
+	PRICE_CHANGE_PENDING   = "pending"
+	PRICE_CHANGE_APPROVED  = "approved"
+	PRICE_CHANGE_APPLIED   = "applied"
+	PRICE_CHANGE_REJECTED  = "rejected"
+)
+
 type PriceChange struct {
-	RequestedPrice float32 `json:"requestedPrice"`
-	Timestamp      int64   `json:"ts"`
+	RequestId      string `json:"requestId,omitempty"`
+	RequestedPrice Money  `json:"requestedPrice"`
+	Timestamp      int64  `json:"ts"`
+	Status         string `json:"status,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+}
+
+// A price change request that is waiting for approval, along with the product's current price
+type PendingPriceChange struct {
+	Namespace    string      `json:"ns"`
+	SKU          string      `json:"sku"`
+	CurrentPrice Money       `json:"currentPrice"`
+	Request      PriceChange `json:"request"`
 }
+
+// A sellable variation of a product, for example a particular size and colour of a shoe. Variants
+// live within the product's stream, so they share the product's history and sequence numbers
+type VariantModel struct {
+	VariantSKU    string   `json:"variantSku" binding:"required"`
+	Size          string   `json:"size"`
+	Color         string   `json:"color"`
+	PriceOverride *Money   `json:"priceOverride,omitempty"`
+	Images        []string `json:"images"`
+	IsActive      bool     `json:"is_active"`
+	IsRetired     bool     `json:"is_retired"`
+}
+
 type ProductModel struct {
-	Namespace           string        `json:"ns" binding:"required"`
-	SequenceNum         int64         `json:"sequenceNum" binding:"required"`
-	SKU                 string        `json:"sku" binding:"required"`
-	Title               string        `json:"title"`
-	Description         string        `json:"description"`
-	Images              []string      `json:"images"`
-	PrimaryImgIdx       int           `json:"primaryImgIdx"`
-	Url                 string        `json:"url"`
-	IsContraband        bool          `json:"is_contraband"`
-	IsActive            bool          `json:"is_active"`
-	HeadCheckOk         bool          `json:"headCheckOK"`
-	LastHeadCheck       int64         `json:"lastHeadCheck"`
-	Price               float32       `json:"price"`
-	PriceChangeRequests []PriceChange `json:"priceChanges"`
+	Namespace           string            `json:"ns" binding:"required"`
+	SequenceNum         int64             `json:"sequenceNum" binding:"required"`
+	SKU                 string            `json:"sku" binding:"required"`
+	Title               string            `json:"title"`
+	Description         string            `json:"description"`
+	Images              []string          `json:"images"`
+	PrimaryImgIdx       int               `json:"primaryImgIdx"`
+	Url                 string            `json:"url"`
+	IsContraband        bool              `json:"is_contraband"`
+	IsActive            bool              `json:"is_active"`
+	IsDeleted           bool              `json:"is_deleted"`
+	HeadCheckOk         bool              `json:"headCheckOK"`
+	LastHeadCheck       int64             `json:"lastHeadCheck"`
+	Price               Money             `json:"price"`
+	PriceList           map[string]Money  `json:"priceList"`
+	PriceChangeRequests []PriceChange     `json:"priceChanges"`
+	Variants            []VariantModel    `json:"variants"`
+	Schedules           []ScheduledChange `json:"schedules"`
+	Supplier            *SupplierContact  `json:"supplier,omitempty"`
+	// the supplier contact as it was sealed in the product's events, the command processor
+	// opens it into Supplier when it reads the product
+	SealedSupplier *Sealed `json:"-"`
+}
+
+// Returns the index of the price change request with the given ID, or -1 if there is no
+// such request
+func (p *ProductModel) PriceChangeIndex(requestId string) int {
+	for i, pc := range p.PriceChangeRequests {
+		if pc.RequestId == requestId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the scheduled change with the given ID, or -1 if there is no such
+// scheduled change
+func (p *ProductModel) ScheduleIndex(scheduleId string) int {
+	for i, s := range p.Schedules {
+		if s.ScheduleId == scheduleId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the index of the variant with the given variant SKU, or -1 if the product
+// has no such variant
+func (p *ProductModel) VariantIndex(variantSku string) int {
+	for i, v := range p.Variants {
+		if v.VariantSKU == variantSku {
+			return i
+		}
+	}
+	return -1
 }
 
 var SampleProduct = ProductModel{
@@ -0,0 +1,51 @@
+package models
+
+// The kinds of change that can be scheduled
+const (
+	SCHEDULE_PRICE  = "price"
+	SCHEDULE_ACTIVE = "active"
+)
+
+// The states of a scheduled change. A change with an end time (a sale for example) is started
+// when it's applied, and completed when the change is reverted at the end time
+const (
+	SCHEDULE_PENDING   = "pending"
+	SCHEDULE_STARTED   = "started"
+	SCHEDULE_COMPLETED = "completed"
+	SCHEDULE_CANCELLED = "cancelled"
+	SCHEDULE_FAILED    = "failed"
+)
+
+// A change to a product that will be made at a future time. Times are unix nanoseconds,
+// like event timestamps
+type ScheduledChange struct {
+	ScheduleId  string `json:"scheduleId"`
+	Kind        string `json:"kind"`
+	Price       *Money `json:"price,omitempty"`
+	Active      *bool  `json:"active,omitempty"`
+	At          int64  `json:"at"`
+	Until       int64  `json:"until,omitempty"`
+	RevertPrice *Money `json:"revertPrice,omitempty"`
+	// the request ID of the price change a started sale makes, and whether that request is in
+	// the product's stream yet. Sales started before it was recorded have no ID
+	PriceChangeId  string `json:"priceChangeId,omitempty"`
+	PriceRequested bool   `json:"priceRequested,omitempty"`
+	Status         string `json:"status"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Gets the time the scheduled change next needs to be acted on, or 0 if it's finished
+func (s ScheduledChange) DueAt() int64 {
+	switch s.Status {
+	case SCHEDULE_PENDING:
+		return s.At
+	case SCHEDULE_STARTED:
+		// a sale whose price change didn't get made after it was started is due again straight
+		// away, to make it
+		if len(s.PriceChangeId) > 0 && !s.PriceRequested {
+			return s.At
+		}
+		return s.Until
+	}
+	return 0
+}
@@ -0,0 +1,18 @@
+package models
+
+// Contact details for a product's supplier. These are personal data, so they're sealed (see
+// the keystore package) whenever they're written to an event. When the product's keys have been
+// destroyed the details can no longer be read, and the product shows them as redacted
+type SupplierContact struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// Data encrypted with a key from the key store. KeyId identifies the key, Data is the nonce
+// followed by the ciphertext
+type Sealed struct {
+	KeyId string `json:"keyId"`
+	Data  []byte `json:"data"`
+}
@@ -0,0 +1,243 @@
+//
+// Process managers react to events by issuing commands, coordinating work that spans more than
+// one command. The head check monitor watches head checks: after enough consecutive failures it
+// deactivates the product, and if it was the one that deactivated it, it reactivates the product
+// after the next successful head check. Its state is event sourced like everything else, and the
+// commands it issues carry causation IDs that point back at the head check that caused them.
+//
+
+package processManager
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	"github.com/efvincent/archex5/processor"
+	"github.com/google/uuid"
+)
+
+const DefaultFailureThreshold = 3
+
+// A head check the monitor has been told about but hasn't dealt with yet
+type observation struct {
+	ns      string
+	sku     string
+	seqNum  int64
+	success bool
+}
+
+type HeadCheckMonitor struct {
+	cp        *processor.CmdProc
+	threshold int
+	queue     chan observation
+	// set when a head check couldn't be queued, the monitor then catches up from the event store
+	behind *int32
+}
+
+// Makes a monitor that deactivates a product after threshold consecutive failed head checks
+func MakeHeadCheckMonitor(cp *processor.CmdProc, threshold int) *HeadCheckMonitor {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &HeadCheckMonitor{cp: cp, threshold: threshold, queue: make(chan observation, 1024), behind: new(int32)}
+}
+
+// Starts watching head checks in the background. Head checks that were written while the monitor
+// wasn't running are caught up on first. The listener is added before catching up so nothing is
+// missed, head checks that turn up twice are recognised by their sequence number and skipped
+func (m *HeadCheckMonitor) Start() error {
+	m.cp.AddListener(m.onEvents)
+	backlog, err := m.catchUp()
+	if err != nil {
+		return err
+	}
+	log.Printf("headcheck monitor: Started with %v head checks to catch up on", len(backlog))
+
+	go func() {
+		for _, o := range backlog {
+			m.handle(o)
+		}
+		for o := range m.queue {
+			// head checks that were dropped because the queue was full come before the ones
+			// still queued behind them, so they're caught up on before anything else is handled
+			if atomic.CompareAndSwapInt32(m.behind, 1, 0) {
+				m.catchUpNow()
+			}
+			m.handle(o)
+		}
+	}()
+	return nil
+}
+
+func (m *HeadCheckMonitor) catchUpNow() {
+	backlog, err := m.catchUp()
+	if err != nil {
+		log.Printf("headcheck monitor: Could not catch up on head checks: %v", err)
+		atomic.StoreInt32(m.behind, 1)
+		return
+	}
+	log.Printf("headcheck monitor: Catching up on %v head checks", len(backlog))
+	for _, o := range backlog {
+		m.handle(o)
+	}
+}
+
+// Reports whether the monitor is waiting on a head check of the product to decide whether to
+// reactivate it, see HeadCheckWorker.AlsoCheck
+func (m *HeadCheckMonitor) WantsHeadCheck(p *models.ProductModel) bool {
+	state, err := m.cp.GetHeadCheckMonitor(p.Namespace, p.SKU)
+	return err == nil && state.AutoDeactivated
+}
+
+// Called on the goroutine that wrote the events, so the observations are only queued here. When
+// the queue is full the observation is dropped rather than holding up the writer, and the monitor
+// finds it in the event store instead
+func (m *HeadCheckMonitor) onEvents(ns string, streamId string, es []eventStore.EventEnvelope) {
+	if !processor.IsProductStream(streamId) {
+		return
+	}
+	for _, e := range es {
+		if o, ok := toObservation(ns, streamId, e); ok {
+			select {
+			case m.queue <- o:
+			default:
+				atomic.StoreInt32(m.behind, 1)
+			}
+		}
+	}
+}
+
+func toObservation(ns string, sku string, e eventStore.EventEnvelope) (observation, bool) {
+	if e.EventType != events.HeadCheckPerformedT {
+		return observation{}, false
+	}
+	var hcp events.HeadCheckPerformed
+	if err := json.Unmarshal(e.Data, &hcp); err != nil {
+		log.Printf("headcheck monitor: Could not unmarshal HeadCheckPerformed event %s",
+			events.EventRef(ns, sku, e.SeqNum))
+		return observation{}, false
+	}
+	return observation{ns, sku, e.SeqNum, hcp.Success}, true
+}
+
+// Finds the head checks in every product stream after the last one the monitor observed.
+// Namespaces and products that can't be read are logged and skipped
+func (m *HeadCheckMonitor) catchUp() ([]observation, error) {
+	nss, err := m.cp.GetNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	backlog := []observation{}
+	for _, ns := range nss {
+		skus, err := m.cp.GetSkus(ns)
+		if err != nil {
+			log.Printf("headcheck monitor: Could not list the products in %s: %v", ns, err)
+			continue
+		}
+		for _, sku := range skus {
+			state, err := m.cp.GetHeadCheckMonitor(ns, sku)
+			if err != nil {
+				log.Printf("headcheck monitor: Could not read state for %s in %s: %v", sku, ns, err)
+				continue
+			}
+			es, err := m.cp.GetProductEvents(ns, sku, state.LastObserved+1)
+			if err != nil {
+				log.Printf("headcheck monitor: Could not read %s in %s: %v", sku, ns, err)
+				continue
+			}
+			for _, e := range es {
+				if o, ok := toObservation(ns, sku, e); ok {
+					backlog = append(backlog, o)
+				}
+			}
+		}
+	}
+	return backlog, nil
+}
+
+func (m *HeadCheckMonitor) productCmd(o observation) commands.ProductCmd {
+	return commands.ProductCmd{
+		Namespace:   o.ns,
+		Timestamp:   int(time.Now().Unix()),
+		UID:         uuid.New().String(),
+		SKU:         o.sku,
+		CausationId: events.EventRef(o.ns, o.sku, o.seqNum),
+	}
+}
+
+// Decides what to do about a head check, then records the observation and decision and issues
+// the command that carries it out. Each step is ordered so that a failure part way through is put
+// right by a later head check:
+//
+//   - A deactivation is recorded before the product is deactivated, so the monitor always knows
+//     it deactivated the products it did, and reactivates them. If deactivating fails the product
+//     is still active, so the next failed head check decides to deactivate it again.
+//   - A reactivation is carried out before it's recorded, since recording it ends the monitor's
+//     claim on the product. If recording fails the next passing head check clears the claim.
+//
+// If recording fails the head check is observed again when the monitor next catches up
+func (m *HeadCheckMonitor) handle(o observation) {
+	state, err := m.cp.GetHeadCheckMonitor(o.ns, o.sku)
+	if err != nil {
+		log.Printf("headcheck monitor: Could not read state for %s in %s: %v", o.sku, o.ns, err)
+		return
+	}
+	if o.seqNum <= state.LastObserved {
+		return
+	}
+	product, err := m.cp.GetProduct(o.ns, o.sku)
+	if err != nil {
+		log.Printf("headcheck monitor: Could not read %s in %s: %v", o.sku, o.ns, err)
+		return
+	}
+
+	record := &commands.RecordHeadCheckObservedCmd{
+		ProductCmd:      m.productCmd(o),
+		HeadCheckSeqNum: o.seqNum,
+		Success:         o.success,
+	}
+	failures := state.ConsecutiveFailures + 1
+	switch {
+	case !o.success && failures >= m.threshold && product.IsActive:
+		record.Decision = models.HEADCHECK_MONITOR_DEACTIVATE
+		record.Reason = fmt.Sprintf("%v consecutive failed head checks", failures)
+	case o.success && state.AutoDeactivated && !product.IsActive:
+		record.Decision = models.HEADCHECK_MONITOR_REACTIVATE
+		record.Reason = "head check passed"
+	}
+
+	if record.Decision == models.HEADCHECK_MONITOR_REACTIVATE && !m.setActive(o, record) {
+		// leave the head check unobserved, it's retried when the monitor next catches up
+		return
+	}
+	if err := m.cp.ProcessProductCommand(record); err != nil {
+		log.Printf("headcheck monitor: Could not record head check %s: %v", record.CausationId, err)
+		return
+	}
+	if record.Decision == models.HEADCHECK_MONITOR_DEACTIVATE {
+		m.setActive(o, record)
+	}
+}
+
+// Carries out a decision to deactivate or reactivate a product, reporting whether it was
+func (m *HeadCheckMonitor) setActive(o observation, record *commands.RecordHeadCheckObservedCmd) bool {
+	cmd := &commands.SetActiveCmd{
+		ProductCmd: m.productCmd(o),
+		Active:     record.Decision == models.HEADCHECK_MONITOR_REACTIVATE,
+		Reason:     record.Reason,
+	}
+	if err := m.cp.ProcessProductCommand(cmd); err != nil {
+		log.Printf("headcheck monitor: Could not %s %s in %s: %v", record.Decision, o.sku, o.ns, err)
+		return false
+	}
+	log.Printf("headcheck monitor: Decided to %s %s in %s because of %s: %s",
+		record.Decision, o.sku, o.ns, record.CausationId, record.Reason)
+	return true
+}
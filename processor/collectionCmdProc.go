@@ -0,0 +1,288 @@
+//
+// Collections are an aggregate of their own, stored alongside the products in a namespace under
+// a reserved stream ID so they never show up as SKUs. Membership is validated against the
+// product streams in the namespace when products are added.
+//
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+const collectionStreamPrefix = ReservedStreamPrefix + "col-"
+
+// Maps a collection ID to the ID of the stream that holds the collection's events
+func collectionStreamId(collectionId string) string {
+	return collectionStreamPrefix + collectionId
+}
+
+// Gets a collection aggregate from the event store by folding over its events, see GetProduct
+func (cp CmdProc) GetCollection(ns string, collectionId string) (*models.CollectionModel, error) {
+	es, err := cp.es.GetEventRange(ns, collectionStreamId(collectionId), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(es) == 0 {
+		return nil, errors.New(fmt.Sprintf("No such collection %s on %s", collectionId, ns))
+	}
+	return CollectionReducer(&models.CollectionModel{}, es)
+}
+
+// Gets all the collections in a namespace
+func (cp CmdProc) GetCollections(ns string) ([]*models.CollectionModel, error) {
+	streamIds, err := cp.es.GetStreams(ns)
+	if err != nil {
+		return nil, err
+	}
+	cols := []*models.CollectionModel{}
+	for _, id := range streamIds {
+		if !strings.HasPrefix(id, collectionStreamPrefix) {
+			continue
+		}
+		c, err := cp.GetCollection(ns, strings.TrimPrefix(id, collectionStreamPrefix))
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	sort.Slice(cols, func(i, j int) bool { return cols[i].CollectionId < cols[j].CollectionId })
+	return cols, nil
+}
+
+// Products can only be added to a collection if they exist in the collection's namespace
+func (cp CmdProc) validateMember(ns string, sku string) error {
+	if !IsProductStream(sku) {
+		return errors.New(fmt.Sprintf("Invalid SKU %s", sku))
+	}
+	ok, err := cp.es.StreamExists(ns, sku)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New(fmt.Sprintf("No such SKU %s on %s", sku, ns))
+	}
+	deleted, err := cp.isDeleted(ns, sku)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return errors.New(fmt.Sprintf("SKU %s on %s has been deleted", sku, ns))
+	}
+	return nil
+}
+
+func (cp CmdProc) createCollection(cmd *commands.CreateCollectionCmd) error {
+	if err := validation.ValidateStruct(cmd,
+		validation.Field(&cmd.Namespace, validation.Required),
+		validation.Field(&cmd.CollectionId, validation.Required),
+		validation.Field(&cmd.Name, validation.Required),
+	); err != nil {
+		return err
+	}
+
+	e := events.CollectionCreated{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		Name:         cmd.Name,
+	}
+	_, err := cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.NEW_STREAM, 0,
+		events.CollectionCreatedT, &e)
+	return err
+}
+
+func (cp CmdProc) renameCollection(cmd *commands.RenameCollectionCmd) error {
+	col, err := cp.GetCollection(cmd.Namespace, cmd.CollectionId)
+	if err != nil {
+		return err
+	}
+	if len(cmd.Name) == 0 {
+		return errors.New(fmt.Sprintf("Collection %s in %s cannot have an empty name", cmd.CollectionId, cmd.Namespace))
+	}
+
+	e := events.CollectionRenamed{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		Name:         cmd.Name,
+	}
+	_, err = cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.EXPECTING_SEQ_NUM,
+		col.SequenceNum, events.CollectionRenamedT, &e)
+	return err
+}
+
+func (cp CmdProc) addCollectionProduct(cmd *commands.AddCollectionProductCmd) error {
+	col, err := cp.GetCollection(cmd.Namespace, cmd.CollectionId)
+	if err != nil {
+		return err
+	}
+	if err := cp.validateMember(cmd.Namespace, cmd.SKU); err != nil {
+		return err
+	}
+	if col.IndexOf(cmd.SKU) >= 0 {
+		return errors.New(fmt.Sprintf("SKU %s is already in collection %s in %s", cmd.SKU, cmd.CollectionId, cmd.Namespace))
+	}
+
+	e := events.CollectionProductAdded{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		SKU:          cmd.SKU,
+	}
+	_, err = cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.EXPECTING_SEQ_NUM,
+		col.SequenceNum, events.CollectionProductAddedT, &e)
+	return err
+}
+
+func (cp CmdProc) removeCollectionProduct(cmd *commands.RemoveCollectionProductCmd) error {
+	col, err := cp.GetCollection(cmd.Namespace, cmd.CollectionId)
+	if err != nil {
+		return err
+	}
+	if col.IndexOf(cmd.SKU) < 0 {
+		return errors.New(fmt.Sprintf("SKU %s is not in collection %s in %s", cmd.SKU, cmd.CollectionId, cmd.Namespace))
+	}
+
+	e := events.CollectionProductRemoved{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		SKU:          cmd.SKU,
+	}
+	_, err = cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.EXPECTING_SEQ_NUM,
+		col.SequenceNum, events.CollectionProductRemovedT, &e)
+	return err
+}
+
+func (cp CmdProc) reorderCollection(cmd *commands.ReorderCollectionCmd) error {
+	col, err := cp.GetCollection(cmd.Namespace, cmd.CollectionId)
+	if err != nil {
+		return err
+	}
+
+	// a reorder can't be used to sneak members in or out of the collection, the new order
+	// has to be a permutation of the current members
+	if len(cmd.SKUs) != len(col.SKUs) {
+		return errors.New(fmt.Sprintf("Reorder of collection %s in %s must list all %v members",
+			cmd.CollectionId, cmd.Namespace, len(col.SKUs)))
+	}
+	seen := map[string]bool{}
+	for _, sku := range cmd.SKUs {
+		if col.IndexOf(sku) < 0 || seen[sku] {
+			return errors.New(fmt.Sprintf("Reorder of collection %s in %s must list each member exactly once",
+				cmd.CollectionId, cmd.Namespace))
+		}
+		seen[sku] = true
+	}
+
+	e := events.CollectionReordered{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		SKUs:         cmd.SKUs,
+	}
+	_, err = cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.EXPECTING_SEQ_NUM,
+		col.SequenceNum, events.CollectionReorderedT, &e)
+	return err
+}
+
+func (cp CmdProc) setCollectionHero(cmd *commands.SetCollectionHeroCmd) error {
+	col, err := cp.GetCollection(cmd.Namespace, cmd.CollectionId)
+	if err != nil {
+		return err
+	}
+	if col.IndexOf(cmd.SKU) < 0 {
+		return errors.New(fmt.Sprintf("Hero SKU %s must be a member of collection %s in %s",
+			cmd.SKU, cmd.CollectionId, cmd.Namespace))
+	}
+
+	e := events.CollectionHeroSet{
+		Namespace:    cmd.Namespace,
+		CollectionId: cmd.CollectionId,
+		SKU:          cmd.SKU,
+	}
+	_, err = cp.writeEvent(cmd.Namespace, collectionStreamId(cmd.CollectionId), eventStore.EXPECTING_SEQ_NUM,
+		col.SequenceNum, events.CollectionHeroSetT, &e)
+	return err
+}
+
+// Assembles a collection from a starting point and a series of events. Like the ProductReducer
+// this is a pure function.
+func CollectionReducer(startingModel *models.CollectionModel, es []eventStore.EventEnvelope) (*models.CollectionModel, error) {
+	cur := *startingModel
+	for _, e := range es {
+		switch e.EventType {
+		case events.CollectionCreatedT:
+			var cc events.CollectionCreated
+			if err := json.Unmarshal(e.Data, &cc); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionCreated event"))
+			}
+			cur = models.CollectionModel{
+				Namespace:    cc.Namespace,
+				CollectionId: cc.CollectionId,
+				Name:         cc.Name,
+				SKUs:         []string{},
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.CollectionRenamedT:
+			var cr events.CollectionRenamed
+			if err := json.Unmarshal(e.Data, &cr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionRenamed event"))
+			}
+			cur.Name = cr.Name
+			cur.SequenceNum = e.SeqNum
+
+		case events.CollectionProductAddedT:
+			var pa events.CollectionProductAdded
+			if err := json.Unmarshal(e.Data, &pa); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionProductAdded event"))
+			}
+			cur.SKUs = append(append([]string{}, cur.SKUs...), pa.SKU)
+			cur.SequenceNum = e.SeqNum
+
+		case events.CollectionProductRemovedT:
+			var pr events.CollectionProductRemoved
+			if err := json.Unmarshal(e.Data, &pr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionProductRemoved event"))
+			}
+			skus := []string{}
+			for _, sku := range cur.SKUs {
+				if sku != pr.SKU {
+					skus = append(skus, sku)
+				}
+			}
+			cur.SKUs = skus
+			if cur.HeroSKU == pr.SKU {
+				cur.HeroSKU = ""
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.CollectionReorderedT:
+			var cr events.CollectionReordered
+			if err := json.Unmarshal(e.Data, &cr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionReordered event"))
+			}
+			cur.SKUs = append([]string{}, cr.SKUs...)
+			cur.SequenceNum = e.SeqNum
+
+		case events.CollectionHeroSetT:
+			var hs events.CollectionHeroSet
+			if err := json.Unmarshal(e.Data, &hs); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionHeroSet event"))
+			}
+			cur.HeroSKU = hs.SKU
+			cur.SequenceNum = e.SeqNum
+
+		default:
+			return nil, errors.New(fmt.Sprintf("Invalid event type in CollectionReducer: %s", e.EventType))
+		}
+	}
+	return &cur, nil
+}
@@ -0,0 +1,225 @@
+//
+// Every command the API is sent is recorded in its namespace's command log, a reserved stream,
+// along with what became of it. Accepted commands also leave their events behind, but rejected
+// ones would otherwise leave nothing, so the log is where to look to find out what was asked of
+// the system and by whom. Commands the server issues itself aren't logged.
+//
+
+package processor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/eventStore/esErrors.go"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/keystore"
+	"github.com/efvincent/archex5/models"
+)
+
+const commandLogStreamId = ReservedStreamPrefix + "commands"
+
+// How many commands refused before they're processed are logged a second in each namespace, so a
+// client whose commands keep being refused can't fill the store with the log of them
+const refusalsLoggedPerSecond = 5
+
+// A command in the command log, with where it is in the log
+type CommandLogEntry struct {
+	events.CommandLogged
+	SeqNum int64 `json:"seq"`
+	// when it was logged, in unix nanos
+	Timestamp int64 `json:"ts"`
+}
+
+// Works out what became of a command from the error processing it returned
+func CommandOutcome(err error) string {
+	if err == nil {
+		return events.COMMAND_ACCEPTED
+	}
+	if e, ok := err.(*esErrors.ESError); ok &&
+		(e.ErrCode == esErrors.SEQ_NUM_EXPECTATION_FAILED || e.ErrCode == esErrors.STREAM_EXISTS) {
+		return events.COMMAND_CONFLICT
+	}
+	return events.COMMAND_REJECTED
+}
+
+// Supplier contacts are personal data that are only ever written encrypted (see
+// supplierCmdProc.go), so they're taken out of payloads before they're logged
+func redactPayload(payload json.RawMessage) json.RawMessage {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return payload
+	}
+	redacted := false
+	if _, ok := raw["supplier"]; ok {
+		raw["supplier"], redacted = "redacted", true
+	}
+	if p, ok := raw["product"].(map[string]interface{}); ok {
+		if _, ok := p["supplier"]; ok {
+			p["supplier"], redacted = "redacted", true
+		}
+	}
+	if !redacted {
+		return payload
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return payload
+	}
+	return b
+}
+
+// The key store subject that a command's sealed payload belongs to. commands is a reserved
+// namespace, so it can't be taken for a product's subject (see supplierSubject)
+func commandSubject(uid string) string {
+	return fmt.Sprintf("commands/%s", uid)
+}
+
+// Redacts a command's payload so it can be kept, sealing the original when anything was taken out
+// of it so that it can still be processed. The sealed payload is nil when nothing was redacted
+func (cp CmdProc) SealPayload(uid string, payload json.RawMessage) (json.RawMessage, *models.Sealed, error) {
+	redacted := redactPayload(payload)
+	if bytes.Equal(redacted, payload) {
+		return payload, nil, nil
+	}
+	sealed, err := keystore.Seal(cp.keys, commandSubject(uid), payload)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Could not seal the payload of command %s: %v", uid, err))
+	}
+	return redacted, sealed, nil
+}
+
+// Opens a payload sealed by SealPayload
+func (cp CmdProc) OpenPayload(uid string, sealed *models.Sealed) (json.RawMessage, error) {
+	payload, err := keystore.Open(cp.keys, sealed)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not open the payload of command %s: %v", uid, err))
+	}
+	return payload, nil
+}
+
+// Destroys the key a command's payload was sealed with, once the payload isn't needed
+func (cp CmdProc) ForgetPayload(uid string) error {
+	return cp.keys.Forget(commandSubject(uid))
+}
+
+// Records a command in its namespace's command log, with the outcome err implies. The entry's
+// namespace, SKU and command type are taken from cmd when it's given, which it isn't when the
+// command couldn't be unmarshaled. Commands for namespaces that don't exist aren't logged, so
+// logging never creates a namespace
+func (cp CmdProc) LogCommand(cmd interface{}, entry events.CommandLogged, err error) error {
+	entry = cp.logEntry(cmd, entry, err)
+	entry.Payload = redactPayload(entry.Payload)
+	return cp.writeLogEntry(entry)
+}
+
+// Records a command that was refused before it was processed, by its namespace's rate limit or
+// for the principal's roles say. The entry is logged without the command's payload, and refusals
+// beyond refusalsLoggedPerSecond aren't logged at all
+func (cp CmdProc) LogRefusedCommand(cmd interface{}, entry events.CommandLogged, err error) error {
+	entry = cp.logEntry(cmd, entry, err)
+	entry.Payload = nil
+	if len(entry.Namespace) == 0 ||
+		cp.refusals.take(entry.Namespace, refusalsLoggedPerSecond, time.Now()) > 0 {
+		return nil
+	}
+	return cp.writeLogEntry(entry)
+}
+
+// Fills in the entry for a command, see LogCommand
+func (cp CmdProc) logEntry(cmd interface{}, entry events.CommandLogged, err error) events.CommandLogged {
+	if n, ok := cmd.(commands.Namespaced); ok {
+		entry.Namespace = n.GetNamespace()
+	}
+	if p, ok := cmd.(commands.ForProduct); ok {
+		entry.SKU = p.GetSKU()
+	}
+	if t := commands.CommandTypeOf(cmd); len(t) > 0 {
+		entry.CommandType = t
+	}
+	if cp.principal != nil {
+		entry.Principal = cp.principal.Name
+	}
+	entry.Outcome = CommandOutcome(err)
+	entry.Error = ""
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	return entry
+}
+
+// Writes an entry to its namespace's command log, unless the namespace doesn't exist
+func (cp CmdProc) writeLogEntry(entry events.CommandLogged) error {
+	if len(entry.Namespace) == 0 {
+		return nil
+	}
+	found, e := cp.es.NamespaceExists(entry.Namespace)
+	if e != nil || !found {
+		return e
+	}
+	data, e := json.Marshal(entry)
+	if e != nil {
+		return errors.New(fmt.Sprintf("Could not marshal %s event", events.CommandLoggedT))
+	}
+	// written straight to the store rather than with writeEvents, so that a namespace's quotas
+	// can't stop its commands being logged. Each entry stands on its own, so the log can be cut
+	// anywhere; marking them all snapshots lets a retention policy trim it
+	_, e = cp.es.WriteEvent(entry.Namespace, commandLogStreamId, eventStore.ANY, 0, &eventStore.EventEnvelope{
+		EventType: events.CommandLoggedT,
+		Timestamp: time.Now().Local().UnixNano(),
+		Data:      data,
+		Actor:     cp.actor(),
+		Snapshot:  true,
+	})
+	return e
+}
+
+// Processes a command the API was sent, then records it in the command log with the events it
+// wrote, returning them as event refs. Failing to log the command is only reported in the
+// server's log, the command's outcome is what's returned
+func (cp CmdProc) ProcessLoggedCommand(cmd interface{}, entry events.CommandLogged) ([]string, error) {
+	cp.written = &[]string{}
+	err := cp.ProcessProductCommand(cmd)
+	entry.Events = *cp.written
+	if logErr := cp.LogCommand(cmd, entry, err); logErr != nil {
+		log.Printf("processor: Could not log command %s: %v", entry.UID, logErr)
+	}
+	return entry.Events, err
+}
+
+// Gets the commands in a namespace's command log, oldest first. Only commands for the SKU, and
+// with the outcome, are included when they're given
+func (cp CmdProc) GetCommandLog(ns string, sku string, outcome string) ([]CommandLogEntry, error) {
+	switch outcome {
+	case "", events.COMMAND_ACCEPTED, events.COMMAND_REJECTED, events.COMMAND_CONFLICT:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown outcome '%s', expected %s, %s or %s", outcome,
+			events.COMMAND_ACCEPTED, events.COMMAND_REJECTED, events.COMMAND_CONFLICT))
+	}
+	entries := []CommandLogEntry{}
+	found, err := cp.es.StreamExists(ns, commandLogStreamId)
+	if err != nil || !found {
+		return entries, err
+	}
+	es, err := cp.es.GetEventRange(ns, commandLogStreamId, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range es {
+		var logged events.CommandLogged
+		if err := json.Unmarshal(e.Data, &logged); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not unmarshal %s event %v", e.EventType, e.SeqNum))
+		}
+		if (len(sku) > 0 && logged.SKU != sku) || (len(outcome) > 0 && logged.Outcome != outcome) {
+			continue
+		}
+		entries = append(entries, CommandLogEntry{logged, e.SeqNum, e.Timestamp})
+	}
+	return entries, nil
+}
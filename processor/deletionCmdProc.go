@@ -0,0 +1,120 @@
+//
+// Products are deleted with a tombstone, a ProductDeleted event at the end of the product's
+// stream. The history stays in the event store, but the product is left out of listings and
+// commands against it fail until the SKU is created again. Removing a stream outright is an
+// administrative operation that bypasses the events altogether.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+)
+
+// Reports whether a product has been deleted. A product's stream ends with a tombstone exactly
+// when it's deleted, since nothing but a create is accepted after one (and deleted products are
+// never snapshotted, see snapshotProduct)
+func (cp CmdProc) isDeleted(ns string, sku string) (bool, error) {
+	es, err := cp.es.GetEventRange(ns, sku, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	return len(es) > 0 && es[len(es)-1].EventType == events.ProductDeletedT, nil
+}
+
+// Works out how a create product command writes to the SKU's stream. A new SKU needs a new
+// stream, a deleted one is created again after its tombstone
+func (cp CmdProc) createMode(ns string, sku string) (eventStore.ConcurrencyMode, int64, error) {
+	exists, err := cp.es.StreamExists(ns, sku)
+	if err != nil || !exists {
+		return eventStore.NEW_STREAM, 0, err
+	}
+	product, err := cp.getProductIncludingDeleted(ns, sku)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !product.IsDeleted {
+		return 0, 0, errors.New(fmt.Sprintf("SKU %s already exists on %s", sku, ns))
+	}
+	return eventStore.EXPECTING_SEQ_NUM, product.SequenceNum, nil
+}
+
+func (cp CmdProc) deleteProduct(cmd *commands.DeleteProductCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	e := events.ProductDeleted{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Reason:    cmd.Reason,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.ProductDeletedT, &e)
+	return err
+}
+
+// Permanently removes a stream and its events from the event store. This isn't an event, so
+// listeners aren't told about it and projections built from the stream have to be rebuilt.
+// Removing a product's stream removes what depends on it as well (see deleteProductDependents),
+// since a SKU created again numbers its events from 0
+func (cp CmdProc) DeleteStream(ns string, streamId string) error {
+	isProduct := IsProductStream(streamId)
+	if isProduct {
+		exists, err := cp.es.StreamExists(ns, streamId)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return errors.New(fmt.Sprintf("No such stream %s in namespace %s", streamId, ns))
+		}
+		if err := cp.deleteProductDependents(ns, streamId); err != nil {
+			return err
+		}
+	}
+	if err := cp.es.DeleteStream(ns, streamId); err != nil {
+		return err
+	}
+	log.Printf("processor: Deleted stream %s in namespace %s", streamId, ns)
+	if isProduct {
+		// only once the stream is gone, there's no getting the keys back
+		if err := cp.keys.Forget(supplierSubject(ns, streamId)); err != nil {
+			return errors.New(fmt.Sprintf("Deleted stream %s in namespace %s but could not destroy its keys: %v",
+				streamId, ns, err))
+		}
+	}
+	return nil
+}
+
+// Removes the product from the collections it's a member of, which is recorded in the
+// collections' streams, and removes the head check monitor's stream for it, whose state refers
+// to the product's sequence numbers
+func (cp CmdProc) deleteProductDependents(ns string, sku string) error {
+	cols, err := cp.GetCollections(ns)
+	if err != nil {
+		return err
+	}
+	for _, col := range cols {
+		if col.IndexOf(sku) < 0 {
+			continue
+		}
+		cmd := &commands.RemoveCollectionProductCmd{
+			CollectionCmd: commands.CollectionCmd{Namespace: ns, CollectionId: col.CollectionId},
+			SKU:           sku,
+		}
+		if err := cp.removeCollectionProduct(cmd); err != nil {
+			return err
+		}
+	}
+	monitor := headCheckMonitorStreamId(sku)
+	exists, err := cp.es.StreamExists(ns, monitor)
+	if err != nil || !exists {
+		return err
+	}
+	return cp.es.DeleteStream(ns, monitor)
+}
@@ -0,0 +1,132 @@
+//
+// The head check monitor (see the processManager package) keeps its own event sourced state for
+// each product it watches, in a reserved stream alongside the product. The monitor makes the
+// decisions, the command processor only records them, so the monitor's state is written the same
+// way as every other aggregate's.
+//
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+)
+
+const headCheckMonitorStreamPrefix = ReservedStreamPrefix + "pm-headcheck-"
+
+// Maps a SKU to the ID of the stream that holds the head check monitor's events for the product
+func headCheckMonitorStreamId(sku string) string {
+	return headCheckMonitorStreamPrefix + sku
+}
+
+// Gets the head check monitor's state for a product. A product the monitor hasn't seen yet gets
+// a fresh state, with a sequence number of -1 since its stream doesn't exist
+func (cp CmdProc) GetHeadCheckMonitor(ns string, sku string) (*models.HeadCheckMonitorModel, error) {
+	fresh := &models.HeadCheckMonitorModel{Namespace: ns, SKU: sku, SequenceNum: -1, LastObserved: -1}
+	streamId := headCheckMonitorStreamId(sku)
+	ok, err := cp.es.StreamExists(ns, streamId)
+	if err != nil || !ok {
+		return fresh, err
+	}
+	es, err := cp.es.GetEventRange(ns, streamId, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	return HeadCheckMonitorReducer(fresh, es)
+}
+
+func (cp CmdProc) recordHeadCheckObserved(cmd *commands.RecordHeadCheckObservedCmd) error {
+	state, err := cp.GetHeadCheckMonitor(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	if cmd.HeadCheckSeqNum <= state.LastObserved {
+		return errors.New(fmt.Sprintf("Head check %v of %s in %s has already been observed",
+			cmd.HeadCheckSeqNum, cmd.SKU, cmd.Namespace))
+	}
+
+	evs := []typedEvent{{events.HeadCheckObservedT, &events.HeadCheckObserved{
+		Namespace:       cmd.Namespace,
+		SKU:             cmd.SKU,
+		HeadCheckSeqNum: cmd.HeadCheckSeqNum,
+		Success:         cmd.Success,
+		CausationId:     cmd.CausationId,
+	}}}
+	switch cmd.Decision {
+	case "":
+	case models.HEADCHECK_MONITOR_DEACTIVATE:
+		evs = append(evs, typedEvent{events.ProductAutoDeactivatedT, &events.ProductAutoDeactivated{
+			Namespace:   cmd.Namespace,
+			SKU:         cmd.SKU,
+			Reason:      cmd.Reason,
+			CausationId: cmd.CausationId,
+		}})
+	case models.HEADCHECK_MONITOR_REACTIVATE:
+		evs = append(evs, typedEvent{events.ProductAutoReactivatedT, &events.ProductAutoReactivated{
+			Namespace:   cmd.Namespace,
+			SKU:         cmd.SKU,
+			Reason:      cmd.Reason,
+			CausationId: cmd.CausationId,
+		}})
+	default:
+		return errors.New(fmt.Sprintf("Unknown head check monitor decision '%s'", cmd.Decision))
+	}
+
+	cMode := eventStore.EXPECTING_SEQ_NUM
+	if state.SequenceNum < 0 {
+		cMode = eventStore.NEW_STREAM
+	}
+	_, err = cp.writeEvents(cmd.Namespace, headCheckMonitorStreamId(cmd.SKU), cMode, state.SequenceNum, evs...)
+	return err
+}
+
+// Folds the head check monitor's events into its state for a product
+func HeadCheckMonitorReducer(startingModel *models.HeadCheckMonitorModel, es []eventStore.EventEnvelope) (*models.HeadCheckMonitorModel, error) {
+	cur := *startingModel
+	for _, e := range es {
+		switch e.EventType {
+		case events.HeadCheckObservedT:
+			var o events.HeadCheckObserved
+			if err := json.Unmarshal(e.Data, &o); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal HeadCheckObserved event"))
+			}
+			cur.LastObserved = o.HeadCheckSeqNum
+			cur.LastCausationId = o.CausationId
+			if o.Success {
+				// a product that passes a head check is no longer inactive because of failures,
+				// whether the monitor or somebody else reactivated it
+				cur.ConsecutiveFailures = 0
+				cur.AutoDeactivated = false
+			} else {
+				cur.ConsecutiveFailures++
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.HeadCheckMonitorSnapshotT:
+			var s events.HeadCheckMonitorSnapshot
+			if err := json.Unmarshal(e.Data, &s); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal HeadCheckMonitorSnapshot event"))
+			}
+			cur = s.State
+			cur.SequenceNum = e.SeqNum
+
+		case events.ProductAutoDeactivatedT:
+			cur.AutoDeactivated = true
+			cur.SequenceNum = e.SeqNum
+
+		case events.ProductAutoReactivatedT:
+			cur.AutoDeactivated = false
+			cur.SequenceNum = e.SeqNum
+
+		default:
+			return nil, errors.New(fmt.Sprintf("Unexpected event type %s in head check monitor stream", e.EventType))
+		}
+	}
+	return &cur, nil
+}
@@ -0,0 +1,82 @@
+//
+// Stream metadata is kept by the event store beside a stream's events (see
+// eventStore.StreamMetadata). It isn't part of the aggregate, so setting it doesn't write an event
+// and doesn't move the stream's sequence number on; it has a version of its own instead, which a
+// caller setting metadata gives back to show it has seen the latest. The ACL is checked for the
+// principal commands are processed for (see CheckStreamAccess), and admins in the stream's
+// namespace always pass it, so no stream can be put out of reach.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+
+	"github.com/efvincent/archex5/auth"
+	"github.com/efvincent/archex5/eventStore"
+)
+
+// Checks the stream's ACL gives the principal the commands are being processed for the access (see
+// eventStore.StreamAcl), returning a *auth.AclError when it doesn't. Commands the server issues
+// itself aren't subject to ACLs
+func (cp CmdProc) CheckStreamAccess(ns string, streamId string, access string) error {
+	if cp.principal == nil || cp.principal.Can(ns, auth.ROLE_ADMIN) {
+		return nil
+	}
+	m, err := cp.es.GetStreamMetadata(ns, streamId)
+	if err != nil {
+		return err
+	}
+	if m.Acl == nil {
+		return nil
+	}
+	if listed := m.Acl.Principals(access); len(listed) > 0 && !cp.principal.Listed(listed) {
+		return &auth.AclError{Principal: cp.principal.Name, Access: access, Namespace: ns, StreamId: streamId}
+	}
+	return nil
+}
+
+// Gets the metadata of a product's stream
+func (cp CmdProc) GetProductMetadata(ns string, sku string) (eventStore.StreamMetadata, error) {
+	if _, err := cp.GetProduct(ns, sku); err != nil {
+		return eventStore.StreamMetadata{}, err
+	}
+	return cp.es.GetStreamMetadata(ns, sku)
+}
+
+// Replaces the metadata of a product's stream, if it's still at the version in m, returning the
+// new version
+func (cp CmdProc) SetProductMetadata(ns string, sku string, m eventStore.StreamMetadata) (int64, error) {
+	if _, err := cp.GetProduct(ns, sku); err != nil {
+		return 0, err
+	}
+	if err := validateMetadata(m); err != nil {
+		return 0, err
+	}
+	version, err := cp.es.SetStreamMetadata(ns, sku, m.Version, m)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("processor: Set metadata of %s/%s to version %v", ns, sku, version)
+	return version, nil
+}
+
+func validateMetadata(m eventStore.StreamMetadata) error {
+	if err := validateRetention(m.Retention); err != nil {
+		return err
+	}
+	if len(m.ContentType) > 0 {
+		if _, _, err := mime.ParseMediaType(m.ContentType); err != nil {
+			return errors.New(fmt.Sprintf("Content type %s is not a media type: %v", m.ContentType, err))
+		}
+	}
+	for k := range m.Custom {
+		if len(k) == 0 {
+			return errors.New("Custom metadata keys can't be empty")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+//
+// Namespaces hold a tenant's products and collections. A namespace can be created up front with
+// settings that apply to everything in it: the currencies its prices can be in, the default
+// retention policy of its streams, and its quotas (see QuotaError). Namespaces that are created
+// by their first write (when the event store isn't strict) have no settings until they're given
+// some.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/models"
+)
+
+// Names that can't be used for namespaces, since they're the first segment of the API's routes
+// that aren't a namespace's
+var reservedNamespaces = map[string]bool{"admin": true, "command": true, "commands": true, "namespaces": true}
+
+// Refuses namespace names that are reserved. Checked when a namespace is created, and on every
+// write, since a write to a namespace that doesn't exist creates it when the store isn't strict
+func checkNamespaceName(ns string) error {
+	if reservedNamespaces[ns] {
+		return errors.New(fmt.Sprintf("%s is reserved, it can't be used as a namespace", ns))
+	}
+	return nil
+}
+
+func (cp CmdProc) CreateNamespace(ns string, settings eventStore.NamespaceSettings) error {
+	if len(ns) == 0 {
+		return errors.New("A namespace needs a name")
+	}
+	if err := checkNamespaceName(ns); err != nil {
+		return err
+	}
+	if err := validateNamespaceSettings(settings); err != nil {
+		return err
+	}
+	if err := cp.es.CreateNamespace(ns, settings); err != nil {
+		return err
+	}
+	log.Printf("processor: Created namespace %s with %+v", ns, settings)
+	return nil
+}
+
+// Replaces a namespace's settings. Quotas and allowed currencies only apply to commands
+// processed from now on, what's already in the namespace is left as it is
+func (cp CmdProc) SetNamespaceSettings(ns string, settings eventStore.NamespaceSettings) error {
+	if err := validateNamespaceSettings(settings); err != nil {
+		return err
+	}
+	if err := cp.es.SetNamespaceSettings(ns, settings); err != nil {
+		return err
+	}
+	log.Printf("processor: Set the settings of namespace %s to %+v", ns, settings)
+	return nil
+}
+
+// Removes a namespace. One that still has streams is only removed when force is set, and then
+// everything in it goes with it
+func (cp CmdProc) DeleteNamespace(ns string, force bool) error {
+	info, err := cp.es.GetNamespaceInfo(ns)
+	if err != nil {
+		return err
+	}
+	if info.Streams > 0 && !force {
+		return errors.New(fmt.Sprintf("Namespace %s has %v streams, it can only be deleted with everything in it",
+			ns, info.Streams))
+	}
+	if err := cp.es.DeleteNamespace(ns); err != nil {
+		return err
+	}
+	log.Printf("processor: Deleted namespace %s and its %v streams", ns, info.Streams)
+	return nil
+}
+
+func (cp CmdProc) GetNamespaceInfo(ns string) (eventStore.NamespaceInfo, error) {
+	return cp.es.GetNamespaceInfo(ns)
+}
+
+func validateNamespaceSettings(settings eventStore.NamespaceSettings) error {
+	seen := map[string]bool{}
+	for _, c := range settings.AllowedCurrencies {
+		if !models.IsCurrency(c) {
+			return errors.New(fmt.Sprintf("Unknown currency '%s'", c))
+		}
+		if seen[c] {
+			return errors.New(fmt.Sprintf("Currency %s is allowed more than once", c))
+		}
+		seen[c] = true
+	}
+	if err := validateRetention(settings.DefaultRetention); err != nil {
+		return err
+	}
+	q := settings.Quotas
+	if q.MaxStreams < 0 || q.MaxEventsPerStream < 0 || q.MaxPayloadBytes < 0 || q.CommandsPerSecond < 0 {
+		return errors.New("Quotas can't be negative")
+	}
+	return nil
+}
+
+// Gets a namespace's info, which is empty for a namespace that doesn't exist yet
+func (cp CmdProc) namespaceInfo(ns string) (eventStore.NamespaceInfo, error) {
+	exists, err := cp.es.NamespaceExists(ns)
+	if err != nil || !exists {
+		return eventStore.NamespaceInfo{Namespace: ns}, err
+	}
+	return cp.es.GetNamespaceInfo(ns)
+}
+
+// Refuses prices in currencies the namespace doesn't allow
+func (cp CmdProc) checkCurrencies(ns string, prices ...models.Money) error {
+	info, err := cp.namespaceInfo(ns)
+	if err != nil {
+		return err
+	}
+	settings := info.Settings
+	if len(settings.AllowedCurrencies) == 0 {
+		return nil
+	}
+	for _, p := range prices {
+		allowed := false
+		for _, c := range settings.AllowedCurrencies {
+			allowed = allowed || c == p.Currency
+		}
+		if !allowed {
+			return errors.New(fmt.Sprintf("Prices in %s can't be in %s, the namespace allows %v",
+				ns, p.Currency, settings.AllowedCurrencies))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+//
+// Price changes that look suspicious compared to the product's price history are held rather
+// than applied, see updatePrice. Held requests wait for a person to approve or reject them.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+)
+
+// Requested prices that drop more than this percentage below the reference price, or rise
+// to more than this multiple of it, are held for approval
+const (
+	maxPriceDropPercent    = 50
+	maxPriceIncreaseFactor = 3
+)
+
+// How many of the most recently applied prices are considered when working out what the
+// price of a product normally is
+const priceHistoryWindow = 5
+
+// Works out the price a requested price change is compared against - the median of the most
+// recently applied prices, so that a single past outlier that was approved doesn't move the
+// goalposts. Products without any applied changes are compared against their current price
+func referencePrice(product *models.ProductModel) models.Money {
+	amounts := []int64{}
+	for i := len(product.PriceChangeRequests) - 1; i >= 0 && len(amounts) < priceHistoryWindow; i-- {
+		pc := product.PriceChangeRequests[i]
+		if pc.Status == models.PRICE_CHANGE_APPLIED && pc.RequestedPrice.Currency == product.Price.Currency {
+			amounts = append(amounts, pc.RequestedPrice.Amount)
+		}
+	}
+	if len(amounts) == 0 {
+		return product.Price
+	}
+	sort.Slice(amounts, func(i, j int) bool { return amounts[i] < amounts[j] })
+	m := len(amounts) / 2
+	median := amounts[m]
+	if len(amounts)%2 == 0 {
+		median = (amounts[m-1] + amounts[m]) / 2
+	}
+	return models.Money{Amount: median, Currency: product.Price.Currency}
+}
+
+// Compares a requested price with the reference price, returning the reason the change should
+// be held for approval, or an empty string if the change can be applied
+func evaluatePriceChange(ref models.Money, price models.Money) string {
+	if ref.Amount <= 0 || ref.Currency != price.Currency {
+		return ""
+	}
+	if price.Amount*100 < ref.Amount*(100-maxPriceDropPercent) {
+		return fmt.Sprintf("%v is more than %v%% below the reference price %v", price, maxPriceDropPercent, ref)
+	}
+	if price.Amount > ref.Amount*maxPriceIncreaseFactor {
+		return fmt.Sprintf("%v is more than %vx the reference price %v", price, maxPriceIncreaseFactor, ref)
+	}
+	return ""
+}
+
+// Updates the status of a price change request in the model being reduced
+func setPriceChangeStatus(cur *models.ProductModel, requestId string, status string, reason string) {
+	if i := cur.PriceChangeIndex(requestId); len(requestId) > 0 && i >= 0 {
+		cur.PriceChangeRequests = append([]models.PriceChange{}, cur.PriceChangeRequests...)
+		cur.PriceChangeRequests[i].Status = status
+		if len(reason) > 0 {
+			cur.PriceChangeRequests[i].Reason = reason
+		}
+	}
+}
+
+// Gets the product and the pending price change request a command refers to
+func (cp CmdProc) getPendingPriceChange(ns string, sku string, requestId string) (*models.ProductModel, *models.PriceChange, error) {
+	product, err := cp.GetProduct(ns, sku)
+	if err != nil {
+		return nil, nil, err
+	}
+	i := product.PriceChangeIndex(requestId)
+	if len(requestId) == 0 || i < 0 {
+		return nil, nil, errors.New(fmt.Sprintf("No such price change %s for sku %s in %s", requestId, sku, ns))
+	}
+	pc := product.PriceChangeRequests[i]
+	if pc.Status != models.PRICE_CHANGE_PENDING {
+		return nil, nil, errors.New(fmt.Sprintf("Price change %s for sku %s in %s is %s, not pending",
+			requestId, sku, ns, pc.Status))
+	}
+	return product, &pc, nil
+}
+
+func (cp CmdProc) approvePriceChange(cmd *commands.ApprovePriceChangeCmd) error {
+	product, pc, err := cp.getPendingPriceChange(cmd.Namespace, cmd.SKU, cmd.RequestId)
+	if err != nil {
+		return err
+	}
+
+	// the approval and the price change it leads to are recorded together
+	approved := events.PriceChangeApproved{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		RequestId: cmd.RequestId,
+		Note:      cmd.Note,
+	}
+	pu := events.PriceUpdated{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Price:     pc.RequestedPrice,
+		RequestId: cmd.RequestId,
+	}
+	_, err = cp.writeEvents(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum,
+		typedEvent{events.PriceChangeApprovedT, &approved},
+		typedEvent{events.PriceUpdatedT, &pu})
+	return err
+}
+
+func (cp CmdProc) rejectPriceChange(cmd *commands.RejectPriceChangeCmd) error {
+	product, _, err := cp.getPendingPriceChange(cmd.Namespace, cmd.SKU, cmd.RequestId)
+	if err != nil {
+		return err
+	}
+
+	e := events.PriceChangeRejected{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		RequestId: cmd.RequestId,
+		Reason:    cmd.Reason,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.PriceChangeRejectedT, &e)
+	return err
+}
+
+// Gets the price change requests in a namespace that are waiting for approval, oldest first
+func (cp CmdProc) GetPendingPriceChanges(ns string) ([]models.PendingPriceChange, error) {
+	skus, err := cp.GetSkus(ns)
+	if err != nil {
+		return nil, err
+	}
+	pending := []models.PendingPriceChange{}
+	for _, sku := range skus {
+		product, err := cp.GetProduct(ns, sku)
+		if err != nil {
+			return nil, err
+		}
+		for _, pc := range product.PriceChangeRequests {
+			if pc.Status == models.PRICE_CHANGE_PENDING {
+				pending = append(pending, models.PendingPriceChange{
+					Namespace:    ns,
+					SKU:          sku,
+					CurrentPrice: product.Price,
+					Request:      pc,
+				})
+			}
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Request.Timestamp < pending[j].Request.Timestamp })
+	return pending, nil
+}
@@ -10,23 +10,138 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/efvincent/archex5/auth"
 	"github.com/efvincent/archex5/commands"
 	"github.com/efvincent/archex5/eventStore"
 	"github.com/efvincent/archex5/eventStore/MemoryEventStore"
 	"github.com/efvincent/archex5/eventStore/esErrors.go"
 	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/headcheck"
+	"github.com/efvincent/archex5/keystore"
 	"github.com/efvincent/archex5/models"
 	validation "github.com/go-ozzo/ozzo-validation"
+	"github.com/google/uuid"
 )
 
 type CmdProc struct {
-	es eventStore.EventStore
+	es        eventStore.EventStore
+	listeners *eventListeners
+	checker   headcheck.Checker
+	keys      keystore.KeyStore
+	// how many events a stream with a retention policy gets between snapshots
+	snapshotEvery int
+	// each namespace's rate limit, see AdmitCommand, and the rate its refused commands are logged
+	// at, see LogRefusedCommand
+	limiter  *rateLimiter
+	refusals *rateLimiter
+	// taken by principals' writes to namespaces with stream or event quotas, see checkQuotas
+	quotaLocks *namespaceLocks
+	// who the commands are being processed for, see ActingAs
+	principal *auth.Principal
+	// which of the commands sent for principals are allowed, everything they have the roles for
+	// when nil
+	policy *auth.Policy
+	// collects refs to the events written while a command is processed, see ProcessLoggedCommand
+	written *[]string
 }
 
 func MakeCmdProc() *CmdProc {
-	return &CmdProc{MemoryEventStore.SingletonMemoryEventStore}
+	return MakeCmdProcWithStore(MemoryEventStore.SingletonMemoryEventStore)
+}
+
+// Makes a command processor that reads and writes events with the given event store
+func MakeCmdProcWithStore(es eventStore.EventStore) *CmdProc {
+	return &CmdProc{es, &eventListeners{}, headcheck.MakeDefaultChecker(), keystore.SingletonMemoryKeyStore,
+		DefaultSnapshotEvery, makeRateLimiter(), makeRateLimiter(), makeNamespaceLocks(), nil, nil, nil}
+}
+
+// Gets a command processor that processes commands for the principal, recording it as the actor
+// in the events they write. The command processor itself is left as it was
+func (cp CmdProc) ActingAs(p *auth.Principal) CmdProc {
+	cp.principal = p
+	return cp
+}
+
+// The name the events being written record as their actor, empty when the commands aren't
+// being processed for a principal
+func (cp CmdProc) actor() string {
+	if cp.principal == nil {
+		return ""
+	}
+	return cp.principal.Name
+}
+
+// Sets the policy that decides which commands principals can send. Commands that aren't being
+// processed for a principal, the ones the server issues itself, aren't subject to it
+func (cp *CmdProc) SetPolicy(p *auth.Policy) {
+	cp.policy = p
+}
+
+// Checks the policy allows the principal the command is being processed for to send it, returning
+// a *auth.PolicyError when it doesn't, and that the ACL of the product's stream gives it write
+// access (delete access for deletes), returning a *auth.AclError when it doesn't
+func (cp CmdProc) Authorize(cmd interface{}) error {
+	if cp.principal == nil {
+		return nil
+	}
+	ns := ""
+	if n, ok := cmd.(commands.Namespaced); ok {
+		ns = n.GetNamespace()
+	}
+	if cp.policy != nil {
+		if err := cp.policy.Authorize(*cp.principal, commands.CommandTypeOf(cmd), ns); err != nil {
+			return err
+		}
+	}
+	if p, ok := cmd.(commands.ForProduct); ok {
+		access := eventStore.ACL_WRITE
+		if _, ok := cmd.(*commands.DeleteProductCmd); ok {
+			access = eventStore.ACL_DELETE
+		}
+		return cp.CheckStreamAccess(ns, p.GetSKU(), access)
+	}
+	return nil
+}
+
+// Replaces the checker used to perform head checks
+func (cp *CmdProc) SetHeadChecker(c headcheck.Checker) {
+	cp.checker = c
+}
+
+// Replaces the key store that sensitive fields are sealed with. Events sealed with keys the new
+// store doesn't have can't be opened with it
+func (cp *CmdProc) SetKeyStore(ks keystore.KeyStore) {
+	cp.keys = ks
+}
+
+// Listeners are called after the command processor has written events, with the envelopes as
+// they were stored (including their sequence numbers). They're called synchronously on the
+// goroutine that processed the command, so anything slow should be handed off.
+type EventListener func(ns string, streamId string, es []eventStore.EventEnvelope)
+
+type eventListeners struct {
+	mutex     sync.Mutex
+	listeners []EventListener
+}
+
+// Registers a listener to be called whenever the command processor writes events
+func (cp *CmdProc) AddListener(l EventListener) {
+	cp.listeners.mutex.Lock()
+	defer cp.listeners.mutex.Unlock()
+	cp.listeners.listeners = append(cp.listeners.listeners, l)
+}
+
+func (cp CmdProc) notify(ns string, streamId string, es []eventStore.EventEnvelope) {
+	cp.listeners.mutex.Lock()
+	ls := append([]EventListener{}, cp.listeners.listeners...)
+	cp.listeners.mutex.Unlock()
+	for _, l := range ls {
+		l(ns, streamId, es)
+	}
 }
 
 // Private utility function that gets a product aggregate from the event store given the namespace
@@ -35,6 +150,22 @@ func MakeCmdProc() *CmdProc {
 // even use a two stage local/remote cache to store aggregates so you don't have to fold over
 // all the events every time to get an aggregate
 func (cp CmdProc) GetProduct(ns string, sku string) (*models.ProductModel, error) {
+	product, err := cp.getProductIncludingDeleted(ns, sku)
+	if err != nil {
+		return nil, err
+	}
+	if product.IsDeleted {
+		return nil, errors.New(fmt.Sprintf("SKU %s on %s has been deleted", sku, ns))
+	}
+	if err := cp.openSupplier(product); err != nil {
+		return nil, err
+	}
+	return product, nil
+}
+
+// Gets a product aggregate whether or not the product has been deleted. Deleted products are
+// only of interest to commands that deal with deletion, everything else uses GetProduct
+func (cp CmdProc) getProductIncludingDeleted(ns string, sku string) (*models.ProductModel, error) {
 	es, err := cp.es.GetEventRange(ns, sku, 0, -1)
 	if err != nil {
 		return nil, err
@@ -45,8 +176,107 @@ func (cp CmdProc) GetProduct(ns string, sku string) (*models.ProductModel, error
 	return ProductReducer(&models.ProductModel{}, es)
 }
 
-// Dispatches the product command to the appropriate command handler
+// Gets a product's events starting at the given sequence number, for process managers that
+// need to see what happened to a product rather than its current state
+func (cp CmdProc) GetProductEvents(ns string, sku string, starting int64) ([]eventStore.EventEnvelope, error) {
+	return cp.es.GetEventRange(ns, sku, starting, -1)
+}
+
+// Gets the namespaces that have been written to
+func (cp CmdProc) GetNamespaces() ([]string, error) {
+	return cp.es.GetNamespaces()
+}
+
+// Streams whose IDs start with this prefix hold aggregates other than products (collections
+// for example), and are never treated as SKUs
+const ReservedStreamPrefix = "$"
+
+// Reports whether a stream in a namespace holds a product, as opposed to one of the other
+// aggregates that share the namespace
+func IsProductStream(streamId string) bool {
+	return !strings.HasPrefix(streamId, ReservedStreamPrefix)
+}
+
+// Gets the SKUs of the products in a namespace, leaving out products that have been deleted
+func (cp CmdProc) GetSkus(ns string) ([]string, error) {
+	streamIds, err := cp.es.GetStreams(ns)
+	if err != nil {
+		return nil, err
+	}
+	skus := []string{}
+	for _, id := range streamIds {
+		if !IsProductStream(id) {
+			continue
+		}
+		deleted, err := cp.isDeleted(ns, id)
+		if err != nil {
+			return nil, err
+		}
+		if !deleted {
+			skus = append(skus, id)
+		}
+	}
+	return skus, nil
+}
+
+// Calls f with every product across all namespaces, leaving out products that have been
+// deleted. Namespaces and products that can't be read are logged and skipped, so that one bad
+// stream doesn't stop a sweep over every other product. why says what the sweep is for, in the log
+func (cp CmdProc) forEachProduct(why string, f func(*models.ProductModel)) error {
+	nss, err := cp.es.GetNamespaces()
+	if err != nil {
+		return err
+	}
+	for _, ns := range nss {
+		streamIds, err := cp.es.GetStreams(ns)
+		if err != nil {
+			log.Printf("processor: Could not list the products in %s %s: %v", ns, why, err)
+			continue
+		}
+		for _, sku := range streamIds {
+			if !IsProductStream(sku) {
+				continue
+			}
+			// read the way GetProduct does, but a deleted product is skipped rather than reported
+			product, err := cp.getProductIncludingDeleted(ns, sku)
+			if err == nil && product.IsDeleted {
+				continue
+			}
+			if err == nil {
+				err = cp.openSupplier(product)
+			}
+			if err != nil {
+				log.Printf("processor: Could not read %s in %s %s: %v", sku, ns, why, err)
+				continue
+			}
+			f(product)
+		}
+	}
+	return nil
+}
+
+// Gets the products across all namespaces whose last head check happened before the given time
+// (in unix nanos) and that the include function wants checked. Products that have never been
+// checked are always due. Products that can't be read are skipped (see forEachProduct)
+func (cp CmdProc) GetHeadCheckDue(before int64, include func(*models.ProductModel) bool) ([]*models.ProductModel, error) {
+	due := []*models.ProductModel{}
+	err := cp.forEachProduct("to head check", func(product *models.ProductModel) {
+		if product.LastHeadCheck < before && include(product) {
+			due = append(due, product)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return due, nil
+}
+
+// Dispatches the product command to the appropriate command handler, once the policy has allowed
+// it (see SetPolicy)
 func (cp CmdProc) ProcessProductCommand(cmd interface{}) error {
+	if err := cp.Authorize(cmd); err != nil {
+		return err
+	}
 	switch c := cmd.(type) {
 	case *commands.CreateProductCmd:
 		return cp.processCreateProduct(c)
@@ -54,17 +284,121 @@ func (cp CmdProc) ProcessProductCommand(cmd interface{}) error {
 		return cp.performHeadCheck(c)
 	case *commands.SetActiveCmd:
 		return cp.setProductActiveState(c)
+	case *commands.DeleteProductCmd:
+		return cp.deleteProduct(c)
+	case *commands.SetSupplierContactCmd:
+		return cp.setSupplierContact(c)
+	case *commands.ForgetSupplierContactCmd:
+		return cp.forgetSupplierContact(c)
 	case *commands.UpdatePriceCmd:
 		return cp.updatePrice(c)
+	case *commands.SetPriceListCmd:
+		return cp.setPriceList(c)
+	case *commands.ApprovePriceChangeCmd:
+		return cp.approvePriceChange(c)
+	case *commands.RejectPriceChangeCmd:
+		return cp.rejectPriceChange(c)
 	case *commands.UpdateProductAttributesCmd:
 		return cp.updateAttribs(c)
 	case *commands.UpdateProductImagesCmd:
 		return cp.updateImages(c)
+	case *commands.AddVariantCmd:
+		return cp.addVariant(c)
+	case *commands.UpdateVariantCmd:
+		return cp.updateVariant(c)
+	case *commands.RetireVariantCmd:
+		return cp.retireVariant(c)
+	case *commands.SchedulePriceChangeCmd:
+		return cp.schedulePriceChange(c)
+	case *commands.ScheduleSetActiveCmd:
+		return cp.scheduleSetActive(c)
+	case *commands.CancelScheduleCmd:
+		return cp.cancelSchedule(c)
+	case *commands.RecordScheduleOutcomeCmd:
+		return cp.recordScheduleOutcome(c)
+	case *commands.RecordHeadCheckObservedCmd:
+		return cp.recordHeadCheckObserved(c)
+	case *commands.CreateCollectionCmd:
+		return cp.createCollection(c)
+	case *commands.RenameCollectionCmd:
+		return cp.renameCollection(c)
+	case *commands.AddCollectionProductCmd:
+		return cp.addCollectionProduct(c)
+	case *commands.RemoveCollectionProductCmd:
+		return cp.removeCollectionProduct(c)
+	case *commands.ReorderCollectionCmd:
+		return cp.reorderCollection(c)
+	case *commands.SetCollectionHeroCmd:
+		return cp.setCollectionHero(c)
 	default:
 		return errors.New(fmt.Sprintf("Unknown command type: %v", c))
 	}
 }
 
+// An event to be written by writeEvents, along with the type it's recorded as
+type typedEvent struct {
+	eventType string
+	event     interface{}
+}
+
+// Serializes events, wraps them in envelopes and writes them to a stream as a single batch using
+// the given consistency mode, so either all of the events are recorded or none are. See
+// performHeadCheck for notes on how consistency failures might be handled.
+func (cp CmdProc) writeEvents(ns string, streamId string, cMode eventStore.ConcurrencyMode, expected int64,
+	evs ...typedEvent) (int64, error) {
+	envs := make([]eventStore.EventEnvelope, len(evs))
+	types := make([]string, len(evs))
+	for i, te := range evs {
+		data, err := json.Marshal(te.event)
+		if err != nil {
+			return 0, errors.New(fmt.Sprintf("Could not marshal %s event", te.eventType))
+		}
+		envs[i] = eventStore.EventEnvelope{
+			EventType: te.eventType,
+			Timestamp: time.Now().Local().UnixNano(),
+			Data:      data,
+			Actor:     cp.actor(),
+		}
+		types[i] = te.eventType
+	}
+	if err := checkNamespaceName(ns); err != nil {
+		return 0, err
+	}
+	written, err := cp.checkQuotas(ns, streamId, envs)
+	if err != nil {
+		return 0, err
+	}
+	newId, err := cp.es.WriteBatch(ns, streamId, cMode, expected, envs)
+	written()
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("processor: Wrote %s with sequence %v on stream %s in namespace %s ",
+		strings.Join(types, ", "), newId, streamId, ns)
+
+	// the batch was written as a block ending at the new sequence number
+	for i := range envs {
+		envs[i].SeqNum = newId - int64(len(envs)-1-i)
+		if cp.written != nil {
+			*cp.written = append(*cp.written, events.EventRef(ns, streamId, envs[i].SeqNum))
+		}
+	}
+	cp.notify(ns, streamId, envs)
+	return newId, nil
+}
+
+// Writes a single event to a stream, see writeEvents
+func (cp CmdProc) writeEvent(ns string, streamId string, cMode eventStore.ConcurrencyMode, expected int64,
+	eventType string, event interface{}) (int64, error) {
+	return cp.writeEvents(ns, streamId, cMode, expected, typedEvent{eventType, event})
+}
+
+// Writes an event to a product's stream, expecting the stream to still be at the sequence
+// number of the aggregate the command was validated against
+func (cp CmdProc) writeProductEvent(ns string, sku string, expected int64, eventType string, event interface{}) (int64, error) {
+	return cp.writeEvent(ns, sku, eventStore.EXPECTING_SEQ_NUM, expected, eventType, event)
+}
+
 func (cp CmdProc) updateImages(cmd *commands.UpdateProductImagesCmd) error {
 	log.Printf("Updating images for %s in %s", cmd.SKU, cmd.Namespace)
 	return nil
@@ -90,45 +424,113 @@ func (cp CmdProc) updatePrice(cmd *commands.UpdatePriceCmd) error {
 	// for the new price, even if it's different from the command. But then we've
 	// *lost information* - there was a request for a new price and we didn't capture that.
 	//
-	// Another approach might be to record the request for new price, examine it in the context
-	// of past price change requests, and determine whether or not to apply that new price.
-	// There's choice here too, we could split update price command into two events, one that
-	// records the request, and if the analysis of past events indicates we chould change the
-	// price, another event that actually changes the current active price. This way we record
-	// the request, and separately record the decision to set the active price.
+	// So instead we record the request for new price, examine it in the context of past price
+	// change requests, and determine whether or not to apply that new price. The update price
+	// command is split into two events, one that records the request, and if the analysis of
+	// past events indicates we should change the price, another event that actually changes the
+	// current active price. If the new price looks suspicious the request is held, and the
+	// decision to apply it is left to the approve and reject price change commands.
+
+	if err := validatePrice(cmd.Price); err != nil {
+		return errors.New(fmt.Sprintf("Invalid price %v for sku %s in %s: %v", cmd.Price, cmd.SKU, cmd.Namespace, err))
+	}
+	if product.Price.Currency != cmd.Price.Currency {
+		return errors.New(fmt.Sprintf("Price for sku %s in %s must be in %s, use the price list for other currencies",
+			cmd.SKU, cmd.Namespace, product.Price.Currency))
+	}
 
-	if cmd.Price <= 0 {
-		return errors.New(fmt.Sprintf("Invalid price %v for sku %s in %s", cmd.Price, cmd.SKU, cmd.Namespace))
+	// the command's unique ID identifies the request, commands that don't come through the
+	// API may not have one
+	requestId := cmd.UID
+	if len(requestId) == 0 {
+		requestId = uuid.New().String()
+	}
+	ref := referencePrice(product)
+	req := events.PriceChangeRequested{
+		Namespace:      cmd.Namespace,
+		SKU:            cmd.SKU,
+		RequestId:      requestId,
+		Price:          cmd.Price,
+		ReferencePrice: ref,
 	}
 
-	// create the event
-	e := events.PriceUpdated{
+	if reason := evaluatePriceChange(ref, cmd.Price); len(reason) > 0 {
+		held := events.PriceChangeHeld{
+			Namespace: cmd.Namespace,
+			SKU:       cmd.SKU,
+			RequestId: requestId,
+			Reason:    reason,
+		}
+		_, err = cp.writeEvents(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum,
+			typedEvent{events.PriceChangeRequestedT, &req},
+			typedEvent{events.PriceChangeHeldT, &held})
+		if err == nil {
+			log.Printf("Price change %s for %s in %s held for approval: %s", requestId, cmd.SKU, cmd.Namespace, reason)
+		}
+		return err
+	}
+
+	pu := events.PriceUpdated{
 		Namespace: cmd.Namespace,
 		SKU:       cmd.SKU,
 		Price:     cmd.Price,
+		RequestId: requestId,
 	}
+	_, err = cp.writeEvents(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum,
+		typedEvent{events.PriceChangeRequestedT, &req},
+		typedEvent{events.PriceUpdatedT, &pu})
+	return err
+}
 
-	// serialize event
-	data, err := json.Marshal(&e)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not marshal event"))
+// Prices must be in a known currency and greater than zero
+func validatePrice(price models.Money) error {
+	if err := price.Validate(); err != nil {
+		return err
+	}
+	if price.Amount <= 0 {
+		return errors.New("price must be greater than zero")
 	}
+	return nil
+}
 
-	// wrap in envelope
-	env := eventStore.EventEnvelope{
-		EventType: events.PriceUpdatedT,
-		Timestamp: time.Now().Local().UnixNano(),
-		Data:      data,
+// Validates a price list against the product's base price, returning it keyed by currency
+func validatePriceList(base models.Money, prices []models.Money) (map[string]models.Money, error) {
+	list := map[string]models.Money{}
+	for _, p := range prices {
+		if err := validatePrice(p); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid price %v in price list: %v", p, err))
+		}
+		if p.Currency == base.Currency {
+			return nil, errors.New(fmt.Sprintf("Price list cannot contain the base price currency %s", base.Currency))
+		}
+		if _, ok := list[p.Currency]; ok {
+			return nil, errors.New(fmt.Sprintf("Price list contains more than one %s price", p.Currency))
+		}
+		list[p.Currency] = p
 	}
+	return list, nil
+}
 
-	// write the event see the head check event for deeper notes on checking consistency errors
-	newId, err := cp.es.WriteEvent(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum, &env)
+func (cp CmdProc) setPriceList(cmd *commands.SetPriceListCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
 	if err != nil {
 		return err
 	}
-	log.Printf("processor: Wrote price with sequence %v on stream %s in namespace %s ",
-		newId, cmd.SKU, cmd.Namespace)
-	return nil
+	list, err := validatePriceList(product.Price, cmd.Prices)
+	if err != nil {
+		return err
+	}
+	if err := cp.checkCurrencies(cmd.Namespace, cmd.Prices...); err != nil {
+		return err
+	}
+
+	e := events.PriceListSet{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Prices:    list,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.PriceListSetT, &e)
+	return err
 }
 
 func (cp CmdProc) setProductActiveState(cmd *commands.SetActiveCmd) error {
@@ -153,63 +555,41 @@ func (cp CmdProc) setProductActiveState(cmd *commands.SetActiveCmd) error {
 
 	// create the event
 	e := events.ActiveStateSet{
-		Namespace: cmd.Namespace,
-		SKU:       cmd.SKU,
-		Active:    cmd.Active,
-	}
-
-	// serialize event
-	data, err := json.Marshal(&e)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not marshal set active event"))
-	}
-
-	// wrap in envelope
-	env := eventStore.EventEnvelope{
-		EventType: events.ActiveStateSetT,
-		Timestamp: time.Now().Local().UnixNano(),
-		Data:      data,
+		Namespace:   cmd.Namespace,
+		SKU:         cmd.SKU,
+		Active:      cmd.Active,
+		Reason:      cmd.Reason,
+		CausationId: cmd.CausationId,
 	}
 
 	// write the event see the head check event for deeper notes on checking consistency errors
-	newId, err := cp.es.WriteEvent(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum, &env)
-	if err != nil {
-		return err
-	}
-	log.Printf("processor: Wrote ActiveStateSet with sequence %v on stream %s in namespace %s ",
-		newId, cmd.SKU, cmd.Namespace)
-	return nil
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.ActiveStateSetT, &e)
+	return err
 }
 
-// Validates that a head check can be performed. If it cannot the command fails,
-// if it can per performed we simulate the headcheck and record the result as an event
+// Validates that a head check can be performed. If it cannot the command fails, if it can be
+// performed the product page and each of its images are checked and the result recorded as an event
 func (cp CmdProc) performHeadCheck(cmd *commands.HeadCheckCmd) error {
 	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
 	if err != nil {
 		return err
 	}
 
-	// HEADCHECK SIMULATED!
-	// perform the headcheck
-	headCheckBad := (time.Now().Nanosecond())/1000%4 == 0
+	result := headcheck.CheckProduct(cp.checker, product.Url, product.Images)
+
+	reason := cmd.Reason
+	if len(reason) == 0 {
+		reason = "command"
+	}
 
-	// Build an event that records the headcheck and serialize it
+	// Build an event that records the headcheck
 	hce := events.HeadCheckPerformed{
 		Namespace: cmd.Namespace,
 		SKU:       cmd.SKU,
-		Reason:    "command",
-		Success:   !headCheckBad,
-	}
-	data, err := json.Marshal(&hce)
-	if err != nil {
-		return errors.New(fmt.Sprintf("Could not marshal head check event"))
-	}
-
-	// Wrap the event in the event envelope
-	e := eventStore.EventEnvelope{
-		EventType: events.HeadCheckPerformedT,
-		Timestamp: time.Now().Local().UnixNano(),
-		Data:      data,
+		Reason:    reason,
+		Success:   result.Success,
+		Info:      result.Info,
+		Checks:    result.Checks,
 	}
 
 	// Write the event into the event store, using the consistency mode that expects a specific sequence number.
@@ -220,7 +600,7 @@ func (cp CmdProc) performHeadCheck(cmd *commands.HeadCheckCmd) error {
 	// commands, it does not. You may want to examine the last head check timestamp and see another one should
 	// be done in the elapsed time. Behavior during a consistency failure is up to the domain, command, current
 	// state, and business rules
-	newId, err := cp.es.WriteEvent(cmd.Namespace, cmd.SKU, eventStore.EXPECTING_SEQ_NUM, product.SequenceNum, &e)
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.HeadCheckPerformedT, &hce)
 	if err != nil {
 		if e, ok := err.(*esErrors.ESError); ok {
 			// we specifically have an event store error, which will have information about the
@@ -234,8 +614,6 @@ func (cp CmdProc) performHeadCheck(cmd *commands.HeadCheckCmd) error {
 		}
 		return err
 	}
-	log.Printf("processor: Wrote HeadCheckPerformed with sequence %v on stream %s in namespace %s ",
-		newId, cmd.SKU, cmd.Namespace)
 	return nil
 }
 
@@ -249,6 +627,38 @@ func (cp CmdProc) processCreateProduct(cmd *commands.CreateProductCmd) error {
 	); err != nil {
 		return err
 	}
+	if err := validatePrice(p.Price); err != nil {
+		return errors.New(fmt.Sprintf("Invalid price %v: %v", p.Price, err))
+	}
+	prices := []models.Money{}
+	for c, lp := range p.PriceList {
+		if c != lp.Currency {
+			return errors.New(fmt.Sprintf("Price list entry %s holds a %s price", c, lp.Currency))
+		}
+		prices = append(prices, lp)
+	}
+	if _, err := validatePriceList(p.Price, prices); err != nil {
+		return err
+	}
+	if err := cp.checkCurrencies(p.Namespace, append(prices, p.Price)...); err != nil {
+		return err
+	}
+	if !IsProductStream(p.SKU) {
+		return errors.New(fmt.Sprintf("Invalid SKU %s, SKUs cannot start with '%s'", p.SKU, ReservedStreamPrefix))
+	}
+	p.IsDeleted = false
+	if p.Supplier != nil {
+		if err := validateSupplier(p.Supplier); err != nil {
+			return err
+		}
+	}
+
+	// A SKU can be created again after it's deleted. The new product starts after the tombstone
+	// in the same stream, so the old product's history is kept
+	cMode, expected, err := cp.createMode(p.Namespace, p.SKU)
+	if err != nil {
+		return err
+	}
 
 	// If valid, make a product created event and attempt to save it to the
 	// event store with the expectation that the stream does not yet exist,
@@ -259,18 +669,19 @@ func (cp CmdProc) processCreateProduct(cmd *commands.CreateProductCmd) error {
 		Source:    "Test",
 		Product:   p,
 	}
-	data, err := json.Marshal(&pe)
-	if err != nil {
-		log.Fatal("Failed to encode JSON")
-	}
-	e := eventStore.EventEnvelope{
-		SeqNum:    0,
-		Timestamp: time.Now().UnixNano(),
-		EventType: events.ProductCreatedT,
-		Data:      data,
+	if p.Supplier != nil {
+		// the supplier contact is personal data, it's only written sealed
+		sealed, err := cp.sealSupplier(p.Namespace, p.SKU, p.Supplier)
+		if err != nil {
+			return err
+		}
+		product := *p
+		product.Supplier = nil
+		pe.Product = &product
+		pe.Supplier = sealed
 	}
 
-	newId, err := cp.es.WriteEvent(p.Namespace, p.SKU, eventStore.NEW_STREAM, 0, &e)
+	_, err = cp.writeEvent(p.Namespace, p.SKU, cMode, expected, events.ProductCreatedT, &pe)
 	if err != nil {
 		// how an error is handled depends on the command being processed, the type of
 		// error, and whether or not the command processor is being run synchronously.
@@ -280,8 +691,6 @@ func (cp CmdProc) processCreateProduct(cmd *commands.CreateProductCmd) error {
 		// for example), you need to decide what to do with a failed event of this type.
 		return err
 	}
-	log.Printf("processor: Wrote ProductCreated with sequence %v on stream %s in namespace %s ",
-		newId, p.SKU, p.Namespace)
 
 	return nil
 }
@@ -293,6 +702,10 @@ func (cp CmdProc) processCreateProduct(cmd *commands.CreateProductCmd) error {
 func ProductReducer(startingModel *models.ProductModel, es []eventStore.EventEnvelope) (*models.ProductModel, error) {
 	cur := *startingModel
 	for _, e := range es {
+		e, err := events.UpcastEvent(e)
+		if err != nil {
+			return nil, err
+		}
 		switch e.EventType {
 		case events.ProductCreatedT:
 			// a product created event produces the product on the event, ignoring
@@ -302,6 +715,17 @@ func ProductReducer(startingModel *models.ProductModel, es []eventStore.EventEnv
 				return nil, errors.New(fmt.Sprintf("Could not unmarshal ProductCreated event"))
 			}
 			cur = *pc.Product
+			cur.SealedSupplier = pc.Supplier
+			cur.SequenceNum = e.SeqNum
+
+		case events.ProductSnapshotT:
+			// like a product created event, a snapshot replaces whatever came before it
+			var ps events.ProductSnapshot
+			if err := json.Unmarshal(e.Data, &ps); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ProductSnapshot event"))
+			}
+			cur = *ps.Product
+			cur.SealedSupplier = ps.Supplier
 			cur.SequenceNum = e.SeqNum
 
 		case events.AttribsUpdatedT:
@@ -326,13 +750,171 @@ func ProductReducer(startingModel *models.ProductModel, es []eventStore.EventEnv
 		case events.PriceUpdatedT:
 			var pu events.PriceUpdated
 			if err := json.Unmarshal(e.Data, &pu); err != nil {
-				return nil, errors.New(fmt.Sprintf("Could not unmarshal ImagesUpdated event"))
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceUpdated event"))
+			}
+			if i := cur.PriceChangeIndex(pu.RequestId); len(pu.RequestId) > 0 && i >= 0 {
+				cur.PriceChangeRequests = append([]models.PriceChange{}, cur.PriceChangeRequests...)
+				cur.PriceChangeRequests[i].Status = models.PRICE_CHANGE_APPLIED
+			} else {
+				// prices applied before requests were recorded separately are their own request
+				cur.PriceChangeRequests = append(cur.PriceChangeRequests, models.PriceChange{
+					RequestedPrice: pu.Price,
+					Timestamp:      e.Timestamp,
+					Status:         models.PRICE_CHANGE_APPLIED,
+				})
 			}
-			cur.PriceChangeRequests = append(cur.PriceChangeRequests, models.PriceChange{
-				RequestedPrice: pu.Price,
+			cur.Price = pu.Price
+			cur.SequenceNum = e.SeqNum
+
+		case events.PriceChangeRequestedT:
+			var pcr events.PriceChangeRequested
+			if err := json.Unmarshal(e.Data, &pcr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceChangeRequested event"))
+			}
+			cur.PriceChangeRequests = append(append([]models.PriceChange{}, cur.PriceChangeRequests...), models.PriceChange{
+				RequestId:      pcr.RequestId,
+				RequestedPrice: pcr.Price,
 				Timestamp:      e.Timestamp,
+				Status:         models.PRICE_CHANGE_REQUESTED,
 			})
-			cur.Price = pu.Price
+			setSchedulePriceRequested(&cur, pcr.RequestId)
+			cur.SequenceNum = e.SeqNum
+
+		case events.PriceChangeHeldT:
+			var pch events.PriceChangeHeld
+			if err := json.Unmarshal(e.Data, &pch); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceChangeHeld event"))
+			}
+			setPriceChangeStatus(&cur, pch.RequestId, models.PRICE_CHANGE_PENDING, pch.Reason)
+			cur.SequenceNum = e.SeqNum
+
+		case events.PriceChangeApprovedT:
+			var pca events.PriceChangeApproved
+			if err := json.Unmarshal(e.Data, &pca); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceChangeApproved event"))
+			}
+			setPriceChangeStatus(&cur, pca.RequestId, models.PRICE_CHANGE_APPROVED, "")
+			cur.SequenceNum = e.SeqNum
+
+		case events.PriceChangeRejectedT:
+			var pcr events.PriceChangeRejected
+			if err := json.Unmarshal(e.Data, &pcr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceChangeRejected event"))
+			}
+			setPriceChangeStatus(&cur, pcr.RequestId, models.PRICE_CHANGE_REJECTED, pcr.Reason)
+			cur.SequenceNum = e.SeqNum
+
+		case events.PriceListSetT:
+			var pl events.PriceListSet
+			if err := json.Unmarshal(e.Data, &pl); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal PriceListSet event"))
+			}
+			cur.PriceList = pl.Prices
+			cur.SequenceNum = e.SeqNum
+
+		case events.VariantAddedT:
+			var va events.VariantAdded
+			if err := json.Unmarshal(e.Data, &va); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal VariantAdded event"))
+			}
+			// copy the slice so the starting model is never mutated by the reducer
+			cur.Variants = append(append([]models.VariantModel{}, cur.Variants...), va.Variant)
+			cur.SequenceNum = e.SeqNum
+
+		case events.VariantUpdatedT:
+			var vu events.VariantUpdated
+			if err := json.Unmarshal(e.Data, &vu); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal VariantUpdated event"))
+			}
+			if i := cur.VariantIndex(vu.Variant.VariantSKU); i >= 0 {
+				cur.Variants = append([]models.VariantModel{}, cur.Variants...)
+				cur.Variants[i] = vu.Variant
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.VariantRetiredT:
+			var vr events.VariantRetired
+			if err := json.Unmarshal(e.Data, &vr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal VariantRetired event"))
+			}
+			if i := cur.VariantIndex(vr.VariantSKU); i >= 0 {
+				cur.Variants = append([]models.VariantModel{}, cur.Variants...)
+				cur.Variants[i].IsActive = false
+				cur.Variants[i].IsRetired = true
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.ScheduleCreatedT:
+			var sc events.ScheduleCreated
+			if err := json.Unmarshal(e.Data, &sc); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ScheduleCreated event"))
+			}
+			cur.Schedules = append(append([]models.ScheduledChange{}, cur.Schedules...), sc.Schedule)
+			cur.SequenceNum = e.SeqNum
+
+		case events.ScheduleStartedT:
+			var ss events.ScheduleStarted
+			if err := json.Unmarshal(e.Data, &ss); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ScheduleStarted event"))
+			}
+			if i := cur.ScheduleIndex(ss.ScheduleId); i >= 0 {
+				cur.Schedules = append([]models.ScheduledChange{}, cur.Schedules...)
+				cur.Schedules[i].Status = models.SCHEDULE_STARTED
+				cur.Schedules[i].RevertPrice = ss.RevertPrice
+				cur.Schedules[i].PriceChangeId = ss.PriceChangeId
+			}
+			cur.SequenceNum = e.SeqNum
+
+		case events.ScheduleCompletedT:
+			var sc events.ScheduleCompleted
+			if err := json.Unmarshal(e.Data, &sc); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ScheduleCompleted event"))
+			}
+			setScheduleStatus(&cur, sc.ScheduleId, models.SCHEDULE_COMPLETED, "")
+			cur.SequenceNum = e.SeqNum
+
+		case events.ScheduleFailedT:
+			var sf events.ScheduleFailed
+			if err := json.Unmarshal(e.Data, &sf); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ScheduleFailed event"))
+			}
+			setScheduleStatus(&cur, sf.ScheduleId, models.SCHEDULE_FAILED, sf.Error)
+			cur.SequenceNum = e.SeqNum
+
+		case events.ScheduleCancelledT:
+			var sc events.ScheduleCancelled
+			if err := json.Unmarshal(e.Data, &sc); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ScheduleCancelled event"))
+			}
+			setScheduleStatus(&cur, sc.ScheduleId, models.SCHEDULE_CANCELLED, "")
+			cur.SequenceNum = e.SeqNum
+
+		case events.SupplierContactSetT:
+			var ss events.SupplierContactSet
+			if err := json.Unmarshal(e.Data, &ss); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal SupplierContactSet event"))
+			}
+			cur.SealedSupplier = &ss.Supplier
+			cur.Supplier = nil
+			cur.SequenceNum = e.SeqNum
+
+		case events.SupplierContactForgottenT:
+			// the keys are gone, so there's nothing left to open
+			cur.SealedSupplier = nil
+			cur.Supplier = &models.SupplierContact{Redacted: true}
+			cur.SequenceNum = e.SeqNum
+
+		case events.ProductDeletedT:
+			cur.IsDeleted = true
+			cur.IsActive = false
+			cur.SequenceNum = e.SeqNum
+
+		case events.ActiveStateSetT:
+			var as events.ActiveStateSet
+			if err := json.Unmarshal(e.Data, &as); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal ActiveStateSet event"))
+			}
+			cur.IsActive = as.Active
 			cur.SequenceNum = e.SeqNum
 
 		case events.HeadCheckPerformedT:
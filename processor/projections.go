@@ -0,0 +1,87 @@
+//
+// Projections fold events from many streams into read models that answer questions no
+// single aggregate can, like which collections a product belongs to. Like the reducers they
+// are pure functions of a starting state and a series of events.
+//
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+)
+
+// Maps each SKU to the IDs of the collections it is a member of
+type CollectionMembership map[string][]string
+
+// Projects collection events into collection membership by SKU. Events from any number of
+// collection streams can be folded in, membership only depends on the order of events within
+// each collection. Events that don't affect membership are ignored.
+func CollectionMembershipProjector(starting CollectionMembership, es []eventStore.EventEnvelope) (CollectionMembership, error) {
+	cur := CollectionMembership{}
+	for sku, ids := range starting {
+		cur[sku] = append([]string{}, ids...)
+	}
+	remove := func(sku string, collectionId string) {
+		ids := []string{}
+		for _, id := range cur[sku] {
+			if id != collectionId {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(cur, sku)
+		} else {
+			cur[sku] = ids
+		}
+	}
+
+	for _, e := range es {
+		switch e.EventType {
+		case events.CollectionProductAddedT:
+			var pa events.CollectionProductAdded
+			if err := json.Unmarshal(e.Data, &pa); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionProductAdded event"))
+			}
+			remove(pa.SKU, pa.CollectionId)
+			cur[pa.SKU] = append(cur[pa.SKU], pa.CollectionId)
+
+		case events.CollectionProductRemovedT:
+			var pr events.CollectionProductRemoved
+			if err := json.Unmarshal(e.Data, &pr); err != nil {
+				return nil, errors.New(fmt.Sprintf("Could not unmarshal CollectionProductRemoved event"))
+			}
+			remove(pr.SKU, pr.CollectionId)
+		}
+	}
+	return cur, nil
+}
+
+// Builds the collection membership projection for a namespace from the collection streams
+// in the event store. THIS IS WHERE YOU'D keep the projection up to date in a read store as
+// events are written rather than rebuilding it for every query.
+func (cp CmdProc) GetCollectionMembership(ns string) (CollectionMembership, error) {
+	streamIds, err := cp.es.GetStreams(ns)
+	if err != nil {
+		return nil, err
+	}
+	membership := CollectionMembership{}
+	for _, id := range streamIds {
+		if !strings.HasPrefix(id, collectionStreamPrefix) {
+			continue
+		}
+		es, err := cp.es.GetEventRange(ns, id, 0, -1)
+		if err != nil {
+			return nil, err
+		}
+		if membership, err = CollectionMembershipProjector(membership, es); err != nil {
+			return nil, err
+		}
+	}
+	return membership, nil
+}
@@ -0,0 +1,273 @@
+//
+// Namespaces are tenants sharing one event store, and quotas keep one of them from taking more
+// than its share (see eventStore.NamespaceQuotas). How much a namespace holds is checked as
+// events are written, with the namespace's principals' writes taking turns between the check
+// and the write so that they can't take it past its quotas together. That only holds within one
+// server: servers sharing an event store can each let a write through. How fast it sends commands is checked by AdmitCommand, which the API calls
+// for every command it's given, with a token bucket per namespace that refills at the namespace's
+// commands per second. Commands the server issues itself (the scheduler's and the process
+// managers') aren't rate limited, since they'd only have to be retried.
+//
+
+package processor
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/eventStore"
+)
+
+// Returned when a command would take a namespace over one of its quotas. RetryAfter is how long
+// until the namespace's rate limit would let the command through, zero when waiting won't help.
+// TooLarge is set when the command, or an event it writes, is larger than the namespace allows,
+// which no retry gets past
+type QuotaError struct {
+	Namespace  string
+	Reason     string
+	RetryAfter time.Duration
+	TooLarge   bool
+}
+
+func (e QuotaError) Error() string {
+	return fmt.Sprintf("Namespace %s is over its quota, %s", e.Namespace, e.Reason)
+}
+
+// How much of its quotas a namespace is using
+type NamespaceUsage struct {
+	Namespace string                     `json:"namespace"`
+	Quotas    eventStore.NamespaceQuotas `json:"quotas"`
+	Streams   int                        `json:"streams"`
+	Events    int                        `json:"events"`
+	// the events in the namespace's fullest stream, and the largest event payload in it
+	MostEventsInStream  int `json:"mostEventsInStream"`
+	LargestPayloadBytes int `json:"largestPayloadBytes"`
+	// commands the API was given for the namespace since the server started, and how many of them
+	// were refused by AdmitCommand
+	CommandsAdmitted int64 `json:"commandsAdmitted"`
+	CommandsRefused  int64 `json:"commandsRefused"`
+	// the commands the namespace can send right now before it's rate limited, left out when it
+	// isn't rate limited
+	CommandsAvailable *float64 `json:"commandsAvailable,omitempty"`
+}
+
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens   float64
+	last     time.Time
+	admitted int64
+	refused  int64
+}
+
+func makeRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// A lock for each namespace, see checkQuotas
+type namespaceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func makeNamespaceLocks() *namespaceLocks {
+	return &namespaceLocks{locks: map[string]*sync.Mutex{}}
+}
+
+// Locks the namespace, returning the func that unlocks it
+func (l *namespaceLocks) lock(ns string) func() {
+	l.mutex.Lock()
+	m, ok := l.locks[ns]
+	if !ok {
+		m = &sync.Mutex{}
+		l.locks[ns] = m
+	}
+	l.mutex.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// Gets the namespace's bucket refilled up to now. Must be called with the mutex held
+func (l *rateLimiter) bucket(ns string, rate float64, now time.Time) *bucket {
+	burst := math.Max(rate, 1)
+	b, ok := l.buckets[ns]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[ns] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b
+}
+
+// Takes a token from the namespace's bucket, returning how long until there's one when it's empty
+func (l *rateLimiter) take(ns string, rate float64, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	b := l.bucket(ns, rate, now)
+	if rate > 0 && b.tokens < 1 {
+		b.refused++
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	if rate > 0 {
+		b.tokens--
+	}
+	b.admitted++
+	return 0
+}
+
+func (l *rateLimiter) refuse(ns string, rate float64, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.bucket(ns, rate, now).refused++
+}
+
+// Checks a command the API was given against its namespace's payload size and rate limit,
+// counting it against the rate limit when it's admitted. payloadBytes is the size of the command
+func (cp CmdProc) AdmitCommand(ns string, payloadBytes int) error {
+	info, err := cp.namespaceInfo(ns)
+	if err != nil {
+		return err
+	}
+	q := info.Settings.Quotas
+	now := time.Now()
+	if q.MaxPayloadBytes > 0 && int64(payloadBytes) > q.MaxPayloadBytes {
+		cp.limiter.refuse(ns, q.CommandsPerSecond, now)
+		return &QuotaError{ns, fmt.Sprintf("commands are limited to %v bytes", q.MaxPayloadBytes), 0, true}
+	}
+	if wait := cp.limiter.take(ns, q.CommandsPerSecond, now); wait > 0 {
+		return &QuotaError{ns, fmt.Sprintf("commands are limited to %v a second", q.CommandsPerSecond), wait, false}
+	}
+	return nil
+}
+
+// Refuses to write events that would take the namespace over its quotas, whether by starting a
+// new stream, by adding to one that's full, or with a payload that's too large. The stream and
+// event counts only hold back principals' commands: the server's own (a head check's outcome, a
+// schedule's) record what happened to what's already there, and refusing them would lose that.
+// When the events can be written, the func returned is called once they have been: a principal's
+// write to a namespace with those quotas holds the namespace's lock until then, so that another
+// can't be counted before it's written
+func (cp CmdProc) checkQuotas(ns string, streamId string, envs []eventStore.EventEnvelope) (func(), error) {
+	written := func() {}
+	info, err := cp.namespaceInfo(ns)
+	if err != nil {
+		return nil, err
+	}
+	q := info.Settings.Quotas
+	if q.MaxStreams == 0 && q.MaxEventsPerStream == 0 && q.MaxPayloadBytes == 0 {
+		return written, nil
+	}
+	for _, e := range envs {
+		if q.MaxPayloadBytes > 0 && int64(len(e.Data)) > q.MaxPayloadBytes {
+			return nil, &QuotaError{ns, fmt.Sprintf("%s events are %v bytes, events are limited to %v",
+				e.EventType, len(e.Data), q.MaxPayloadBytes), 0, true}
+		}
+	}
+	if cp.principal == nil || (q.MaxStreams == 0 && q.MaxEventsPerStream == 0) {
+		return written, nil
+	}
+	unlock := cp.quotaLocks.lock(ns)
+	if err := cp.checkCounts(ns, streamId, envs, q); err != nil {
+		unlock()
+		return nil, err
+	}
+	return unlock, nil
+}
+
+// Checks the namespace's stream and event counts, see checkQuotas
+func (cp CmdProc) checkCounts(ns string, streamId string, envs []eventStore.EventEnvelope,
+	q eventStore.NamespaceQuotas) error {
+	// read again now the namespace is locked, since another write may have started a stream
+	info, err := cp.es.GetNamespaceInfo(ns)
+	if err != nil {
+		return err
+	}
+	found, err := cp.es.StreamExists(ns, streamId)
+	if err != nil {
+		return err
+	}
+	streams, err := cp.quotaStreams(ns, info)
+	if err != nil {
+		return err
+	}
+	if !found && q.MaxStreams > 0 && int64(streams) >= q.MaxStreams {
+		return &QuotaError{ns, fmt.Sprintf("it has its %v streams", q.MaxStreams), 0, false}
+	}
+	if q.MaxEventsPerStream > 0 {
+		held := 0
+		if found {
+			es, err := cp.es.GetEventRange(ns, streamId, 0, -1)
+			if err != nil {
+				return err
+			}
+			held = len(es)
+		}
+		if int64(held+len(envs)) > q.MaxEventsPerStream {
+			return &QuotaError{ns, fmt.Sprintf("stream %s can't hold more than %v events",
+				streamId, q.MaxEventsPerStream), 0, false}
+		}
+	}
+	return nil
+}
+
+// The command log isn't the namespace's doing, so it doesn't count against its quotas
+func (cp CmdProc) quotaStreams(ns string, info eventStore.NamespaceInfo) (int, error) {
+	logged, err := cp.es.StreamExists(ns, commandLogStreamId)
+	if err != nil || !logged {
+		return info.Streams, err
+	}
+	return info.Streams - 1, nil
+}
+
+// Gets how much of its quotas a namespace is using. Every stream in the namespace is read, so
+// this isn't something to call often
+func (cp CmdProc) GetNamespaceUsage(ns string) (NamespaceUsage, error) {
+	info, err := cp.es.GetNamespaceInfo(ns)
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+	q := info.Settings.Quotas
+	streams, err := cp.quotaStreams(ns, info)
+	if err != nil {
+		return NamespaceUsage{}, err
+	}
+	usage := NamespaceUsage{Namespace: ns, Quotas: q, Streams: streams}
+	ids, err := cp.es.GetStreams(ns)
+	if err != nil {
+		return usage, err
+	}
+	for _, id := range ids {
+		if id == commandLogStreamId {
+			continue
+		}
+		es, err := cp.es.GetEventRange(ns, id, 0, -1)
+		if err != nil {
+			return usage, err
+		}
+		usage.Events += len(es)
+		if len(es) > usage.MostEventsInStream {
+			usage.MostEventsInStream = len(es)
+		}
+		for _, e := range es {
+			if len(e.Data) > usage.LargestPayloadBytes {
+				usage.LargestPayloadBytes = len(e.Data)
+			}
+		}
+	}
+
+	cp.limiter.mutex.Lock()
+	defer cp.limiter.mutex.Unlock()
+	b := cp.limiter.bucket(ns, q.CommandsPerSecond, time.Now())
+	usage.CommandsAdmitted, usage.CommandsRefused = b.admitted, b.refused
+	if q.CommandsPerSecond > 0 {
+		available := math.Floor(b.tokens)
+		usage.CommandsAvailable = &available
+	}
+	return usage, nil
+}
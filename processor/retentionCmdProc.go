@@ -0,0 +1,209 @@
+//
+// Retention policies let the event store drop a stream's older events (see
+// eventStore.RetentionPolicy). The store only cuts a stream at a snapshot, so the command
+// processor writes snapshots into the streams that have a policy, every so many events, and
+// only for the aggregates it knows how to snapshot. Streams of other aggregates (collections)
+// are never cut, whatever their policy. A snapshot moves the stream's sequence number on like
+// any other event, so a command validated just before one is written fails its consistency
+// check and has to be retried.
+//
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+)
+
+const DefaultSnapshotEvery = 100
+
+// Sets how many events a stream with a retention policy gets between snapshots, zero stops the
+// command processor writing snapshots
+func (cp *CmdProc) SetSnapshotEvery(n int) {
+	cp.snapshotEvery = n
+}
+
+// Sets a stream's retention policy, or the namespace's default when streamId is empty. A stream's
+// policy is kept in its metadata and the namespace's in its settings, the rest of which are left
+// as they are
+func (cp CmdProc) SetRetention(ns string, streamId string, p eventStore.RetentionPolicy) error {
+	if err := validateRetention(p); err != nil {
+		return err
+	}
+	if len(streamId) == 0 {
+		info, err := cp.es.GetNamespaceInfo(ns)
+		if err != nil {
+			return err
+		}
+		info.Settings.DefaultRetention = p
+		if err := cp.es.SetNamespaceSettings(ns, info.Settings); err != nil {
+			return err
+		}
+		log.Printf("processor: Set default retention of %s to %+v", ns, p)
+		return nil
+	}
+	m, err := cp.es.GetStreamMetadata(ns, streamId)
+	if err != nil {
+		return err
+	}
+	m.Retention = p
+	if _, err := cp.es.SetStreamMetadata(ns, streamId, m.Version, m); err != nil {
+		return err
+	}
+	log.Printf("processor: Set retention of %s/%s to %+v", ns, streamId, p)
+	return nil
+}
+
+// Gets the retention policy set on a stream, or the namespace's default when streamId is empty
+func (cp CmdProc) GetRetention(ns string, streamId string) (eventStore.RetentionPolicy, error) {
+	if len(streamId) == 0 {
+		info, err := cp.es.GetNamespaceInfo(ns)
+		return info.Settings.DefaultRetention, err
+	}
+	m, err := cp.es.GetStreamMetadata(ns, streamId)
+	return m.Retention, err
+}
+
+func validateRetention(p eventStore.RetentionPolicy) error {
+	if p.MaxCount < 0 || p.MaxAge < 0 || p.TruncateBefore < 0 {
+		return errors.New("Retention limits can't be negative")
+	}
+	return nil
+}
+
+// Writes the snapshots that are due, then has the event store remove the events that retention
+// policies no longer keep
+func (cp CmdProc) EnforceRetention() (int, eventStore.ScavengeReport, error) {
+	written, err := cp.writeDueSnapshots()
+	if err != nil {
+		return written, eventStore.ScavengeReport{}, err
+	}
+	report, err := cp.es.Scavenge()
+	return written, report, err
+}
+
+func (cp CmdProc) writeDueSnapshots() (int, error) {
+	written := 0
+	if cp.snapshotEvery <= 0 {
+		return written, nil
+	}
+	nss, err := cp.es.GetNamespaces()
+	if err != nil {
+		return written, err
+	}
+	for _, ns := range nss {
+		info, err := cp.es.GetNamespaceInfo(ns)
+		if err != nil {
+			return written, err
+		}
+		ids, err := cp.es.GetStreams(ns)
+		if err != nil {
+			return written, err
+		}
+		for _, id := range ids {
+			m, err := cp.es.GetStreamMetadata(ns, id)
+			if err != nil {
+				return written, err
+			}
+			policy := info.Settings.DefaultRetention.Merge(m.Retention)
+			if policy.IsZero() {
+				continue
+			}
+			// a stream is cut at its last snapshot before the events its policy drops, so it can
+			// hold up to a snapshot interval more than its max count. Snapshotting at least every
+			// max count events keeps that to twice the max count
+			every := cp.snapshotEvery
+			if policy.MaxCount > 0 && policy.MaxCount < int64(every) {
+				every = int(policy.MaxCount)
+			}
+			ok, err := cp.snapshotIfDue(ns, id, every)
+			if err != nil {
+				// most likely a command wrote to the stream first, the next pass tries again
+				log.Printf("processor: Could not snapshot %s/%s: %v", ns, id, err)
+			}
+			if ok {
+				written++
+			}
+		}
+	}
+	return written, nil
+}
+
+// Writes a snapshot to the end of the stream if it has had every events since its last one
+func (cp CmdProc) snapshotIfDue(ns string, streamId string, every int) (bool, error) {
+	es, err := cp.es.GetEventRange(ns, streamId, 0, -1)
+	if err != nil || len(es) == 0 {
+		return false, err
+	}
+	since := len(es)
+	for i := len(es) - 1; i >= 0; i-- {
+		if es[i].Snapshot {
+			since = len(es) - 1 - i
+			break
+		}
+	}
+	if since < every {
+		return false, nil
+	}
+
+	var te *typedEvent
+	switch {
+	case IsProductStream(streamId):
+		te, err = snapshotProduct(es)
+	case strings.HasPrefix(streamId, headCheckMonitorStreamPrefix):
+		te, err = snapshotHeadCheckMonitor(ns, strings.TrimPrefix(streamId, headCheckMonitorStreamPrefix), es)
+	}
+	if err != nil || te == nil {
+		return false, err
+	}
+
+	data, err := json.Marshal(te.event)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Could not marshal %s event", te.eventType))
+	}
+	// snapshots aren't something that happened to the aggregate, so listeners aren't told
+	last := es[len(es)-1].SeqNum
+	seq, err := cp.es.WriteEvent(ns, streamId, eventStore.EXPECTING_SEQ_NUM, last, &eventStore.EventEnvelope{
+		EventType: te.eventType,
+		Timestamp: time.Now().Local().UnixNano(),
+		Data:      data,
+		Snapshot:  true,
+	})
+	if err != nil {
+		return false, err
+	}
+	log.Printf("processor: Wrote %s with sequence %v on stream %s in namespace %s", te.eventType, seq, streamId, ns)
+	return true, nil
+}
+
+// Deleted products aren't snapshotted, since a deleted product's stream has to end with its
+// tombstone
+func snapshotProduct(es []eventStore.EventEnvelope) (*typedEvent, error) {
+	product, err := ProductReducer(&models.ProductModel{}, es)
+	if err != nil || product.IsDeleted {
+		return nil, err
+	}
+	return &typedEvent{events.ProductSnapshotT, &events.ProductSnapshot{
+		Namespace: product.Namespace,
+		SKU:       product.SKU,
+		Product:   product,
+		Supplier:  product.SealedSupplier,
+	}}, nil
+}
+
+func snapshotHeadCheckMonitor(ns string, sku string, es []eventStore.EventEnvelope) (*typedEvent, error) {
+	fresh := &models.HeadCheckMonitorModel{Namespace: ns, SKU: sku, SequenceNum: -1, LastObserved: -1}
+	state, err := HeadCheckMonitorReducer(fresh, es)
+	if err != nil {
+		return nil, err
+	}
+	return &typedEvent{events.HeadCheckMonitorSnapshotT, &events.HeadCheckMonitorSnapshot{State: *state}}, nil
+}
@@ -0,0 +1,221 @@
+//
+// Scheduled changes are recorded in the product's stream when they're requested, and carried
+// out later by the scheduler, which issues the real commands when they're due and records the
+// outcome with a RecordScheduleOutcomeCmd. Because the schedules are events, the scheduler can
+// rebuild its pending work from the event store after a restart.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	"github.com/google/uuid"
+)
+
+// A scheduled change along with the product it applies to
+type PendingSchedule struct {
+	Namespace string
+	SKU       string
+	Schedule  models.ScheduledChange
+}
+
+// Schedules are identified by the unique ID of the command that created them, commands that
+// don't come through the API may not have one
+func scheduleIdFor(cmd commands.ProductCmd) string {
+	if len(cmd.UID) > 0 {
+		return cmd.UID
+	}
+	return uuid.New().String()
+}
+
+func (cp CmdProc) writeScheduleCreated(cmd commands.ProductCmd, product *models.ProductModel,
+	sc models.ScheduledChange) error {
+	if sc.At <= time.Now().UnixNano() {
+		return errors.New(fmt.Sprintf("Scheduled change for sku %s in %s must be in the future", cmd.SKU, cmd.Namespace))
+	}
+	sc.Status = models.SCHEDULE_PENDING
+	e := events.ScheduleCreated{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Schedule:  sc,
+	}
+	_, err := cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.ScheduleCreatedT, &e)
+	return err
+}
+
+func (cp CmdProc) schedulePriceChange(cmd *commands.SchedulePriceChangeCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	if err := validatePrice(cmd.Price); err != nil {
+		return errors.New(fmt.Sprintf("Invalid price %v for sku %s in %s: %v", cmd.Price, cmd.SKU, cmd.Namespace, err))
+	}
+	if product.Price.Currency != cmd.Price.Currency {
+		return errors.New(fmt.Sprintf("Price for sku %s in %s must be in %s", cmd.SKU, cmd.Namespace, product.Price.Currency))
+	}
+
+	price := cmd.Price
+	sc := models.ScheduledChange{
+		ScheduleId: scheduleIdFor(cmd.ProductCmd),
+		Kind:       models.SCHEDULE_PRICE,
+		Price:      &price,
+		At:         cmd.StartAt.UnixNano(),
+	}
+	if cmd.EndAt != nil {
+		if !cmd.EndAt.After(cmd.StartAt) {
+			return errors.New(fmt.Sprintf("Scheduled price change for sku %s in %s must end after it starts",
+				cmd.SKU, cmd.Namespace))
+		}
+		sc.Until = cmd.EndAt.UnixNano()
+	}
+	return cp.writeScheduleCreated(cmd.ProductCmd, product, sc)
+}
+
+func (cp CmdProc) scheduleSetActive(cmd *commands.ScheduleSetActiveCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	active := cmd.Active
+	sc := models.ScheduledChange{
+		ScheduleId: scheduleIdFor(cmd.ProductCmd),
+		Kind:       models.SCHEDULE_ACTIVE,
+		Active:     &active,
+		At:         cmd.At.UnixNano(),
+	}
+	return cp.writeScheduleCreated(cmd.ProductCmd, product, sc)
+}
+
+func (cp CmdProc) cancelSchedule(cmd *commands.CancelScheduleCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	i := product.ScheduleIndex(cmd.ScheduleId)
+	if len(cmd.ScheduleId) == 0 || i < 0 {
+		return errors.New(fmt.Sprintf("No such scheduled change %s for sku %s in %s", cmd.ScheduleId, cmd.SKU, cmd.Namespace))
+	}
+	// a change that has started (a sale that's running) has already happened, so it can't be cancelled
+	if product.Schedules[i].Status != models.SCHEDULE_PENDING {
+		return errors.New(fmt.Sprintf("Scheduled change %s for sku %s in %s is %s and can no longer be cancelled",
+			cmd.ScheduleId, cmd.SKU, cmd.Namespace, product.Schedules[i].Status))
+	}
+
+	e := events.ScheduleCancelled{
+		Namespace:  cmd.Namespace,
+		SKU:        cmd.SKU,
+		ScheduleId: cmd.ScheduleId,
+		Reason:     cmd.Reason,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.ScheduleCancelledT, &e)
+	return err
+}
+
+func (cp CmdProc) recordScheduleOutcome(cmd *commands.RecordScheduleOutcomeCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	i := product.ScheduleIndex(cmd.ScheduleId)
+	if len(cmd.ScheduleId) == 0 || i < 0 {
+		return errors.New(fmt.Sprintf("No such scheduled change %s for sku %s in %s", cmd.ScheduleId, cmd.SKU, cmd.Namespace))
+	}
+	status := product.Schedules[i].Status
+
+	// only the transitions the scheduler can make are allowed, which also means an outcome
+	// that's recorded twice (after a restart for example) is rejected the second time
+	var eventType string
+	var e interface{}
+	switch {
+	case cmd.Outcome == models.SCHEDULE_STARTED && status == models.SCHEDULE_PENDING:
+		eventType = events.ScheduleStartedT
+		e = &events.ScheduleStarted{
+			Namespace:     cmd.Namespace,
+			SKU:           cmd.SKU,
+			ScheduleId:    cmd.ScheduleId,
+			RevertPrice:   cmd.RevertPrice,
+			PriceChangeId: cmd.PriceChangeId,
+		}
+	case cmd.Outcome == models.SCHEDULE_COMPLETED && (status == models.SCHEDULE_PENDING || status == models.SCHEDULE_STARTED):
+		eventType = events.ScheduleCompletedT
+		e = &events.ScheduleCompleted{
+			Namespace:  cmd.Namespace,
+			SKU:        cmd.SKU,
+			ScheduleId: cmd.ScheduleId,
+		}
+	case cmd.Outcome == models.SCHEDULE_FAILED && (status == models.SCHEDULE_PENDING || status == models.SCHEDULE_STARTED):
+		eventType = events.ScheduleFailedT
+		e = &events.ScheduleFailed{
+			Namespace:  cmd.Namespace,
+			SKU:        cmd.SKU,
+			ScheduleId: cmd.ScheduleId,
+			Error:      cmd.Error,
+		}
+	default:
+		return errors.New(fmt.Sprintf("Cannot record outcome %s for scheduled change %s that is %s",
+			cmd.Outcome, cmd.ScheduleId, status))
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, eventType, e)
+	return err
+}
+
+// Updates the status of a scheduled change in the model being reduced
+func setScheduleStatus(cur *models.ProductModel, scheduleId string, status string, errMsg string) {
+	if i := cur.ScheduleIndex(scheduleId); i >= 0 {
+		cur.Schedules = append([]models.ScheduledChange{}, cur.Schedules...)
+		cur.Schedules[i].Status = status
+		cur.Schedules[i].Error = errMsg
+	}
+}
+
+// Marks the started sale whose price change the request is as having made it, in the model being
+// reduced
+func setSchedulePriceRequested(cur *models.ProductModel, requestId string) {
+	for i, sc := range cur.Schedules {
+		if sc.Status == models.SCHEDULE_STARTED && len(requestId) > 0 && sc.PriceChangeId == requestId {
+			cur.Schedules = append([]models.ScheduledChange{}, cur.Schedules...)
+			cur.Schedules[i].PriceRequested = true
+			return
+		}
+	}
+}
+
+// Gets the scheduled changes across all namespaces that still need to be acted on, by
+// folding over every product stream. Products that can't be read are skipped (see
+// forEachProduct), so they don't keep the scheduler from starting
+func (cp CmdProc) GetPendingSchedules() ([]PendingSchedule, error) {
+	pending := []PendingSchedule{}
+	err := cp.forEachProduct("for pending schedules", func(product *models.ProductModel) {
+		pending = append(pending, pendingSchedules(product)...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// Gets the scheduled changes for one product that still need to be acted on
+func (cp CmdProc) GetPendingProductSchedules(ns string, sku string) ([]PendingSchedule, error) {
+	product, err := cp.GetProduct(ns, sku)
+	if err != nil {
+		return nil, err
+	}
+	return pendingSchedules(product), nil
+}
+
+func pendingSchedules(product *models.ProductModel) []PendingSchedule {
+	pending := []PendingSchedule{}
+	for _, sc := range product.Schedules {
+		if sc.DueAt() > 0 {
+			pending = append(pending, PendingSchedule{product.Namespace, product.SKU, sc})
+		}
+	}
+	return pending
+}
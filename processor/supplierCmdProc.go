@@ -0,0 +1,109 @@
+//
+// Supplier contacts are personal data, and have to be erasable even though events are not. They
+// are sealed with a key belonging to the product before they're written to an event, and
+// forgetting a supplier contact destroys the product's keys. The reducer only ever sees the sealed
+// contact, it's opened when the product is read, and shown as redacted once the keys are gone.
+//
+
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/keystore"
+	"github.com/efvincent/archex5/models"
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// The key store subject that a product's sealed data belongs to
+func supplierSubject(ns string, sku string) string {
+	return fmt.Sprintf("%s/%s", ns, sku)
+}
+
+// Deliberately loose, it only catches values that are obviously not email addresses
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+func validateSupplier(s *models.SupplierContact) error {
+	return validation.ValidateStruct(s,
+		validation.Field(&s.Name, validation.Required),
+		validation.Field(&s.Email, validation.Match(emailPattern)),
+	)
+}
+
+func (cp CmdProc) sealSupplier(ns string, sku string, s *models.SupplierContact) (*models.Sealed, error) {
+	contact := *s
+	contact.Redacted = false
+	plaintext, err := json.Marshal(&contact)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Could not marshal supplier contact for %s on %s", sku, ns))
+	}
+	return keystore.Seal(cp.keys, supplierSubject(ns, sku), plaintext)
+}
+
+// Opens the product's sealed supplier contact into its Supplier field. If the keys have been
+// destroyed the supplier contact is redacted rather than failing the read
+func (cp CmdProc) openSupplier(product *models.ProductModel) error {
+	if product.SealedSupplier == nil {
+		return nil
+	}
+	plaintext, err := keystore.Open(cp.keys, product.SealedSupplier)
+	if err == keystore.ErrKeyDestroyed {
+		product.Supplier = &models.SupplierContact{Redacted: true}
+		return nil
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not open supplier contact for %s on %s: %v",
+			product.SKU, product.Namespace, err))
+	}
+	var contact models.SupplierContact
+	if err := json.Unmarshal(plaintext, &contact); err != nil {
+		return errors.New(fmt.Sprintf("Could not unmarshal supplier contact for %s on %s", product.SKU, product.Namespace))
+	}
+	product.Supplier = &contact
+	return nil
+}
+
+func (cp CmdProc) setSupplierContact(cmd *commands.SetSupplierContactCmd) error {
+	if err := validateSupplier(&cmd.Supplier); err != nil {
+		return err
+	}
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	sealed, err := cp.sealSupplier(cmd.Namespace, cmd.SKU, &cmd.Supplier)
+	if err != nil {
+		return err
+	}
+	e := events.SupplierContactSet{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Supplier:  *sealed,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.SupplierContactSetT, &e)
+	return err
+}
+
+// The keys are destroyed before the event is written. If writing the event fails the supplier
+// contact is still unreadable, which is the outcome that was asked for
+func (cp CmdProc) forgetSupplierContact(cmd *commands.ForgetSupplierContactCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	if err := cp.keys.Forget(supplierSubject(cmd.Namespace, cmd.SKU)); err != nil {
+		return err
+	}
+	e := events.SupplierContactForgotten{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Reason:    cmd.Reason,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.SupplierContactForgottenT, &e)
+	return err
+}
@@ -0,0 +1,35 @@
+//
+// Exports and imports move streams between environments as NDJSON (see maintenance.Export).
+// Like deleting a stream, importing is an administrative operation on the event store rather
+// than a command, so listeners aren't told about imported events.
+//
+
+package processor
+
+import (
+	"io"
+	"log"
+
+	"github.com/efvincent/archex5/maintenance"
+)
+
+// Writes the matching streams' events to w as NDJSON, decrypted if the store is encrypted, with
+// the keys the exported products' supplier contacts are sealed with
+func (cp CmdProc) Export(w io.Writer, opts maintenance.ExportOptions) (maintenance.TransferReport, error) {
+	opts.Subject = func(ns string, streamId string) string {
+		if !IsProductStream(streamId) {
+			return ""
+		}
+		return supplierSubject(ns, streamId)
+	}
+	return maintenance.Export(cp.es, cp.keys, w, opts)
+}
+
+// Reads events exported as NDJSON from r and writes them to their streams, refusing streams in
+// reserved namespaces like any other write. The keys exported with them are added to the key store
+func (cp CmdProc) Import(r io.Reader, opts maintenance.ImportOptions) (maintenance.TransferReport, error) {
+	opts.CheckNamespace = checkNamespaceName
+	report, err := maintenance.Import(cp.es, cp.keys, r, opts)
+	log.Printf("processor: Imported %v events into %v streams, and %v keys", report.Events, report.Streams, report.Keys)
+	return report, err
+}
@@ -0,0 +1,117 @@
+//
+// Variants are sellable variations of a product (sizes, colourways etc). They are part of the
+// product aggregate, so variant commands are validated against the product and their events are
+// written to the product's stream.
+//
+
+package processor
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	validation "github.com/go-ozzo/ozzo-validation"
+)
+
+// Validation shared by the add and update variant commands
+func validateVariant(product *models.ProductModel, v *models.VariantModel) error {
+	if err := validation.ValidateStruct(v,
+		validation.Field(&v.VariantSKU, validation.Required),
+	); err != nil {
+		return err
+	}
+	if v.VariantSKU == product.SKU {
+		return errors.New(fmt.Sprintf("Variant SKU %s cannot be the same as the product SKU", v.VariantSKU))
+	}
+	if v.PriceOverride != nil {
+		if err := validatePrice(*v.PriceOverride); err != nil {
+			return errors.New(fmt.Sprintf("Invalid price override %v for variant %s: %v", *v.PriceOverride, v.VariantSKU, err))
+		}
+		if v.PriceOverride.Currency != product.Price.Currency {
+			return errors.New(fmt.Sprintf("Price override for variant %s must be in %s", v.VariantSKU, product.Price.Currency))
+		}
+	}
+	return nil
+}
+
+func (cp CmdProc) addVariant(cmd *commands.AddVariantCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	v := cmd.Variant
+	if err := validateVariant(product, &v); err != nil {
+		return err
+	}
+
+	// variant SKUs are never reused, even after the variant has been retired, so that
+	// the history of a variant SKU always refers to the same item
+	if product.VariantIndex(v.VariantSKU) >= 0 {
+		return errors.New(fmt.Sprintf("Variant %s already exists on sku %s in %s", v.VariantSKU, cmd.SKU, cmd.Namespace))
+	}
+	v.IsRetired = false
+
+	e := events.VariantAdded{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Variant:   v,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.VariantAddedT, &e)
+	return err
+}
+
+func (cp CmdProc) updateVariant(cmd *commands.UpdateVariantCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+	v := cmd.Variant
+	if err := validateVariant(product, &v); err != nil {
+		return err
+	}
+
+	i := product.VariantIndex(v.VariantSKU)
+	if i < 0 {
+		return errors.New(fmt.Sprintf("No such variant %s on sku %s in %s", v.VariantSKU, cmd.SKU, cmd.Namespace))
+	}
+	if product.Variants[i].IsRetired {
+		return errors.New(fmt.Sprintf("Variant %s on sku %s in %s is retired", v.VariantSKU, cmd.SKU, cmd.Namespace))
+	}
+	// variants are only retired with retire-product-variant, which records why
+	v.IsRetired = false
+
+	e := events.VariantUpdated{
+		Namespace: cmd.Namespace,
+		SKU:       cmd.SKU,
+		Variant:   v,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.VariantUpdatedT, &e)
+	return err
+}
+
+func (cp CmdProc) retireVariant(cmd *commands.RetireVariantCmd) error {
+	product, err := cp.GetProduct(cmd.Namespace, cmd.SKU)
+	if err != nil {
+		return err
+	}
+
+	i := product.VariantIndex(cmd.VariantSKU)
+	if i < 0 {
+		return errors.New(fmt.Sprintf("No such variant %s on sku %s in %s", cmd.VariantSKU, cmd.SKU, cmd.Namespace))
+	}
+	if product.Variants[i].IsRetired {
+		return errors.New(fmt.Sprintf("Variant %s on sku %s in %s is already retired", cmd.VariantSKU, cmd.SKU, cmd.Namespace))
+	}
+
+	e := events.VariantRetired{
+		Namespace:  cmd.Namespace,
+		SKU:        cmd.SKU,
+		VariantSKU: cmd.VariantSKU,
+		Reason:     cmd.Reason,
+	}
+	_, err = cp.writeProductEvent(cmd.Namespace, cmd.SKU, product.SequenceNum, events.VariantRetiredT, &e)
+	return err
+}
@@ -0,0 +1,21 @@
+//
+// Every stream's envelopes are hash chained by the event store (see eventStore.VerifyStream), so
+// an event that was altered, removed or reordered after it was written breaks the chain. This is
+// how the verify command and endpoint check a stream.
+//
+
+package processor
+
+import (
+	"github.com/efvincent/archex5/eventStore"
+)
+
+// Walks a stream's hash chain and reports the first broken link. The chain covers envelopes as
+// they're stored, so the envelopes are read from the innermost store (encrypted, if they are)
+func (cp CmdProc) VerifyStream(ns string, streamId string) (eventStore.VerifyResult, error) {
+	es, err := eventStore.Raw(cp.es).GetEventRange(ns, streamId, 0, -1)
+	if err != nil {
+		return eventStore.VerifyResult{}, err
+	}
+	return eventStore.VerifyStream(ns, streamId, es), nil
+}
@@ -0,0 +1,332 @@
+//
+// The command queue lets the API accept a command without waiting for it to be processed. A
+// queued command is written to a file in the queue's directory before the API answers, so it
+// survives the server stopping, and is processed by a pool of workers. Commands for the same
+// product always go to the same worker, so they're processed in the order they were queued, while
+// commands for different products are processed side by side. Commands that aren't for a product
+// (collection commands, say) are ordered with the rest of their namespace's.
+//
+// Each command's file is rewritten as it's processed, and holds its outcome once it's done, until
+// it's older than the queue's retention. Supplier contacts are redacted from the payload in the
+// file, the original payload is sealed with a key of the command's own (see processor.SealPayload),
+// and both are dropped, and the key destroyed, once the command is done. Commands that were queued or being processed when the
+// server stopped are processed when it starts again, so a command can be processed twice if the
+// server stops partway through it.
+//
+
+package scheduler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/auth"
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	"github.com/efvincent/archex5/processor"
+)
+
+const (
+	DefaultQueueWorkers = 4
+	DefaultQueueRetain  = 24 * time.Hour
+)
+
+// Where a queued command is up to
+const (
+	COMMAND_QUEUED     = "queued"
+	COMMAND_PROCESSING = "processing"
+	COMMAND_DONE       = "done"
+)
+
+type QueuedCommand struct {
+	UID         string `json:"uid"`
+	Namespace   string `json:"ns"`
+	SKU         string `json:"sku,omitempty"`
+	CommandType string `json:"commandType"`
+	// the payload with supplier contacts redacted, and the original sealed when anything was, until
+	// the command is done
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Sealed  *models.Sealed  `json:"sealed,omitempty"`
+	// who sent the command, it's processed for them
+	Principal *auth.Principal `json:"principal,omitempty"`
+	Status    string          `json:"status"`
+	// what became of the command (see events.COMMAND_ACCEPTED), and the events it wrote, once
+	// it's done
+	Outcome string   `json:"outcome,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Events  []string `json:"events,omitempty"`
+	// the order commands were queued in, and when, in unix nanos
+	Seq      int64 `json:"seq"`
+	Queued   int64 `json:"queued"`
+	Finished int64 `json:"finished,omitempty"`
+}
+
+type CommandQueue struct {
+	cp      *processor.CmdProc
+	dir     string
+	retain  time.Duration
+	mutex   *sync.Mutex
+	queued  map[string]*QueuedCommand
+	nextSeq int64
+	lanes   []*lane
+}
+
+// The commands waiting for one of the workers, in order
+type lane struct {
+	mutex   *sync.Mutex
+	ready   *sync.Cond
+	pending []string
+}
+
+// Opens a queue kept in dir, creating the directory if it doesn't exist. The queue's commands are
+// processed by the given number of workers once it's started, and the outcomes of commands that
+// are done are kept for retain
+func MakeCommandQueue(cp *processor.CmdProc, dir string, workers int, retain time.Duration) (*CommandQueue, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &CommandQueue{cp: cp, dir: dir, retain: retain, mutex: &sync.Mutex{}, queued: map[string]*QueuedCommand{}}
+	for i := 0; i < workers; i++ {
+		m := &sync.Mutex{}
+		q.lanes = append(q.lanes, &lane{mutex: m, ready: sync.NewCond(m)})
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var qc QueuedCommand
+		if err := json.Unmarshal(b, &qc); err != nil {
+			return nil, errors.New(fmt.Sprintf("Could not read queued command %s: %v", f, err))
+		}
+		// commands done before payloads were dropped still hold theirs
+		if qc.Status == COMMAND_DONE && (qc.Payload != nil || qc.Sealed != nil) {
+			qc.Payload, qc.Sealed = nil, nil
+			if err := q.save(&qc); err != nil {
+				return nil, err
+			}
+		}
+		q.queued[qc.UID] = &qc
+		if qc.Seq >= q.nextSeq {
+			q.nextSeq = qc.Seq + 1
+		}
+	}
+	return q, nil
+}
+
+// Runs the workers in the background, starting with the commands that weren't done when the queue
+// was last open
+func (q *CommandQueue) Start() {
+	unfinished := []*QueuedCommand{}
+	q.mutex.Lock()
+	for _, qc := range q.queued {
+		if qc.Status != COMMAND_DONE {
+			unfinished = append(unfinished, qc)
+		}
+	}
+	q.mutex.Unlock()
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].Seq < unfinished[j].Seq })
+	for _, qc := range unfinished {
+		q.dispatch(qc)
+	}
+	log.Printf("command queue: Started %v workers with %v commands to catch up on", len(q.lanes), len(unfinished))
+
+	for _, l := range q.lanes {
+		go q.work(l)
+	}
+	go q.sweep()
+}
+
+// Queues a command for processing on behalf of the principal, once it's been written to the
+// queue's directory. payload is the command as the API was sent it, with its uid
+func (q *CommandQueue) Enqueue(uid string, commandType string, payload []byte, cmd interface{},
+	p *auth.Principal) (QueuedCommand, error) {
+	redacted, sealed, err := q.cp.SealPayload(uid, payload)
+	if err != nil {
+		return QueuedCommand{}, err
+	}
+	qc := &QueuedCommand{
+		UID:         uid,
+		CommandType: commandType,
+		Payload:     redacted,
+		Sealed:      sealed,
+		Principal:   p,
+		Status:      COMMAND_QUEUED,
+		Queued:      time.Now().UnixNano(),
+	}
+	if n, ok := cmd.(commands.Namespaced); ok {
+		qc.Namespace = n.GetNamespace()
+	}
+	if fp, ok := cmd.(commands.ForProduct); ok {
+		qc.SKU = fp.GetSKU()
+	}
+
+	q.mutex.Lock()
+	if _, ok := q.queued[uid]; ok {
+		q.mutex.Unlock()
+		return QueuedCommand{}, errors.New(fmt.Sprintf("Command %s is already queued", uid))
+	}
+	qc.Seq = q.nextSeq
+	q.nextSeq++
+	if err := q.save(qc); err != nil {
+		q.mutex.Unlock()
+		return QueuedCommand{}, err
+	}
+	q.queued[uid] = qc
+	saved := *qc
+	q.mutex.Unlock()
+
+	q.dispatch(&saved)
+	return saved, nil
+}
+
+// Gets a queued command, with its outcome if it's done
+func (q *CommandQueue) Get(uid string) (QueuedCommand, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	qc, ok := q.queued[uid]
+	if !ok {
+		return QueuedCommand{}, false
+	}
+	return *qc, true
+}
+
+func (q *CommandQueue) path(uid string) string {
+	return filepath.Join(q.dir, uid+".json")
+}
+
+// Writes a queued command's file. Must be called with the mutex held
+func (q *CommandQueue) save(qc *QueuedCommand) error {
+	b, err := json.Marshal(qc)
+	if err != nil {
+		return err
+	}
+	tmp := q.path(qc.UID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(qc.UID))
+}
+
+// Hands a command to the worker for its product, or its namespace when it isn't for a product
+func (q *CommandQueue) dispatch(qc *QueuedCommand) {
+	h := fnv.New32a()
+	h.Write([]byte(qc.Namespace + "/" + qc.SKU))
+	l := q.lanes[int(h.Sum32()%uint32(len(q.lanes)))]
+	l.mutex.Lock()
+	l.pending = append(l.pending, qc.UID)
+	l.mutex.Unlock()
+	l.ready.Signal()
+}
+
+func (q *CommandQueue) work(l *lane) {
+	for {
+		l.mutex.Lock()
+		for len(l.pending) == 0 {
+			l.ready.Wait()
+		}
+		uid := l.pending[0]
+		l.pending = l.pending[1:]
+		l.mutex.Unlock()
+		q.process(uid)
+	}
+}
+
+// Updates a queued command and writes it to its file, returning a copy of it as it now is
+func (q *CommandQueue) update(uid string, f func(qc *QueuedCommand)) (QueuedCommand, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	qc := q.queued[uid]
+	f(qc)
+	return *qc, q.save(qc)
+}
+
+// The payload a queued command was sent with, opened if it was sealed
+func (q *CommandQueue) payload(qc QueuedCommand) (json.RawMessage, error) {
+	if qc.Sealed == nil {
+		return qc.Payload, nil
+	}
+	return q.cp.OpenPayload(qc.UID, qc.Sealed)
+}
+
+func (q *CommandQueue) process(uid string) {
+	qc, err := q.update(uid, func(qc *QueuedCommand) { qc.Status = COMMAND_PROCESSING })
+	if err != nil {
+		log.Printf("command queue: Could not save command %s: %v", uid, err)
+	}
+
+	var refs []string
+	payload, err := q.payload(qc)
+	var cmd interface{}
+	if err == nil {
+		cmd, err = commands.UnmarshalAsTypedCommand(qc.CommandType, payload)
+	}
+	if err == nil {
+		// the log is given the redacted payload, it has no use for the original
+		entry := events.CommandLogged{UID: qc.UID, CommandType: qc.CommandType, Payload: qc.Payload}
+		refs, err = q.cp.ActingAs(qc.Principal).ProcessLoggedCommand(cmd, entry)
+	}
+	if err != nil {
+		log.Printf("command queue: Command %s failed: %v", uid, err)
+	}
+
+	_, saveErr := q.update(uid, func(qc *QueuedCommand) {
+		qc.Status = COMMAND_DONE
+		qc.Outcome = processor.CommandOutcome(err)
+		qc.Events = refs
+		qc.Finished = time.Now().UnixNano()
+		if err != nil {
+			qc.Error = err.Error()
+		}
+		qc.Payload = nil
+		qc.Sealed = nil
+	})
+	if saveErr != nil {
+		log.Printf("command queue: Could not save command %s: %v", uid, saveErr)
+		return
+	}
+	// the key is only destroyed once the file no longer holds the payload it sealed
+	if qc.Sealed != nil {
+		if err := q.cp.ForgetPayload(uid); err != nil {
+			log.Printf("command queue: Could not destroy the key for command %s: %v", uid, err)
+		}
+	}
+}
+
+// Removes the commands that have been done for longer than the queue keeps them
+func (q *CommandQueue) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		before := time.Now().Add(-q.retain).UnixNano()
+		q.mutex.Lock()
+		for uid, qc := range q.queued {
+			if qc.Status != COMMAND_DONE || qc.Finished >= before {
+				continue
+			}
+			if err := os.Remove(q.path(uid)); err != nil && !os.IsNotExist(err) {
+				log.Printf("command queue: Could not remove command %s: %v", uid, err)
+				continue
+			}
+			delete(q.queued, uid)
+		}
+		q.mutex.Unlock()
+	}
+}
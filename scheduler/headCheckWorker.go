@@ -0,0 +1,160 @@
+//
+// The head check worker keeps head checks fresh without anyone having to ask for them. Every
+// sweep it finds the active products whose last head check is older than the max age, and
+// issues head check commands for them through the command processor. The number of checks in
+// flight is limited, and so is how often any one host is hit, since a namespace's products
+// (and their images) tend to all live on the same few hosts.
+//
+
+package scheduler
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/models"
+	"github.com/efvincent/archex5/processor"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultHeadCheckMaxAge      = time.Hour
+	DefaultHeadCheckSweep       = time.Minute
+	DefaultHeadCheckConcurrency = 4
+	DefaultHeadCheckHostGap     = time.Second
+)
+
+type HeadCheckWorker struct {
+	cp          *processor.CmdProc
+	maxAge      time.Duration
+	sweep       time.Duration
+	concurrency int
+	hostGap     time.Duration
+	alsoCheck   func(*models.ProductModel) bool
+	mutex       *sync.Mutex
+	inFlight    map[productRef]bool
+	nextForHost map[string]time.Time
+}
+
+// Makes a worker that sweeps for stale head checks every sweep interval. An active product is
+// checked when its last head check is older than maxAge. At most concurrency checks run at once,
+// and checks that hit the same host are started at least hostGap apart
+func MakeHeadCheckWorker(cp *processor.CmdProc, maxAge time.Duration, sweep time.Duration,
+	concurrency int, hostGap time.Duration) *HeadCheckWorker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &HeadCheckWorker{
+		cp:          cp,
+		maxAge:      maxAge,
+		sweep:       sweep,
+		concurrency: concurrency,
+		hostGap:     hostGap,
+		mutex:       &sync.Mutex{},
+		inFlight:    map[productRef]bool{},
+		nextForHost: map[string]time.Time{},
+	}
+}
+
+// Active products are always checked, this adds inactive products the function returns true
+// for. The head check monitor uses it so the products it deactivated get a chance to recover
+func (w *HeadCheckWorker) AlsoCheck(f func(*models.ProductModel) bool) {
+	w.alsoCheck = f
+}
+
+// Reports whether the worker keeps the product's head check fresh
+func (w *HeadCheckWorker) wants(p *models.ProductModel) bool {
+	return p.IsActive || (w.alsoCheck != nil && w.alsoCheck(p))
+}
+
+// Runs the worker in the background. The first sweep happens straight away
+func (w *HeadCheckWorker) Start() {
+	log.Printf("headcheck worker: Checking products every %v, max age %v", w.sweep, w.maxAge)
+	go w.run()
+}
+
+func (w *HeadCheckWorker) run() {
+	sem := make(chan struct{}, w.concurrency)
+	ticker := time.NewTicker(w.sweep)
+	defer ticker.Stop()
+	for {
+		w.sweepOnce(sem)
+		<-ticker.C
+	}
+}
+
+// Starts a head check for each stale product that isn't already being checked. A sweep blocks
+// while all the workers are busy, so a slow sweep delays the next rather than piling up
+func (w *HeadCheckWorker) sweepOnce(sem chan struct{}) {
+	due, err := w.cp.GetHeadCheckDue(time.Now().Add(-w.maxAge).UnixNano(), w.wants)
+	if err != nil {
+		log.Printf("headcheck worker: Could not find products due a head check: %v", err)
+		return
+	}
+	for _, p := range due {
+		ref := productRef{p.Namespace, p.SKU}
+		w.mutex.Lock()
+		busy := w.inFlight[ref]
+		w.inFlight[ref] = true
+		w.mutex.Unlock()
+		if busy {
+			continue
+		}
+
+		sem <- struct{}{}
+		go func(p *models.ProductModel, ref productRef) {
+			defer func() {
+				w.mutex.Lock()
+				delete(w.inFlight, ref)
+				w.mutex.Unlock()
+				<-sem
+			}()
+			w.check(p)
+		}(p, ref)
+	}
+}
+
+func (w *HeadCheckWorker) check(p *models.ProductModel) {
+	time.Sleep(w.reserveHosts(p))
+	cmd := &commands.HeadCheckCmd{
+		ProductCmd: commands.ProductCmd{
+			Namespace: p.Namespace,
+			Timestamp: int(time.Now().Unix()),
+			UID:       uuid.New().String(),
+			SKU:       p.SKU,
+		},
+		Reason: "scheduled",
+	}
+	if err := w.cp.ProcessProductCommand(cmd); err != nil {
+		log.Printf("headcheck worker: Head check of %s in %s failed: %v", p.SKU, p.Namespace, err)
+	}
+}
+
+// Reserves the next slot on each host the product's head check will hit, and returns how long
+// to wait before the check can start. Every host is reserved for the same start time, the
+// latest of their next free slots
+func (w *HeadCheckWorker) reserveHosts(p *models.ProductModel) time.Duration {
+	hosts := map[string]bool{}
+	for _, u := range append([]string{p.Url}, p.Images...) {
+		if parsed, err := url.Parse(u); err == nil && len(parsed.Host) > 0 {
+			hosts[parsed.Host] = true
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := time.Now()
+	start := now
+	for h := range hosts {
+		if next := w.nextForHost[h]; next.After(start) {
+			start = next
+		}
+	}
+	for h := range hosts {
+		w.nextForHost[h] = start.Add(w.hostGap)
+	}
+	return start.Sub(now)
+}
@@ -0,0 +1,46 @@
+//
+// The scavenger enforces retention policies in the background. Every sweep it has the command
+// processor write the snapshots that are due, then has the event store remove the events that
+// retention policies no longer keep (see processor.EnforceRetention). Reads leave those events
+// out as soon as a policy stops keeping them, the scavenger is what frees the space.
+//
+
+package scheduler
+
+import (
+	"log"
+	"time"
+
+	"github.com/efvincent/archex5/processor"
+)
+
+const DefaultScavengeSweep = time.Minute
+
+type Scavenger struct {
+	cp    *processor.CmdProc
+	sweep time.Duration
+}
+
+func MakeScavenger(cp *processor.CmdProc, sweep time.Duration) *Scavenger {
+	return &Scavenger{cp: cp, sweep: sweep}
+}
+
+// Runs the scavenger in the background. The first sweep happens after one interval
+func (s *Scavenger) Start() {
+	log.Printf("scavenger: Enforcing retention every %v", s.sweep)
+	go func() {
+		ticker := time.NewTicker(s.sweep)
+		defer ticker.Stop()
+		for range ticker.C {
+			snapshots, report, err := s.cp.EnforceRetention()
+			if err != nil {
+				log.Printf("scavenger: %v", err)
+				continue
+			}
+			if snapshots > 0 || report.Removed > 0 {
+				log.Printf("scavenger: Wrote %v snapshots, removed %v events from %v streams",
+					snapshots, report.Removed, report.Streams)
+			}
+		}
+	}()
+}
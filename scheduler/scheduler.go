@@ -0,0 +1,246 @@
+//
+// The scheduler carries out scheduled changes when they're due. It doesn't change products
+// itself, it issues the same commands an API caller would through the command processor, and
+// then records what happened. Its pending work is rebuilt from the event store when it starts,
+// and kept up to date by listening for the events the command processor writes.
+//
+
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/efvincent/archex5/commands"
+	"github.com/efvincent/archex5/eventStore"
+	"github.com/efvincent/archex5/events"
+	"github.com/efvincent/archex5/models"
+	"github.com/efvincent/archex5/processor"
+	"github.com/google/uuid"
+)
+
+type productRef struct {
+	ns  string
+	sku string
+}
+
+type Scheduler struct {
+	cp       *processor.CmdProc
+	interval time.Duration
+	mutex    *sync.Mutex
+	pending  map[productRef][]models.ScheduledChange
+	dirty    map[productRef]bool
+}
+
+// Makes a scheduler that checks for due changes at the given interval
+func MakeScheduler(cp *processor.CmdProc, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		cp:       cp,
+		interval: interval,
+		mutex:    &sync.Mutex{},
+		pending:  map[productRef][]models.ScheduledChange{},
+		dirty:    map[productRef]bool{},
+	}
+}
+
+// Rebuilds the pending scheduled changes from the event store, then runs the scheduler in the
+// background. The listener is added first so that nothing written during the rebuild is missed
+func (s *Scheduler) Start() error {
+	s.cp.AddListener(s.onEvents)
+	pending, err := s.cp.GetPendingSchedules()
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	for _, p := range pending {
+		ref := productRef{p.Namespace, p.SKU}
+		s.pending[ref] = append(s.pending[ref], p.Schedule)
+	}
+	s.mutex.Unlock()
+	log.Printf("scheduler: Started with %v pending scheduled changes", len(pending))
+
+	go s.run()
+	return nil
+}
+
+// Events that change a product's schedules mark the product to be re-read on the next tick.
+// This is called on the goroutine that wrote the events, so it does no real work itself
+func (s *Scheduler) onEvents(ns string, streamId string, es []eventStore.EventEnvelope) {
+	for _, e := range es {
+		switch e.EventType {
+		case events.ScheduleCreatedT, events.ScheduleStartedT, events.ScheduleCompletedT,
+			events.ScheduleFailedT, events.ScheduleCancelledT:
+			s.mutex.Lock()
+			s.dirty[productRef{ns, streamId}] = true
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+func (s *Scheduler) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.refresh()
+		for _, p := range s.takeDue(time.Now().UnixNano()) {
+			s.act(p)
+		}
+	}
+}
+
+// Re-reads the schedules of the products that have changed since the last tick
+func (s *Scheduler) refresh() {
+	s.mutex.Lock()
+	dirty := s.dirty
+	s.dirty = map[productRef]bool{}
+	s.mutex.Unlock()
+
+	for ref := range dirty {
+		ps, err := s.cp.GetPendingProductSchedules(ref.ns, ref.sku)
+		if err != nil {
+			log.Printf("scheduler: Could not read schedules for %s in %s: %v", ref.sku, ref.ns, err)
+			continue
+		}
+		scs := []models.ScheduledChange{}
+		for _, p := range ps {
+			scs = append(scs, p.Schedule)
+		}
+		s.mutex.Lock()
+		s.pending[ref] = scs
+		s.mutex.Unlock()
+	}
+}
+
+// Removes the changes that are due from the pending changes and returns them. The products
+// they belong to are marked dirty, so if recording the outcome fails the change is picked up
+// again on the next tick - changes are carried out at least once
+func (s *Scheduler) takeDue(now int64) []processor.PendingSchedule {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	due := []processor.PendingSchedule{}
+	for ref, scs := range s.pending {
+		remaining := []models.ScheduledChange{}
+		for _, sc := range scs {
+			if at := sc.DueAt(); at > 0 && at <= now {
+				due = append(due, processor.PendingSchedule{Namespace: ref.ns, SKU: ref.sku, Schedule: sc})
+				s.dirty[ref] = true
+			} else {
+				remaining = append(remaining, sc)
+			}
+		}
+		s.pending[ref] = remaining
+	}
+	return due
+}
+
+func (s *Scheduler) productCmd(p processor.PendingSchedule) commands.ProductCmd {
+	return commands.ProductCmd{
+		Namespace: p.Namespace,
+		Timestamp: int(time.Now().Unix()),
+		UID:       uuid.New().String(),
+		SKU:       p.SKU,
+	}
+}
+
+// Issues a price change for a product, returning an error when it isn't applied. Scheduled price
+// changes go through the same evaluation as any other price change, so a deep discount may be
+// held for approval, which counts as not applied. The change is made with the request ID when
+// one is given
+func (s *Scheduler) updatePrice(p processor.PendingSchedule, price models.Money, requestId string) error {
+	cmd := commands.UpdatePriceCmd{ProductCmd: s.productCmd(p), Price: price}
+	if len(requestId) > 0 {
+		cmd.UID = requestId
+	}
+	if err := s.cp.ProcessProductCommand(&cmd); err != nil {
+		return err
+	}
+	product, err := s.cp.GetProduct(p.Namespace, p.SKU)
+	if err != nil {
+		return err
+	}
+	if i := product.PriceChangeIndex(cmd.UID); i >= 0 && product.PriceChangeRequests[i].Status == models.PRICE_CHANGE_PENDING {
+		return errors.New(fmt.Sprintf("Price change %s was held for approval: %s", cmd.UID,
+			product.PriceChangeRequests[i].Reason))
+	}
+	return nil
+}
+
+func (s *Scheduler) outcomeCmd(p processor.PendingSchedule, outcome string) commands.RecordScheduleOutcomeCmd {
+	return commands.RecordScheduleOutcomeCmd{
+		ProductCmd: s.productCmd(p),
+		ScheduleId: p.Schedule.ScheduleId,
+		Outcome:    outcome,
+	}
+}
+
+func (s *Scheduler) record(p processor.PendingSchedule, outcome commands.RecordScheduleOutcomeCmd) error {
+	if err := s.cp.ProcessProductCommand(&outcome); err != nil {
+		log.Printf("scheduler: Could not record outcome of scheduled change %s for %s in %s: %v",
+			p.Schedule.ScheduleId, p.SKU, p.Namespace, err)
+		return err
+	}
+	log.Printf("scheduler: Scheduled change %s for %s in %s %s", p.Schedule.ScheduleId, p.SKU, p.Namespace, outcome.Outcome)
+	return nil
+}
+
+// Issues the command for a due change and records the outcome
+func (s *Scheduler) act(p processor.PendingSchedule) {
+	sc := p.Schedule
+	outcome := s.outcomeCmd(p, models.SCHEDULE_COMPLETED)
+
+	var err error
+	switch {
+	case sc.Status == models.SCHEDULE_STARTED && len(sc.PriceChangeId) > 0 && !sc.PriceRequested && sc.Price != nil:
+		// the sale was started but its price change never got made, the server stopped in between
+		// for example, so reverting it at the end would change nothing. It's made now, with the
+		// request ID recorded when it started, unless the sale is already over
+		if time.Now().UnixNano() >= sc.Until {
+			err = errors.New("The sale ended before its price could be applied")
+		} else if err = s.updatePrice(p, *sc.Price, sc.PriceChangeId); err == nil {
+			return
+		}
+
+	case sc.Status == models.SCHEDULE_STARTED && sc.RevertPrice != nil:
+		err = s.updatePrice(p, *sc.RevertPrice, "")
+
+	case sc.Kind == models.SCHEDULE_PRICE && sc.Price != nil && sc.Until > 0:
+		// a change with an end time restores the price that was in effect when it started. That
+		// price is recorded before the change is made, so if recording it fails nothing has
+		// changed yet and the change is tried again, rather than the next try taking the changed
+		// price as the one to restore. So is the request ID the change is made with, so that a
+		// change that isn't made after the sale has started can be told apart and made later
+		var product *models.ProductModel
+		if product, err = s.cp.GetProduct(p.Namespace, p.SKU); err == nil {
+			started := s.outcomeCmd(p, models.SCHEDULE_STARTED)
+			revert := product.Price
+			started.RevertPrice = &revert
+			started.PriceChangeId = uuid.New().String()
+			if s.record(p, started) != nil {
+				return
+			}
+			if err = s.updatePrice(p, *sc.Price, started.PriceChangeId); err == nil {
+				return
+			}
+		}
+
+	case sc.Kind == models.SCHEDULE_PRICE && sc.Price != nil:
+		err = s.updatePrice(p, *sc.Price, "")
+
+	case sc.Kind == models.SCHEDULE_ACTIVE && sc.Active != nil:
+		err = s.cp.ProcessProductCommand(&commands.SetActiveCmd{ProductCmd: s.productCmd(p), Active: *sc.Active})
+
+	default:
+		outcome.Outcome = models.SCHEDULE_FAILED
+		outcome.Error = "Scheduled change is missing the value to change to"
+	}
+
+	if err != nil {
+		outcome.Outcome = models.SCHEDULE_FAILED
+		outcome.Error = err.Error()
+	}
+	s.record(p, outcome)
+}